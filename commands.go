@@ -0,0 +1,313 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/renorris/openfsd-client-patch-utility/patch"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// command is a non-interactive subcommand, e.g. `openfsd-patch verify-checksum file.exe`
+type command struct {
+	name        string
+	usage       string
+	description string
+	run         func(args []string) error
+}
+
+var commands = []command{
+	{
+		name:        "verify-checksum",
+		usage:       "verify-checksum <file>",
+		description: "Report whether the PE checksum stored in a file is valid",
+		run:         verifyChecksumCommand,
+	},
+	{
+		name:        "inspect-assembly",
+		usage:       "inspect-assembly <file>",
+		description: "Report the strong name and ReadyToRun status of a .NET assembly",
+		run:         inspectAssemblyCommand,
+	},
+	{
+		name:        "list-bundle",
+		usage:       "list-bundle <file>",
+		description: "List the files embedded in a .NET single-file bundle",
+		run:         listBundleCommand,
+	},
+	{
+		name:        "list-resources",
+		usage:       "list-resources <file>",
+		description: "List the manifest resources of a .NET assembly and their string values",
+		run:         listResourcesCommand,
+	},
+	{
+		name:        "list-qt-resources",
+		usage:       "list-qt-resources <file>",
+		description: "List the files compiled into the Qt resources of a binary",
+		run:         listQtResourcesCommand,
+	},
+	{
+		name:        "list-slices",
+		usage:       "list-slices <file>",
+		description: "List the architectures of a Mach-O file and whether they are code signed",
+		run:         listSlicesCommand,
+	},
+	{
+		name:        "inspect-config",
+		usage:       "inspect-config [--show-secrets] <file>",
+		description: "Decode the network settings of a vPilotConfig.xml file or its directory",
+		run:         inspectConfigCommand,
+	},
+}
+
+// runCommand runs the subcommand named by args[0].
+func runCommand(args []string) (err error) {
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd.run(args[1:])
+		}
+	}
+
+	printUsage()
+	err = fmt.Errorf("unknown command: %s", args[0])
+	return
+}
+
+func printUsage() {
+	fmt.Println("Usage: openfsd-patch [options] [command]")
+	fmt.Println("\nWithout a command, the interactive patcher is started.")
+	fmt.Println("\nOptions:")
+	flag.PrintDefaults()
+	fmt.Println("\nCommands:")
+	for _, cmd := range commands {
+		fmt.Printf("  %-40s %s\n", cmd.usage, cmd.description)
+	}
+}
+
+func verifyChecksumCommand(args []string) (err error) {
+	if len(args) != 1 {
+		err = errors.New("usage: verify-checksum <file>")
+		return
+	}
+
+	file, err := os.Open(args[0])
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	stored, computed, err := patch.VerifyPEChecksum(file)
+	if err != nil {
+		return
+	}
+
+	fmt.Println(describePEChecksum(stored, computed))
+	return
+}
+
+func inspectAssemblyCommand(args []string) (err error) {
+	if len(args) != 1 {
+		err = errors.New("usage: inspect-assembly <file>")
+		return
+	}
+
+	file, err := os.Open(args[0])
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	info, err := patch.InspectDotNetImage(file)
+	if err != nil {
+		return
+	}
+
+	fmt.Printf("IL only: %t\n", info.ILOnly)
+	fmt.Printf("Strong name signed: %t\n", info.StrongNameSigned)
+	if info.ReadyToRun {
+		fmt.Printf("ReadyToRun: yes (version %s)\n", info.ReadyToRunVersion)
+	} else {
+		fmt.Println("ReadyToRun: no")
+	}
+	return
+}
+
+func listBundleCommand(args []string) (err error) {
+	if len(args) != 1 {
+		err = errors.New("usage: list-bundle <file>")
+		return
+	}
+
+	file, err := os.Open(args[0])
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	entries, err := patch.ListBundle(file)
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		compressed := ""
+		if e.Compressed {
+			compressed = " (compressed)"
+		}
+		fmt.Printf("%-40s %-18s %10d%s\n", e.Path, e.Type, e.Size, compressed)
+	}
+	return
+}
+
+func listResourcesCommand(args []string) (err error) {
+	if len(args) != 1 {
+		err = errors.New("usage: list-resources <file>")
+		return
+	}
+
+	file, err := os.Open(args[0])
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	resources, err := patch.ListResources(file)
+	if err != nil {
+		return
+	}
+
+	for _, r := range resources {
+		fmt.Printf("%-60s %10d\n", r.Name, r.Size)
+		for _, s := range r.Strings {
+			fmt.Printf("    %s = %q\n", s.Key, s.Value)
+		}
+	}
+	return
+}
+
+func listQtResourcesCommand(args []string) (err error) {
+	if len(args) != 1 {
+		err = errors.New("usage: list-qt-resources <file>")
+		return
+	}
+
+	file, err := os.Open(args[0])
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	resources, err := patch.ListQtResources(file)
+	if err != nil {
+		return
+	}
+
+	for _, r := range resources {
+		compressed := ""
+		if r.Compression != "" {
+			compressed = fmt.Sprintf(" (%s)", r.Compression)
+		}
+		fmt.Printf("%-60s %10d%s\n", r.Path, r.Size, compressed)
+	}
+	return
+}
+
+func listSlicesCommand(args []string) (err error) {
+	if len(args) != 1 {
+		err = errors.New("usage: list-slices <file>")
+		return
+	}
+
+	file, err := os.Open(args[0])
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	machoSlices, err := patch.ListMachOSlices(file)
+	if err != nil {
+		return
+	}
+
+	for _, s := range machoSlices {
+		signed := ""
+		if s.CodeSigned {
+			signed = " (code signed)"
+		}
+		fmt.Printf("%-10s offset 0x%08X %10d%s\n", s.Architecture, s.Offset, s.Size, signed)
+	}
+	return
+}
+
+func inspectConfigCommand(args []string) (err error) {
+	flags := flag.NewFlagSet("inspect-config", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	showSecrets := flags.Bool("show-secrets", false, "")
+	if err = flags.Parse(args); err != nil || flags.NArg() != 1 {
+		err = errors.New("usage: inspect-config [--show-secrets] <file>")
+		return
+	}
+
+	path := flags.Arg(0)
+	if stat, statErr := os.Stat(path); statErr == nil && stat.IsDir() {
+		path = filepath.Join(path, "vPilotConfig.xml")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	info, err := patch.InspectVPilotConfig(file)
+	if err != nil {
+		return
+	}
+
+	fmt.Printf("Network status URL: %s\n", describeConfigValue(info.NetworkStatusURL, false))
+	if len(info.CachedServers) == 0 {
+		fmt.Println("Cached servers: (none)")
+	} else {
+		fmt.Println("Cached servers:")
+		for _, server := range info.CachedServers {
+			fmt.Printf("    %s\n", describeConfigValue(server, false))
+		}
+	}
+	fmt.Printf("Network login: %s\n", describeConfigValue(info.NetworkLogin, !*showSecrets))
+	fmt.Printf("Network password: %s\n", describeConfigValue(info.NetworkPassword, !*showSecrets))
+	return
+}
+
+// describeConfigValue describes a decoded config value, masking secrets.
+func describeConfigValue(value patch.VPilotConfigValue, secret bool) (description string) {
+	if value.Missing {
+		return "(missing)"
+	}
+	if value.Value == "" {
+		return "(empty)"
+	}
+
+	description = value.Value
+	if secret {
+		description = "******** (use --show-secrets to reveal)"
+	}
+	if value.Err != nil {
+		description += fmt.Sprintf(" (%s)", value.Err)
+	}
+	return
+}
+
+// describePEChecksum describes the state of a stored PE checksum.
+func describePEChecksum(stored uint32, computed uint32) string {
+	switch {
+	case stored == 0:
+		return fmt.Sprintf("PE checksum: not set (computed 0x%08X)", computed)
+	case stored == computed:
+		return fmt.Sprintf("PE checksum: valid (0x%08X)", stored)
+	default:
+		return fmt.Sprintf("PE checksum: invalid (stored 0x%08X, computed 0x%08X)", stored, computed)
+	}
+}
@@ -4,22 +4,36 @@ import (
 	"bufio"
 	"context"
 	"crypto/sha1"
+	"crypto/sha256"
 	"embed"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/renorris/openfsd-client-patch-utility/patch"
 	"github.com/renorris/openfsd-client-patch-utility/patchfile"
+	"golang.org/x/term"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 )
 
 //go:embed enabled_patchfiles
 var enabledPatchfiles embed.FS
 
-func runFlow(ctx context.Context) {
-	defer bufio.NewReader(os.Stdin).ReadString('\n')
+// credentialOptions are the vPilot credential settings given on the command
+// line or in the environment.
+type credentialOptions struct {
+	mode     string
+	cid      string
+	password string
+}
+
+func runFlow(ctx context.Context, credentials credentialOptions) {
+	stdin := bufio.NewReader(os.Stdin)
+	defer stdin.ReadString('\n')
 
 	patchFile, err := selectPatchfile()
 	if err != nil {
@@ -28,76 +42,270 @@ func runFlow(ctx context.Context) {
 		return
 	}
 
-	targetFile, err := patchFile.OpenTargetFile()
+	targets, err := openTargets(patchFile)
 	if err != nil {
 		fmt.Printf("error opening target file: %s\n", err.Error())
 		return
 	}
-	defer targetFile.Close()
+	defer closeTargets(targets)
 
-	var ok bool
-	if ok, err = verifyChecksum(targetFile, patchFile.ExpectedSum); err != nil {
+	// Every target is verified before any of them is patched or reverted
+	if err = verifyTargets(targets); err != nil {
 		fmt.Printf("error validating checksum: %s\n", err.Error())
 		return
-	} else if !ok {
-		if err = restoreBackup(targetFile); err != nil {
-			fmt.Printf("error restoring backup: %s\n\nPlease reinstall your openfsd client.", err.Error())
-			return
-		}
-
-		// Restore backups for secondary files
-		for _, fileName := range patchFile.MakeBackupsFor {
-			var file *os.File
-			if file, err = os.OpenFile(fileName, os.O_RDWR, 0666); err != nil {
-				fmt.Printf("error opening secondary file for restoration: %s\n", err.Error())
-				return
+	}
+	if slices.ContainsFunc(targets, func(t *target) bool { return !t.original }) {
+		for _, t := range targets {
+			if t.original {
+				continue
 			}
-			if err = restoreBackup(file); err != nil {
-				fmt.Printf("error restoring backup for secondary file: %s\n", err.Error())
+			if _, err = os.Stat(t.file.Name() + ".orig"); err != nil {
+				fmt.Printf("error restoring backup: %s does not match the patchfile and has no backup\n\nPlease reinstall your openfsd client.", t.file.Name())
 				return
 			}
-			file.Close()
+		}
+
+		if err = revertTargets(patchFile, targets); err != nil {
+			fmt.Printf("%s\n\nPlease reinstall your openfsd client.", err.Error())
+			return
 		}
 
 		fmt.Println("Reverted patches.")
 		return
 	}
 
+	if patchFile.VPilotConfigPatch != nil {
+		if err = resolveCredentials(stdin, patchFile.VPilotConfigPatch, credentials); err != nil {
+			fmt.Printf("error reading credentials: %s\n", err.Error())
+			return
+		}
+	}
+
 	// Make backups for secondary files
 	for _, fileName := range patchFile.MakeBackupsFor {
-		var file *os.File
-		if file, err = os.Open(fileName); err != nil {
+		if err = backupSecondaryFile(fileName); err != nil {
+			fmt.Printf("error making backup of secondary file %s: %s\n", fileName, err.Error())
 			return
 		}
-		if err = makeBackup(file); err != nil {
+	}
+
+	for _, t := range targets {
+		if err = makeBackup(t.file); err != nil {
 			fmt.Printf("error making backup: %s\n", err.Error())
 			return
 		}
-		file.Close()
 	}
 
-	if err = makeBackup(targetFile); err != nil {
-		fmt.Printf("error making backup: %s\n", err.Error())
+	for _, t := range targets {
+		warnAuthenticode(t.file, t.patchFile.Authenticode)
+		warnDotNetImage(t.file, t.patchFile)
+		warnCodeSignature(t.file)
+
+		if t.patches, err = extractPatches(t.patchFile); err != nil {
+			fmt.Printf("error extracting patches: %s\n", err.Error())
+			return
+		}
+	}
+
+	fmt.Println("Executing patches...")
+	if err = runPatches(targets); err != nil {
+		fmt.Printf("failed: %s\n", err.Error())
+
+		// Targets are patched as a unit, so none of them is left patched
+		if err = revertTargets(patchFile, targets); err != nil {
+			fmt.Printf("%s\n\nPlease reinstall your openfsd client.", err.Error())
+			return
+		}
+		fmt.Println("Reverted the patches applied so far.")
 		return
 	}
 
-	patches, err := extractPatches(patchFile)
+	fmt.Println("\nApplied all patches. Run this program again to revert.")
+}
+
+// target is a file patched by a patchfile, along with the patchfile entry for it.
+type target struct {
+	patchFile *patchfile.PatchFile
+	file      *os.File
+	patches   []patch.Patch
+
+	// original reports whether the file matches an expected checksum, i.e. is not patched
+	original bool
+}
+
+// openTargets opens the target files of a patchfile.
+func openTargets(patchFile *patchfile.PatchFile) (targets []*target, err error) {
+	for _, targetPatchFile := range patchFile.AllTargets() {
+		var file *os.File
+		if file, err = targetPatchFile.OpenTargetFile(); err != nil {
+			closeTargets(targets)
+			return nil, err
+		}
+		targets = append(targets, &target{patchFile: targetPatchFile, file: file})
+	}
+	return
+}
+
+func closeTargets(targets []*target) {
+	for _, t := range targets {
+		t.file.Close()
+	}
+}
+
+// verifyTargets records which targets match their expected checksums, and
+// applies the variant of the patchfile matching each of them.
+func verifyTargets(targets []*target) (err error) {
+	for _, t := range targets {
+		var sums patchfile.Checksums
+		if sums, err = computeChecksums(t.file); err != nil {
+			err = fmt.Errorf("%s: %w", t.file.Name(), err)
+			return
+		}
+
+		var variant *patchfile.Variant
+		if t.original, variant = t.patchFile.SelectVariant(sums); variant != nil {
+			fmt.Printf("%s matches variant %s\n", filepath.Base(t.file.Name()), variant.Name)
+		}
+	}
+	return
+}
+
+// runPatches runs the patches of every target, and reports the PE checksum of each.
+func runPatches(targets []*target) (err error) {
+	i := 0
+	for _, t := range targets {
+		if len(targets) > 1 {
+			fmt.Printf("%s:\n", t.patchFile.Name)
+		}
+		for _, p := range t.patches {
+			i++
+			fmt.Printf("%d - %s... ", i, p.Name())
+			if err = p.Run(t.file); err != nil {
+				return
+			}
+			fmt.Printf("done\n")
+			if reporter, ok := p.(patch.Reporter); ok {
+				for _, line := range reporter.Report() {
+					fmt.Printf("    %s\n", line)
+				}
+			}
+		}
+	}
+
+	for _, t := range targets {
+		if stored, computed, checksumErr := patch.VerifyPEChecksum(t.file); checksumErr == nil {
+			if len(targets) > 1 {
+				fmt.Printf("\n%s: %s\n", filepath.Base(t.file.Name()), describePEChecksum(stored, computed))
+			} else {
+				fmt.Printf("\n%s\n", describePEChecksum(stored, computed))
+			}
+			if stored != 0 && stored != computed {
+				fmt.Println("Set update_checksum: true in the patchfile to recompute it.")
+			}
+		}
+	}
+	return
+}
+
+// revertTargets undoes a patchfile: its patches revert their own changes, then
+// the target files and secondary files are restored from their backups.
+// Targets without a backup were not patched and are left alone.
+func revertTargets(patchFile *patchfile.PatchFile, targets []*target) (err error) {
+	reverted, err := revertPatches(patchFile)
 	if err != nil {
-		fmt.Printf("error extracting patches: %s\n", err.Error())
+		return fmt.Errorf("error reverting patches: %w", err)
+	}
+
+	for _, t := range targets {
+		if _, statErr := os.Stat(t.file.Name() + ".orig"); statErr != nil {
+			continue
+		}
+		if err = restoreBackup(t.file); err != nil {
+			return fmt.Errorf("error restoring backup: %w", err)
+		}
+	}
+
+	// Restore backups for secondary files
+	for _, fileName := range patchFile.MakeBackupsFor {
+		// Files reverted by their patches keep the user's changes, so their backup is
+		// dropped, unless they did not exist before patching and are removed
+		_, statErr := os.Stat(fileName + missingBackupSuffix)
+		if statErr != nil && slices.Contains(reverted, filepath.Clean(fileName)) {
+			if err = removeBackup(fileName); err != nil {
+				return fmt.Errorf("error removing backup for secondary file %s: %w", fileName, err)
+			}
+			continue
+		}
+
+		if err = restoreSecondaryFile(fileName); err != nil {
+			return fmt.Errorf("error restoring backup for secondary file %s: %w", fileName, err)
+		}
+	}
+	return
+}
+
+// resolveCredentials applies the credential options to a vPilot config patch,
+// asking the user for the CID and password not given in prompt mode.
+func resolveCredentials(stdin *bufio.Reader, configPatch *patchfile.VPilotConfigPatch, credentials credentialOptions) (err error) {
+	if credentials.mode != "" {
+		configPatch.Credentials = credentials.mode
+	}
+	if configPatch.Credentials != "prompt" {
 		return
 	}
 
-	fmt.Println("Executing patches...")
-	for i, p := range patches {
-		fmt.Printf("%d - %s... ", i+1, p.Name())
-		if err = p.Run(targetFile); err != nil {
-			fmt.Printf("failed: %s\n", err.Error())
+	configPatch.CID, configPatch.Password = credentials.cid, credentials.password
+	if configPatch.CID == "" {
+		fmt.Print("Enter your openfsd CID: ")
+		if configPatch.CID, err = readLine(stdin); err != nil {
+			return
+		}
+	}
+	for _, c := range configPatch.CID {
+		if c < '0' || c > '9' {
+			err = fmt.Errorf("invalid CID: %s", configPatch.CID)
 			return
 		}
-		fmt.Printf("done\n")
 	}
+	if configPatch.Password == "" {
+		fmt.Print("Enter your openfsd password: ")
+		if configPatch.Password, err = readPassword(stdin); err != nil {
+			return
+		}
+	}
+	fmt.Println()
+	return
+}
 
-	fmt.Println("\nApplied all patches. Run this program again to revert.")
+// readLine reads the next non-empty line from stdin.
+func readLine(stdin *bufio.Reader) (line string, err error) {
+	for line == "" {
+		if line, err = stdin.ReadString('\n'); err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+	}
+	return
+}
+
+// readPassword reads a password from the terminal without echoing it, or the
+// next non-empty line when stdin is not a terminal.
+func readPassword(stdin *bufio.Reader) (password string, err error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return readLine(stdin)
+	}
+
+	for password == "" {
+		var line []byte
+		if line, err = term.ReadPassword(fd); err != nil {
+			return
+		}
+		// The newline typed by the user is not echoed either
+		fmt.Println()
+		password = strings.TrimSpace(string(line))
+	}
+	return
 }
 
 func selectPatchfile() (selected *patchfile.PatchFile, err error) {
@@ -163,39 +371,214 @@ func loadPatchfiles(fs embed.FS) (files []*patchfile.PatchFile, err error) {
 }
 
 func extractPatches(patchFile *patchfile.PatchFile) (patches []patch.Patch, err error) {
+	caves := patch.NewCaveAllocator()
+
+	var binaryPatches []patch.Patch
+	if slices.ContainsFunc(patchFile.Sections, func(s patchfile.Section) bool { return s.Unresolved() }) {
+		binaryPatches = append(binaryPatches, patch.NewSectionLookupPatch(patchFile))
+	}
+	for _, s := range patchFile.NewSections {
+		binaryPatches = append(binaryPatches, patch.NewNewSectionPatch(patchFile, &s, caves))
+	}
+	for _, p := range patchFile.StringTablePatches {
+		binaryPatches = append(binaryPatches, patch.NewStringTablePatch(patchFile, &p))
+	}
+	for _, p := range patchFile.VersionInfoPatches {
+		binaryPatches = append(binaryPatches, patch.NewVersionInfoPatch(patchFile, &p))
+	}
+	for _, c := range patchFile.CodeCaves {
+		binaryPatches = append(binaryPatches, patch.NewCodeCavePatch(patchFile, &c, caves))
+	}
 	for _, p := range patchFile.SectionOverwritePatches {
-		patches = append(patches, patch.NewSectionOverwritePatch(patchFile, &p))
+		binaryPatches = append(binaryPatches, patch.NewSectionOverwritePatch(patchFile, &p))
 	}
 	for _, p := range patchFile.SectionPaddedStringPatches {
-		patches = append(patches, patch.NewSectionPaddedStringPatch(patchFile, &p))
+		binaryPatches = append(binaryPatches, patch.NewSectionPaddedStringPatch(patchFile, &p))
+	}
+	if patchFile.DotNetImage != nil {
+		binaryPatches = append(binaryPatches, patch.NewDotNetImagePatch(patchFile.DotNetImage))
 	}
 	for _, p := range patchFile.CilUserstringPatches {
-		patches = append(patches, patch.NewCilUserstringPatch(patchFile, &p))
+		binaryPatches = append(binaryPatches, patch.NewCilUserstringPatch(patchFile, &p))
 	}
+	for _, p := range patchFile.CilBlobPatches {
+		binaryPatches = append(binaryPatches, patch.NewCilBlobPatch(patchFile, &p))
+	}
+	for _, p := range patchFile.CilStringsPatches {
+		binaryPatches = append(binaryPatches, patch.NewCilStringsPatch(patchFile, &p))
+	}
+	for _, p := range patchFile.ResourcesStringPatches {
+		binaryPatches = append(binaryPatches, patch.NewResourcesStringPatch(&p))
+	}
+	for _, p := range patchFile.QtResourcePatches {
+		binaryPatches = append(binaryPatches, patch.NewQtResourcePatch(&p))
+	}
+	for _, p := range patchFile.QtStringPatches {
+		binaryPatches = append(binaryPatches, patch.NewQtStringPatch(patchFile, &p, caves))
+	}
+	for _, p := range patchFile.URLRedirects {
+		binaryPatches = append(binaryPatches, patch.NewURLRedirectPatch(patchFile, &p, caves))
+	}
+	for _, p := range patchFile.SectionReferencePatches {
+		binaryPatches = append(binaryPatches, patch.NewSectionReferencePatch(patchFile, &p))
+	}
+
+	// Patches to an embedded assembly or a file inside a single-file bundle
+	// run against the extracted file
+	if patchFile.ManifestResource != "" {
+		binaryPatches = []patch.Patch{patch.NewManifestResourcePatch(patchFile.ManifestResource, binaryPatches)}
+	}
+	if patchFile.MachOSlice != "" {
+		binaryPatches = []patch.Patch{patch.NewMachOSlicePatch(patchFile, patchFile.MachOSlice, binaryPatches, caves)}
+	}
+	if patchFile.BundleEntry != "" {
+		binaryPatches = []patch.Patch{patch.NewBundleEntryPatch(patchFile.BundleEntry, binaryPatches)}
+	}
+	patches = append(patches, binaryPatches...)
+
 	if patchFile.VPilotConfigPatch != nil {
 		patches = append(patches, patch.NewVPilotConfigPatch(patchFile, patchFile.VPilotConfigPatch))
 	}
+	for _, p := range patchFile.XMLConfigPatches {
+		patches = append(patches, patch.NewXMLConfigPatch(patchFile, &p))
+	}
+	for _, p := range patchFile.JSONConfigPatches {
+		patches = append(patches, patch.NewJSONConfigPatch(patchFile, &p))
+	}
+	for _, p := range patchFile.TextConfigPatches {
+		patches = append(patches, patch.NewTextConfigPatch(patchFile, &p))
+	}
+
+	if patchFile.Authenticode != nil && patchFile.Authenticode.Action != "keep" {
+		patches = append(patches, patch.NewAuthenticodePatch(patchFile.Authenticode))
+	}
+
+	// The checksum must be computed once all other patches have been applied
+	if patchFile.UpdateChecksum {
+		patches = append(patches, patch.NewPEChecksumPatch())
+	}
 
 	return
 }
 
-func verifyChecksum(file *os.File, checksum string) (ok bool, err error) {
-	hasher := sha1.New()
+// revertPatches lets the patches that can undo their own changes do so, and
+// returns the files they reverted.
+func revertPatches(patchFile *patchfile.PatchFile) (files []string, err error) {
+	patches, err := extractPatches(patchFile)
+	if err != nil {
+		return
+	}
 
-	if _, err = file.Seek(0, 0); err != nil {
+	for _, p := range patches {
+		revertable, ok := p.(patch.RevertablePatch)
+		if !ok {
+			continue
+		}
+		var reverted []string
+		if reverted, err = revertable.Revert(); err != nil {
+			err = fmt.Errorf("%s: %w", p.Name(), err)
+			return
+		}
+		files = append(files, reverted...)
+	}
+	return
+}
+
+// warnAuthenticode tells the user when the target file carries an Authenticode
+// signature that patching will invalidate.
+func warnAuthenticode(targetFile *os.File, settings *patchfile.Authenticode) {
+	info, err := patch.DetectAuthenticode(targetFile)
+	if err != nil || info == nil {
 		return
 	}
 
-	if _, err = io.Copy(hasher, file); err != nil {
+	signer := info.Signer
+	if signer == "" {
+		signer = "unknown signer"
+	}
+	fmt.Printf("Warning: %s is signed by %s.\n", filepath.Base(targetFile.Name()), signer)
+
+	switch {
+	case settings == nil || settings.Action == "keep":
+		fmt.Print("Patching will invalidate the signature. Set authenticode.action to strip or sign in the patchfile to handle it.\n\n")
+	case settings.Action == "strip":
+		fmt.Print("The signature will be removed.\n\n")
+	case settings.Action == "sign":
+		fmt.Print("The file will be re-signed with the configured certificate.\n\n")
+	}
+}
+
+// warnDotNetImage tells the user when the target assembly is strong name signed
+// or compiled ReadyToRun, either of which can keep IL and #US patches from taking
+// effect. With bundle_entry or manifest_resource set, the embedded assembly is checked.
+func warnDotNetImage(targetFile *os.File, patchFile *patchfile.PatchFile) {
+	name := filepath.Base(targetFile.Name())
+	nested := patchFile.ManifestResource
+	if nested == "" {
+		nested = patchFile.BundleEntry
+	}
+	if nested != "" {
+		name = fmt.Sprintf("%s in %s", nested, name)
+	}
+
+	info, err := patch.InspectNestedDotNetImage(targetFile, patchFile.BundleEntry, patchFile.ManifestResource)
+	if err != nil {
+		// Native images need no warning, but an embedded assembly that cannot be read does
+		if nested != "" && !errors.Is(err, patch.NotDotNetErr) {
+			fmt.Printf("Note: skipped the strong name and ReadyToRun check of %s: %s\n\n", name, err.Error())
+		}
 		return
 	}
 
-	sum := hasher.Sum(nil)
-	if hex.EncodeToString(sum) != checksum {
+	settings := patchFile.DotNetImage
+	if settings == nil {
+		settings = &patchfile.DotNetImage{}
+	}
+
+	if info.StrongNameSigned && !settings.ClearStrongNameFlag {
+		fmt.Printf("Warning: %s is strong name signed. Set dotnet_image.clear_strong_name_flag: true if the runtime rejects the patched assembly.\n\n", name)
+	}
+	if info.ReadyToRun && !settings.RemoveReadyToRun {
+		fmt.Printf("Warning: %s is compiled ReadyToRun, so the runtime may ignore IL and #US patches. Set dotnet_image.remove_ready_to_run: true to drop the precompiled code.\n\n", name)
+	}
+}
+
+// warnCodeSignature tells the user when the target Mach-O file is code signed,
+// as macOS refuses to run code whose signature no longer matches.
+func warnCodeSignature(targetFile *os.File) {
+	machoSlices, err := patch.ListMachOSlices(targetFile)
+	if err != nil {
 		return
 	}
 
-	ok = true
+	var signed []string
+	for _, s := range machoSlices {
+		if s.CodeSigned {
+			signed = append(signed, s.Architecture)
+		}
+	}
+	if len(signed) == 0 {
+		return
+	}
+
+	fmt.Printf("Warning: %s is code signed (%s). Patching will invalidate the signature. Re-sign the patched file before running it, e.g. with an ad-hoc signature:\n", filepath.Base(targetFile.Name()), strings.Join(signed, ", "))
+	fmt.Printf("    codesign --force --sign - %q\n\n", targetFile.Name())
+}
+
+// computeChecksums returns the SHA1 and SHA256 sums of a file.
+func computeChecksums(file *os.File) (sums patchfile.Checksums, err error) {
+	sha1Hasher, sha256Hasher := sha1.New(), sha256.New()
+
+	if _, err = file.Seek(0, 0); err != nil {
+		return
+	}
+
+	if _, err = io.Copy(io.MultiWriter(sha1Hasher, sha256Hasher), file); err != nil {
+		return
+	}
+
+	sums.SHA1 = hex.EncodeToString(sha1Hasher.Sum(nil))
+	sums.SHA256 = hex.EncodeToString(sha256Hasher.Sum(nil))
 	return
 }
 
@@ -218,6 +601,61 @@ func makeBackup(file *os.File) (err error) {
 	return
 }
 
+// missingBackupSuffix marks a secondary file that did not exist when it was
+// backed up, and is removed again on revert.
+const missingBackupSuffix = ".orig.missing"
+
+// backupSecondaryFile makes a backup of a secondary file, or records that it
+// does not exist yet, e.g. a config file the client has not written yet.
+func backupSecondaryFile(fileName string) (err error) {
+	file, err := os.Open(fileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		fmt.Printf("Note: %s does not exist yet. It will be removed when reverting.\n", fileName)
+		var marker *os.File
+		if marker, err = os.Create(fileName + missingBackupSuffix); err != nil {
+			return
+		}
+		return marker.Close()
+	} else if err != nil {
+		return
+	}
+	defer file.Close()
+
+	return makeBackup(file)
+}
+
+// restoreSecondaryFile restores the backup of a secondary file, or removes it
+// along with any journal of its patches if it did not exist before patching.
+func restoreSecondaryFile(fileName string) (err error) {
+	if _, err = os.Stat(fileName + missingBackupSuffix); err == nil {
+		for _, name := range []string{fileName, fileName + patch.JournalSuffix} {
+			if err = os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return
+			}
+		}
+		return os.Remove(fileName + missingBackupSuffix)
+	}
+
+	file, err := os.OpenFile(fileName, os.O_RDWR, 0666)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	return restoreBackup(file)
+}
+
+// removeBackup removes the backup of a secondary file, or its marker if the
+// file did not exist before patching.
+func removeBackup(fileName string) (err error) {
+	for _, suffix := range []string{".orig", missingBackupSuffix} {
+		if err = os.Remove(fileName + suffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return
+		}
+	}
+	return nil
+}
+
 // restoreBackup restores a backup for a given patched file
 func restoreBackup(file *os.File) (err error) {
 	backupFile, err := os.Open(file.Name() + ".orig")
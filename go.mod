@@ -4,5 +4,8 @@ go 1.24
 
 require (
 	github.com/goccy/go-yaml v1.17.1
+	golang.org/x/term v0.32.0
 	golang.org/x/text v0.25.0
 )
+
+require golang.org/x/sys v0.33.0 // indirect
@@ -2,16 +2,41 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 )
 
 func main() {
+	var credentials credentialOptions
+	flag.StringVar(&credentials.mode, "credentials", "", "override the patchfile's vPilot credentials mode: clear, preserve or prompt")
+	flag.StringVar(&credentials.cid, "cid", "", "openfsd CID stored in prompt mode (default $OPENFSD_CID)")
+	flag.StringVar(&credentials.password, "password", "", "openfsd password stored in prompt mode (default $OPENFSD_PASSWORD, which is preferred as other users can see command line arguments)")
+	flag.CommandLine.SetOutput(os.Stdout)
+	flag.Usage = printUsage
+	flag.Parse()
+
+	// The environment is read after parsing so that usage never prints a password
+	if credentials.cid == "" {
+		credentials.cid = os.Getenv("OPENFSD_CID")
+	}
+	if credentials.password == "" {
+		credentials.password = os.Getenv("OPENFSD_PASSWORD")
+	}
+
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args()); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	fmt.Println("Starting openfsd client patch utility...")
 
 	ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancelCtx()
 
-	runFlow(ctx)
+	runFlow(ctx, credentials)
 }
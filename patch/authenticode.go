@@ -0,0 +1,585 @@
+package patch
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/renorris/openfsd-client-patch-utility/patchfile"
+	"math/big"
+	"os"
+	"slices"
+)
+
+// Authenticode signatures are stored in the PE certificate table as a
+// WIN_CERTIFICATE holding a PKCS#7 SignedData structure.
+// https://learn.microsoft.com/en-us/windows/win32/debug/pe-format#the-attribute-certificate-table-image-only
+// https://download.microsoft.com/download/9/c/5/9c5b2167-8017-4bae-9fde-d599bac8184a/Authenticode_PE.docx
+
+const (
+	winCertRevision2_0         = 0x0200
+	winCertTypePKCSSignedData  = 0x0002
+	winCertificateHeaderLength = 8
+)
+
+var (
+	oidSignedData            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSHA256                = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA256       = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidSpcIndirectData       = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 4}
+	oidSpcStatementType      = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 11}
+	oidSpcSpOpusInfo         = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 12}
+	oidSpcPEImageData        = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 15}
+	oidSpcIndividualCodeSign = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 21}
+)
+
+// AuthenticodeInfo describes an Authenticode signature found in a PE file.
+type AuthenticodeInfo struct {
+	// Offset and Size locate the certificate table in the file
+	Offset int64
+	Size   int64
+
+	// Signer is the subject of the signing certificate, if it could be determined
+	Signer string
+}
+
+// DetectAuthenticode returns the Authenticode signature of a PE file, or nil if
+// the file is not signed.
+func DetectAuthenticode(file *os.File) (info *AuthenticodeInfo, err error) {
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	img, err := parsePEImage(data)
+	if err != nil {
+		return
+	}
+
+	return img.authenticode()
+}
+
+func (img *image) authenticode() (info *AuthenticodeInfo, err error) {
+	security := img.dataDirectory(imageDirectoryEntrySecurity)
+	if security.VirtualAddress == 0 || security.Size == 0 {
+		return
+	}
+
+	info = &AuthenticodeInfo{Offset: int64(security.VirtualAddress), Size: int64(security.Size)}
+	if info.Offset+info.Size > int64(len(img.data)) {
+		err = errors.New("certificate table extends past the end of the file")
+		return
+	}
+
+	// Best effort: find the subject of the first signer's certificate
+	table := img.data[info.Offset : info.Offset+info.Size]
+	if len(table) > winCertificateHeaderLength &&
+		binary.LittleEndian.Uint16(table[6:]) == winCertTypePKCSSignedData {
+		length := min(int(binary.LittleEndian.Uint32(table)), len(table))
+		if subject, subjectErr := signerSubject(table[winCertificateHeaderLength:length]); subjectErr == nil {
+			info.Signer = subject
+		}
+	}
+
+	return
+}
+
+// PKCS#7 structures, as far as they are needed to sign and inspect signatures.
+// https://datatracker.ietf.org/doc/html/rfc2315
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      contentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type signerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     issuerAndSerialNumber
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+type spcAttributeTypeAndOptionalValue struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type digestInfo struct {
+	DigestAlgorithm pkix.AlgorithmIdentifier
+	Digest          []byte
+}
+
+type spcIndirectDataContent struct {
+	Data          spcAttributeTypeAndOptionalValue
+	MessageDigest digestInfo
+}
+
+// signerSubject returns the subject of the certificate that produced the first signature.
+func signerSubject(pkcs7 []byte) (subject string, err error) {
+	var info contentInfo
+	if _, err = asn1.Unmarshal(pkcs7, &info); err != nil {
+		return
+	}
+	var sd signedData
+	if _, err = asn1.Unmarshal(info.Content.Bytes, &sd); err != nil {
+		return
+	}
+	if len(sd.SignerInfos) == 0 {
+		err = errors.New("signature has no signers")
+		return
+	}
+
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return
+	}
+	signer := sd.SignerInfos[0].IssuerAndSerialNumber
+	for _, cert := range certs {
+		if bytes.Equal(cert.RawIssuer, signer.Issuer.FullBytes) && cert.SerialNumber.Cmp(signer.SerialNumber) == 0 {
+			subject = cert.Subject.String()
+			return
+		}
+	}
+
+	err = errors.New("signing certificate not found")
+	return
+}
+
+// stripAuthenticode removes the certificate table from a PE file and clears the
+// security data directory. The table is trimmed from the file if nothing follows it.
+func stripAuthenticode(data []byte) (newData []byte, stripped bool, err error) {
+	img, err := parsePEImage(data)
+	if err != nil {
+		return
+	}
+
+	info, err := img.authenticode()
+	if err != nil || info == nil {
+		newData = data
+		return
+	}
+
+	layout, err := img.layout()
+	if err != nil {
+		return
+	}
+
+	if err = setDataDirectory(data, layout, imageDirectoryEntrySecurity, 0, 0); err != nil {
+		return
+	}
+
+	end := info.Offset + info.Size
+	if end >= int64(len(data)) || allZero(data[end:]) {
+		newData = data[:info.Offset]
+	} else {
+		clear(data[info.Offset:end])
+		newData = data
+	}
+
+	stripped = true
+	return
+}
+
+// authenticodeDigest computes the SHA-256 Authenticode image hash of a PE file:
+// the whole file except the checksum field, the security data directory entry
+// and the certificate table.
+func authenticodeDigest(data []byte) (digest []byte, err error) {
+	img, err := parsePEImage(data)
+	if err != nil {
+		return
+	}
+
+	layout, err := img.layout()
+	if err != nil {
+		return
+	}
+
+	checksumOffset := layout.optionalHeaderOffset + optionalHeaderCheckSum
+	securityEntryOffset, err := dataDirectoryOffset(data, layout, imageDirectoryEntrySecurity)
+	if err != nil {
+		return
+	}
+
+	end := int64(len(data))
+	if security := img.dataDirectory(imageDirectoryEntrySecurity); security.VirtualAddress != 0 {
+		end = int64(security.VirtualAddress)
+	}
+
+	hasher := sha256.New()
+	hasher.Write(data[:checksumOffset])
+	hasher.Write(data[checksumOffset+4 : securityEntryOffset])
+	hasher.Write(data[securityEntryOffset+8 : end])
+
+	digest = hasher.Sum(nil)
+	return
+}
+
+// signAuthenticode replaces any existing signature of a PE file with a new
+// Authenticode signature made with the given certificate chain and key.
+// The first certificate in the chain must belong to the key.
+func signAuthenticode(data []byte, chain []*x509.Certificate, key crypto.Signer) (newData []byte, err error) {
+	if data, _, err = stripAuthenticode(data); err != nil {
+		return
+	}
+
+	// The certificate table must start on an 8-byte boundary
+	data = append(data, make([]byte, alignUp(int64(len(data)), 8)-int64(len(data)))...)
+
+	digest, err := authenticodeDigest(data)
+	if err != nil {
+		return
+	}
+
+	pkcs7, err := buildAuthenticodeSignature(digest, chain, key)
+	if err != nil {
+		return
+	}
+
+	// WIN_CERTIFICATE, padded to an 8-byte boundary
+	certLength := alignUp(int64(winCertificateHeaderLength+len(pkcs7)), 8)
+	certificate := make([]byte, certLength)
+	binary.LittleEndian.PutUint32(certificate[0:], uint32(certLength))
+	binary.LittleEndian.PutUint16(certificate[4:], winCertRevision2_0)
+	binary.LittleEndian.PutUint16(certificate[6:], winCertTypePKCSSignedData)
+	copy(certificate[winCertificateHeaderLength:], pkcs7)
+
+	img, err := parsePEImage(data)
+	if err != nil {
+		return
+	}
+	layout, err := img.layout()
+	if err != nil {
+		return
+	}
+	if err = setDataDirectory(data, layout, imageDirectoryEntrySecurity, uint32(len(data)), uint32(certLength)); err != nil {
+		return
+	}
+
+	newData = append(data, certificate...)
+	return
+}
+
+// buildAuthenticodeSignature builds the PKCS#7 SignedData structure signing an image digest.
+func buildAuthenticodeSignature(digest []byte, chain []*x509.Certificate, key crypto.Signer) (pkcs7 []byte, err error) {
+	if len(chain) == 0 {
+		err = errors.New("no signing certificate provided")
+		return
+	}
+	signer := chain[0]
+
+	sha256Algorithm := pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+
+	// SpcPeImageData { flags: includeResources (empty bit string), file: <<<Obsolete>>> }
+	obsolete := []byte{}
+	for _, r := range "<<<Obsolete>>>" {
+		obsolete = append(obsolete, byte(r>>8), byte(r))
+	}
+	// file [0] EXPLICIT SpcLink { file [2] EXPLICIT SpcString { unicode [0] IMPLICIT BMPString } }
+	spcString, err := asn1.Marshal(contextSpecific(0, false, obsolete))
+	if err != nil {
+		return
+	}
+	spcLink, err := asn1.Marshal(contextSpecific(2, true, spcString))
+	if err != nil {
+		return
+	}
+	peImageData, err := asn1.Marshal(struct {
+		Flags asn1.BitString
+		File  asn1.RawValue
+	}{
+		File: contextSpecific(0, true, spcLink),
+	})
+	if err != nil {
+		return
+	}
+
+	indirectData, err := asn1.Marshal(spcIndirectDataContent{
+		Data: spcAttributeTypeAndOptionalValue{
+			Type:  oidSpcPEImageData,
+			Value: asn1.RawValue{FullBytes: peImageData},
+		},
+		MessageDigest: digestInfo{DigestAlgorithm: sha256Algorithm, Digest: digest},
+	})
+	if err != nil {
+		return
+	}
+
+	// Authenticode hashes the content of SpcIndirectDataContent, without its tag and length
+	var indirectDataValue asn1.RawValue
+	if _, err = asn1.Unmarshal(indirectData, &indirectDataValue); err != nil {
+		return
+	}
+	indirectDataDigest := sha256.Sum256(indirectDataValue.Bytes)
+
+	var authenticatedAttributes []attribute
+	for _, a := range []struct {
+		oid   asn1.ObjectIdentifier
+		value any
+	}{
+		{oidContentType, oidSpcIndirectData},
+		{oidSpcSpOpusInfo, struct{}{}},
+		{oidSpcStatementType, []asn1.ObjectIdentifier{oidSpcIndividualCodeSign}},
+		{oidMessageDigest, indirectDataDigest[:]},
+	} {
+		var value []byte
+		if value, err = asn1.Marshal(a.value); err != nil {
+			return
+		}
+		authenticatedAttributes = append(authenticatedAttributes, attribute{Type: a.oid, Values: setOf(value)})
+	}
+
+	attributes, err := marshalAttributes(authenticatedAttributes)
+	if err != nil {
+		return
+	}
+
+	// The signature covers the attributes encoded as a SET rather than [0] IMPLICIT
+	attributesDigest := sha256.Sum256(append([]byte{0x31}, attributes[1:]...))
+
+	var encryptionAlgorithm pkix.AlgorithmIdentifier
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		encryptionAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue}
+	case *ecdsa.PublicKey:
+		encryptionAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}
+	default:
+		err = fmt.Errorf("unsupported signing key type %T", key.Public())
+		return
+	}
+
+	signature, err := key.Sign(rand.Reader, attributesDigest[:], crypto.SHA256)
+	if err != nil {
+		return
+	}
+
+	var certificates []byte
+	for _, cert := range chain {
+		certificates = append(certificates, cert.Raw...)
+	}
+
+	sd, err := asn1.Marshal(signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Algorithm},
+		ContentInfo: contentInfo{
+			ContentType: oidSpcIndirectData,
+			Content:     contextSpecific(0, true, indirectData),
+		},
+		Certificates: contextSpecific(0, true, certificates),
+		SignerInfos: []signerInfo{{
+			Version: 1,
+			IssuerAndSerialNumber: issuerAndSerialNumber{
+				Issuer:       asn1.RawValue{FullBytes: signer.RawIssuer},
+				SerialNumber: signer.SerialNumber,
+			},
+			DigestAlgorithm:           sha256Algorithm,
+			AuthenticatedAttributes:   asn1.RawValue{FullBytes: attributes},
+			DigestEncryptionAlgorithm: encryptionAlgorithm,
+			EncryptedDigest:           signature,
+		}},
+	})
+	if err != nil {
+		return
+	}
+
+	return asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content:     contextSpecific(0, true, sd),
+	})
+}
+
+// marshalAttributes encodes authenticated attributes as [0] IMPLICIT SET OF Attribute,
+// sorted in DER order.
+func marshalAttributes(attributes []attribute) (encoded []byte, err error) {
+	var encodedAttributes [][]byte
+	for _, attr := range attributes {
+		var e []byte
+		if e, err = asn1.Marshal(attr); err != nil {
+			return
+		}
+		encodedAttributes = append(encodedAttributes, e)
+	}
+	slices.SortFunc(encodedAttributes, bytes.Compare)
+
+	return asn1.Marshal(contextSpecific(0, true, bytes.Join(encodedAttributes, nil)))
+}
+
+// contextSpecific wraps content in a context-specific tag. Note that encoding/asn1
+// writes raw values as-is, ignoring any explicit tag set on the containing field.
+func contextSpecific(tag int, compound bool, content []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, IsCompound: compound, Bytes: content}
+}
+
+func setOf(values ...[]byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: bytes.Join(values, nil)}
+}
+
+// loadSigningCredentials reads a PEM certificate chain and private key.
+func loadSigningCredentials(certificateFile string, keyFile string) (chain []*x509.Certificate, key crypto.Signer, err error) {
+	certPEM, err := os.ReadFile(certificateFile)
+	if err != nil {
+		return
+	}
+	for block, rest := pem.Decode(certPEM); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+			return
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		err = fmt.Errorf("no certificates found in %s", certificateFile)
+		return
+	}
+
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		err = fmt.Errorf("no PEM data found in %s", keyFile)
+		return
+	}
+
+	var parsed any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		err = fmt.Errorf("unsupported key type %s in %s", block.Type, keyFile)
+	}
+	if err != nil {
+		return
+	}
+
+	var ok bool
+	if key, ok = parsed.(crypto.Signer); !ok {
+		err = fmt.Errorf("key in %s cannot be used for signing", keyFile)
+		return
+	}
+
+	// The signing certificate must belong to the key
+	if !publicKeysEqual(chain[0].PublicKey, key.Public()) {
+		err = errors.New("the first certificate does not match the signing key")
+		return
+	}
+
+	return
+}
+
+func publicKeysEqual(a crypto.PublicKey, b crypto.PublicKey) bool {
+	type equaler interface {
+		Equal(crypto.PublicKey) bool
+	}
+	e, ok := a.(equaler)
+	return ok && e.Equal(b)
+}
+
+func allZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0x00 {
+			return false
+		}
+	}
+	return true
+}
+
+// AuthenticodePatch strips or re-signs the Authenticode signature of a PE file,
+// which patching otherwise leaves in place but invalid.
+type AuthenticodePatch struct {
+	patch  *patchfile.Authenticode
+	report []string
+}
+
+func NewAuthenticodePatch(patch *patchfile.Authenticode) *AuthenticodePatch {
+	return &AuthenticodePatch{patch: patch}
+}
+
+func (p *AuthenticodePatch) Run(file *os.File) (err error) {
+	p.report = nil
+
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	var newData []byte
+	switch p.patch.Action {
+	case "strip":
+		var stripped bool
+		if newData, stripped, err = stripAuthenticode(data); err != nil {
+			return
+		}
+		if !stripped {
+			p.report = append(p.report, "file is not signed")
+			return
+		}
+		p.report = append(p.report, "stripped signature")
+	case "sign":
+		var chain []*x509.Certificate
+		var key crypto.Signer
+		if chain, key, err = loadSigningCredentials(p.patch.CertificateFile, p.patch.KeyFile); err != nil {
+			return
+		}
+		if newData, err = signAuthenticode(data, chain, key); err != nil {
+			return
+		}
+		p.report = append(p.report, fmt.Sprintf("signed as %s", chain[0].Subject.String()))
+	default:
+		err = fmt.Errorf("unknown authenticode action: %s", p.patch.Action)
+		return
+	}
+
+	if err = rewriteWholeFile(file, newData); err != nil {
+		return
+	}
+
+	return
+}
+
+func (p *AuthenticodePatch) Name() string {
+	return "Update Authenticode signature"
+}
+
+func (p *AuthenticodePatch) Report() []string {
+	return p.report
+}
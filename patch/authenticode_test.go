@@ -0,0 +1,317 @@
+package patch
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/renorris/openfsd-client-patch-utility/patchfile"
+)
+
+// buildTestPE returns a minimal PE32+ image with a single .text section.
+func buildTestPE() []byte {
+	const (
+		peOffset       = 0x40
+		optionalHeader = peOffset + 4 + 20
+		sectionTable   = optionalHeader + 240
+	)
+	data := make([]byte, 0x400)
+	copy(data, "MZ")
+	binary.LittleEndian.PutUint32(data[0x3C:], peOffset)
+
+	copy(data[peOffset:], "PE\x00\x00")
+	binary.LittleEndian.PutUint16(data[peOffset+4:], 0x8664) // Machine: AMD64
+	binary.LittleEndian.PutUint16(data[peOffset+6:], 1)      // NumberOfSections
+	binary.LittleEndian.PutUint16(data[peOffset+20:], 240)   // SizeOfOptionalHeader
+	binary.LittleEndian.PutUint16(data[peOffset+22:], 0x22)  // Characteristics
+
+	binary.LittleEndian.PutUint16(data[optionalHeader:], 0x20B)         // Magic: PE32+
+	binary.LittleEndian.PutUint32(data[optionalHeader+16:], 0x1000)     // AddressOfEntryPoint
+	binary.LittleEndian.PutUint64(data[optionalHeader+24:], 0x14000000) // ImageBase
+	binary.LittleEndian.PutUint32(data[optionalHeader+32:], 0x1000)     // SectionAlignment
+	binary.LittleEndian.PutUint32(data[optionalHeader+36:], 0x200)      // FileAlignment
+	binary.LittleEndian.PutUint32(data[optionalHeader+56:], 0x2000)     // SizeOfImage
+	binary.LittleEndian.PutUint32(data[optionalHeader+60:], 0x200)      // SizeOfHeaders
+	binary.LittleEndian.PutUint16(data[optionalHeader+68:], 3)          // Subsystem: console
+	binary.LittleEndian.PutUint32(data[optionalHeader+108:], 16)        // NumberOfRvaAndSizes
+
+	copy(data[sectionTable:], ".text")
+	binary.LittleEndian.PutUint32(data[sectionTable+8:], 0x200)       // VirtualSize
+	binary.LittleEndian.PutUint32(data[sectionTable+12:], 0x1000)     // VirtualAddress
+	binary.LittleEndian.PutUint32(data[sectionTable+16:], 0x200)      // SizeOfRawData
+	binary.LittleEndian.PutUint32(data[sectionTable+20:], 0x200)      // PointerToRawData
+	binary.LittleEndian.PutUint32(data[sectionTable+36:], 0x60000020) // code, execute, read
+	data[0x200] = 0xC3                                                // ret
+	return data
+}
+
+// testSigningCredentials returns a self-signed certificate for a new key.
+func testSigningCredentials(t *testing.T, key crypto.Signer) []*x509.Certificate {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "openfsd test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []*x509.Certificate{cert}
+}
+
+func securityDirectory(t *testing.T, data []byte) (virtualAddress uint32, size uint32) {
+	t.Helper()
+	img, err := parsePEImage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	security := img.dataDirectory(imageDirectoryEntrySecurity)
+	return security.VirtualAddress, security.Size
+}
+
+func detectAuthenticodeData(t *testing.T, data []byte) *AuthenticodeInfo {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.exe")
+	if err := os.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	info, err := DetectAuthenticode(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestSignAuthenticode(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []crypto.Signer{rsaKey, ecdsaKey} {
+		chain := testSigningCredentials(t, key)
+		signed, err := signAuthenticode(buildTestPE(), chain, key)
+		if err != nil {
+			t.Fatalf("%T: %v", key, err)
+		}
+
+		info := detectAuthenticodeData(t, signed)
+		if info == nil {
+			t.Fatalf("%T: signature not detected", key)
+		}
+		if info.Signer != "CN=openfsd test" {
+			t.Errorf("%T: signer is %q", key, info.Signer)
+		}
+		if info.Offset%8 != 0 || info.Offset+info.Size != int64(len(signed)) {
+			t.Errorf("%T: certificate table at %d+%d in a file of %d bytes", key, info.Offset, info.Size, len(signed))
+		}
+
+		// WIN_CERTIFICATE { length, revision, type, PKCS#7 SignedData }
+		table := signed[info.Offset:]
+		if binary.LittleEndian.Uint32(table) != uint32(info.Size) ||
+			binary.LittleEndian.Uint16(table[4:]) != winCertRevision2_0 ||
+			binary.LittleEndian.Uint16(table[6:]) != winCertTypePKCSSignedData {
+			t.Fatalf("%T: invalid WIN_CERTIFICATE header %x", key, table[:8])
+		}
+
+		var ci contentInfo
+		if _, err = asn1.Unmarshal(table[winCertificateHeaderLength:], &ci); err != nil {
+			t.Fatalf("%T: %v", key, err)
+		}
+		if !ci.ContentType.Equal(oidSignedData) {
+			t.Fatalf("%T: content type is %v", key, ci.ContentType)
+		}
+		var sd signedData
+		if _, err = asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+			t.Fatalf("%T: %v", key, err)
+		}
+		if !sd.ContentInfo.ContentType.Equal(oidSpcIndirectData) || len(sd.SignerInfos) != 1 {
+			t.Fatalf("%T: unexpected SignedData %+v", key, sd)
+		}
+
+		// The signed image digest must match the file as it ends up
+		var indirectData asn1.RawValue
+		if _, err = asn1.Unmarshal(sd.ContentInfo.Content.Bytes, &indirectData); err != nil {
+			t.Fatalf("%T: %v", key, err)
+		}
+		var indirect spcIndirectDataContent
+		if _, err = asn1.Unmarshal(indirectData.FullBytes, &indirect); err != nil {
+			t.Fatalf("%T: %v", key, err)
+		}
+		digest, err := authenticodeDigest(signed)
+		if err != nil {
+			t.Fatalf("%T: %v", key, err)
+		}
+		if !bytes.Equal(indirect.MessageDigest.Digest, digest) {
+			t.Errorf("%T: signed digest %x, image digest %x", key, indirect.MessageDigest.Digest, digest)
+		}
+
+		// The messageDigest attribute covers SpcIndirectDataContent, and the
+		// signature the attributes
+		signer := sd.SignerInfos[0]
+		var attributes []attribute
+		if _, err = asn1.UnmarshalWithParams(signer.AuthenticatedAttributes.FullBytes, &attributes, "set,tag:0"); err != nil {
+			t.Fatalf("%T: %v", key, err)
+		}
+		indirectDataDigest := sha256.Sum256(indirectData.Bytes)
+		var messageDigest []byte
+		for _, a := range attributes {
+			if a.Type.Equal(oidMessageDigest) {
+				if _, err = asn1.Unmarshal(a.Values.Bytes, &messageDigest); err != nil {
+					t.Fatalf("%T: %v", key, err)
+				}
+			}
+		}
+		if !bytes.Equal(messageDigest, indirectDataDigest[:]) {
+			t.Errorf("%T: messageDigest attribute %x, want %x", key, messageDigest, indirectDataDigest)
+		}
+
+		attributesDigest := sha256.Sum256(append([]byte{0x31}, signer.AuthenticatedAttributes.FullBytes[1:]...))
+		switch public := key.Public().(type) {
+		case *rsa.PublicKey:
+			err = rsa.VerifyPKCS1v15(public, crypto.SHA256, attributesDigest[:], signer.EncryptedDigest)
+		case *ecdsa.PublicKey:
+			if !ecdsa.VerifyASN1(public, attributesDigest[:], signer.EncryptedDigest) {
+				err = errors.New("ECDSA signature does not verify")
+			}
+		}
+		if err != nil {
+			t.Errorf("%T: %v", key, err)
+		}
+	}
+}
+
+func TestStripAuthenticode(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := buildTestPE()
+	signed, err := signAuthenticode(slices.Clone(original), testSigningCredentials(t, key), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info := detectAuthenticodeData(t, original); info != nil {
+		t.Errorf("unsigned image has a signature: %+v", info)
+	}
+
+	stripped, ok, err := stripAuthenticode(slices.Clone(signed))
+	if err != nil || !ok {
+		t.Fatalf("stripAuthenticode() = %v, %v", ok, err)
+	}
+	if !bytes.Equal(stripped, original) {
+		t.Errorf("stripped image differs from the unsigned one")
+	}
+	if address, size := securityDirectory(t, stripped); address != 0 || size != 0 {
+		t.Errorf("security directory is %#x+%#x after stripping", address, size)
+	}
+	if info := detectAuthenticodeData(t, stripped); info != nil {
+		t.Errorf("stripped image has a signature: %+v", info)
+	}
+
+	// A table followed by other data is cleared rather than trimmed
+	overlay := append(slices.Clone(signed), "overlay"...)
+	stripped, ok, err = stripAuthenticode(slices.Clone(overlay))
+	if err != nil || !ok {
+		t.Fatalf("stripAuthenticode() = %v, %v", ok, err)
+	}
+	if len(stripped) != len(overlay) || !allZero(stripped[len(original):len(signed)]) {
+		t.Errorf("certificate table before an overlay was not cleared in place")
+	}
+
+	// Stripping an unsigned image leaves it alone
+	if stripped, ok, err = stripAuthenticode(slices.Clone(original)); err != nil || ok || !bytes.Equal(stripped, original) {
+		t.Errorf("stripAuthenticode(unsigned) = %v, %v", ok, err)
+	}
+}
+
+func TestAuthenticodePatchSign(t *testing.T) {
+	dir := t.TempDir()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := testSigningCredentials(t, key)
+
+	certificateFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err = os.WriteFile(certificateFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: chain[0].Raw}), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	targetPath := filepath.Join(dir, "test.exe")
+	if err = os.WriteFile(targetPath, buildTestPE(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	target, err := os.OpenFile(targetPath, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	p := NewAuthenticodePatch(&patchfile.Authenticode{Action: "sign", CertificateFile: certificateFile, KeyFile: keyFile})
+	if err = p.Run(target); err != nil {
+		t.Fatal(err)
+	}
+	info, err := DetectAuthenticode(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info == nil || info.Signer != "CN=openfsd test" {
+		t.Errorf("DetectAuthenticode() = %+v", info)
+	}
+
+	// A key that does not belong to the certificate is refused
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKeyDER, err := x509.MarshalPKCS8PrivateKey(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: otherKeyDER}), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = loadSigningCredentials(certificateFile, keyFile); err == nil {
+		t.Errorf("loadSigningCredentials() accepted a key that does not match the certificate")
+	}
+}
@@ -0,0 +1,457 @@
+package patch
+
+import (
+	"bytes"
+	"cmp"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// .NET single-file bundles append the application's files and a manifest to
+// the apphost. The apphost locates the manifest through the 8-byte header
+// offset stored right before the bundle signature.
+// https://github.com/dotnet/runtime/blob/main/docs/design/features/bundle.md
+// https://github.com/dotnet/runtime/blob/main/src/installer/managed/Microsoft.NET.HostModel/Bundle/Manifest.cs
+
+// bundleSignature is the SHA-256 hash of ".net core bundle"
+var bundleSignature = []byte{
+	0x8b, 0x12, 0x02, 0xb9, 0x6a, 0x61, 0x20, 0x38,
+	0x72, 0x7b, 0x93, 0x02, 0x14, 0xd7, 0xa0, 0x32,
+	0x13, 0xf5, 0xb9, 0xe6, 0xef, 0xae, 0x33, 0x18,
+	0xee, 0x3b, 0x2d, 0xce, 0x24, 0xb3, 0x6a, 0xae,
+}
+
+var NotBundleErr = errors.New("error: file is not a .NET single-file bundle")
+
+// Bundle file types
+const (
+	bundleFileUnknown           = 0
+	bundleFileAssembly          = 1
+	bundleFileNativeBinary      = 2
+	bundleFileDepsJSON          = 3
+	bundleFileRuntimeConfigJSON = 4
+	bundleFileSymbols           = 5
+)
+
+// bundle is a parsed .NET single-file bundle.
+type bundle struct {
+	data []byte
+
+	// placeholderOffset is the raw file offset of the header offset stored in the apphost
+	placeholderOffset int64
+
+	majorVersion uint32
+	minorVersion uint32
+	id           string
+
+	// flags is only present in bundles of version 2 and later
+	flags uint64
+
+	entries []bundleEntry
+}
+
+// bundleEntry is a file embedded in a bundle.
+type bundleEntry struct {
+	// offset is the raw file offset of the entry's data
+	offset int64
+	size   int64
+
+	// compressedSize is the size of the deflated data, or 0 if the entry is stored
+	compressedSize int64
+
+	fileType byte
+	path     string
+}
+
+// storedSize returns the number of bytes the entry occupies in the bundle.
+func (e *bundleEntry) storedSize() int64 {
+	if e.compressedSize != 0 {
+		return e.compressedSize
+	}
+	return e.size
+}
+
+// parseBundle parses the manifest of a single-file bundle.
+func parseBundle(data []byte) (b *bundle, err error) {
+	signatureOffset := bytes.Index(data, bundleSignature)
+	if signatureOffset < 8 {
+		err = NotBundleErr
+		return
+	}
+
+	b = &bundle{data: data, placeholderOffset: int64(signatureOffset) - 8}
+	headerOffset := int64(binary.LittleEndian.Uint64(data[b.placeholderOffset:]))
+	if headerOffset == 0 {
+		// An apphost that is not bundled
+		err = NotBundleErr
+		return
+	}
+	if headerOffset >= int64(len(data)) {
+		err = fmt.Errorf("bundle header offset 0x%X is out of range", headerOffset)
+		return
+	}
+
+	r := &bundleReader{data: data, pos: headerOffset}
+	b.majorVersion = r.readUint32()
+	b.minorVersion = r.readUint32()
+	fileCount := int(int32(r.readUint32()))
+	b.id = r.readString()
+
+	if b.majorVersion >= 2 {
+		// The deps.json and runtimeconfig.json locations duplicate their entries
+		r.pos += 4 * 8
+		b.flags = r.readUint64()
+	}
+
+	for range fileCount {
+		if r.err != nil {
+			break
+		}
+		var e bundleEntry
+		e.offset = int64(r.readUint64())
+		e.size = int64(r.readUint64())
+		if b.majorVersion >= 6 {
+			e.compressedSize = int64(r.readUint64())
+		}
+		e.fileType = r.readByte()
+		e.path = r.readString()
+
+		if e.offset < 0 || e.storedSize() < 0 || e.offset+e.storedSize() > int64(len(data)) {
+			err = fmt.Errorf("bundle entry %s is out of range", e.path)
+			return
+		}
+		b.entries = append(b.entries, e)
+	}
+
+	if r.err != nil {
+		err = fmt.Errorf("bundle manifest is truncated: %w", r.err)
+		return
+	}
+	return
+}
+
+// entry returns the embedded file with the given relative path.
+func (b *bundle) entry(path string) (e *bundleEntry, err error) {
+	path = filepath.ToSlash(path)
+	for i := range b.entries {
+		if filepath.ToSlash(b.entries[i].path) == path {
+			return &b.entries[i], nil
+		}
+	}
+	err = fmt.Errorf("bundle has no file %s", path)
+	return
+}
+
+// entryData returns the uncompressed contents of an embedded file.
+func (b *bundle) entryData(e *bundleEntry) (content []byte, err error) {
+	stored := b.data[e.offset : e.offset+e.storedSize()]
+	if e.compressedSize == 0 {
+		return bytes.Clone(stored), nil
+	}
+
+	if content, err = io.ReadAll(flate.NewReader(bytes.NewReader(stored))); err != nil {
+		err = fmt.Errorf("error decompressing bundle entry %s: %w", e.path, err)
+		return
+	}
+	if int64(len(content)) != e.size {
+		err = fmt.Errorf("bundle entry %s decompressed to %d bytes, expected %d", e.path, len(content), e.size)
+	}
+	return
+}
+
+// bundleEntryData returns the uncompressed contents of a file embedded in a bundle.
+func bundleEntryData(data []byte, path string) (content []byte, err error) {
+	b, err := parseBundle(data)
+	if err != nil {
+		return
+	}
+
+	e, err := b.entry(path)
+	if err != nil {
+		return
+	}
+
+	return b.entryData(e)
+}
+
+// replaceEntry rebuilds the bundle with new contents for one embedded file.
+// All entries following the apphost are laid out again and the manifest is
+// rewritten with their new offsets and sizes.
+func (b *bundle) replaceEntry(path string, content []byte) (newData []byte, err error) {
+	replaced, err := b.entry(path)
+	if err != nil {
+		return
+	}
+
+	// Lay the entries out again in the order they appear in the file
+	entries := slices.Clone(b.entries)
+	order := make([]int, len(entries))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(x, y int) int {
+		return cmp.Compare(entries[x].offset, entries[y].offset)
+	})
+
+	// Everything before the first entry is the apphost
+	start := int64(len(b.data))
+	for _, e := range entries {
+		start = min(start, e.offset)
+	}
+	newData = bytes.Clone(b.data[:start])
+
+	idHash := sha256.New()
+	for _, i := range order {
+		e := &entries[i]
+		stored := b.data[e.offset : e.offset+e.storedSize()]
+
+		if e.path == replaced.path {
+			e.size = int64(len(content))
+			stored = content
+			if e.compressedSize != 0 {
+				if stored, err = deflate(content); err != nil {
+					return
+				}
+				e.compressedSize = int64(len(stored))
+			}
+		}
+
+		// Keep entries aligned the way the bundler placed them
+		alignment := int64(1)
+		for _, a := range []int64{4096, 16} {
+			if e.offset%a == 0 {
+				alignment = a
+				break
+			}
+		}
+		newData = append(newData, make([]byte, alignUp(int64(len(newData)), alignment)-int64(len(newData)))...)
+
+		e.offset = int64(len(newData))
+		newData = append(newData, stored...)
+		idHash.Write(stored)
+	}
+
+	// The host caches extracted files by bundle ID, so the ID must change
+	// along with the contents
+	id := b.id
+	if len(id) > 0 {
+		id = strings.ReplaceAll(base64.StdEncoding.EncodeToString(idHash.Sum(nil)), "/", "_")[:min(len(id), 44)]
+	}
+
+	headerOffset := int64(len(newData))
+	newData = binary.LittleEndian.AppendUint32(newData, b.majorVersion)
+	newData = binary.LittleEndian.AppendUint32(newData, b.minorVersion)
+	newData = binary.LittleEndian.AppendUint32(newData, uint32(len(entries)))
+	newData = appendDotNetString(newData, id)
+
+	if b.majorVersion >= 2 {
+		var depsJSON, runtimeConfigJSON bundleEntry
+		for _, e := range entries {
+			switch e.fileType {
+			case bundleFileDepsJSON:
+				depsJSON = e
+			case bundleFileRuntimeConfigJSON:
+				runtimeConfigJSON = e
+			}
+		}
+		newData = binary.LittleEndian.AppendUint64(newData, uint64(depsJSON.offset))
+		newData = binary.LittleEndian.AppendUint64(newData, uint64(depsJSON.size))
+		newData = binary.LittleEndian.AppendUint64(newData, uint64(runtimeConfigJSON.offset))
+		newData = binary.LittleEndian.AppendUint64(newData, uint64(runtimeConfigJSON.size))
+		newData = binary.LittleEndian.AppendUint64(newData, b.flags)
+	}
+
+	for _, e := range entries {
+		newData = binary.LittleEndian.AppendUint64(newData, uint64(e.offset))
+		newData = binary.LittleEndian.AppendUint64(newData, uint64(e.size))
+		if b.majorVersion >= 6 {
+			newData = binary.LittleEndian.AppendUint64(newData, uint64(e.compressedSize))
+		}
+		newData = append(newData, e.fileType)
+		newData = appendDotNetString(newData, e.path)
+	}
+
+	binary.LittleEndian.PutUint64(newData[b.placeholderOffset:], uint64(headerOffset))
+	return
+}
+
+func deflate(data []byte) (compressed []byte, err error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return
+	}
+	if _, err = w.Write(data); err != nil {
+		return
+	}
+	if err = w.Close(); err != nil {
+		return
+	}
+	compressed = buf.Bytes()
+	return
+}
+
+// bundleReader reads the little-endian values of a bundle manifest. The first
+// read past the end of the data sets err and all further reads return zero.
+type bundleReader struct {
+	data []byte
+	pos  int64
+	err  error
+}
+
+func (r *bundleReader) next(n int64) []byte {
+	if r.err != nil || r.pos+n > int64(len(r.data)) {
+		r.err = io.ErrUnexpectedEOF
+		return make([]byte, n)
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *bundleReader) readByte() byte     { return r.next(1)[0] }
+func (r *bundleReader) readUint32() uint32 { return binary.LittleEndian.Uint32(r.next(4)) }
+func (r *bundleReader) readUint64() uint64 { return binary.LittleEndian.Uint64(r.next(8)) }
+
+// readString reads a string prefixed with its 7-bit encoded length, as written by
+// .NET's BinaryWriter.
+func (r *bundleReader) readString() string {
+	var length int64
+	for shift := 0; shift < 35; shift += 7 {
+		b := r.readByte()
+		length |= int64(b&0x7F) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	return string(r.next(length))
+}
+
+// BundleEntryInfo describes a file embedded in a single-file bundle.
+type BundleEntryInfo struct {
+	Path       string
+	Size       int64
+	Compressed bool
+	Type       string
+}
+
+// ListBundle returns the files embedded in a .NET single-file bundle.
+func ListBundle(file *os.File) (entries []BundleEntryInfo, err error) {
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	b, err := parseBundle(data)
+	if err != nil {
+		return
+	}
+
+	for _, e := range b.entries {
+		entries = append(entries, BundleEntryInfo{
+			Path:       e.path,
+			Size:       e.size,
+			Compressed: e.compressedSize != 0,
+			Type:       bundleFileTypeName(e.fileType),
+		})
+	}
+	return
+}
+
+func bundleFileTypeName(fileType byte) string {
+	switch fileType {
+	case bundleFileAssembly:
+		return "assembly"
+	case bundleFileNativeBinary:
+		return "native"
+	case bundleFileDepsJSON:
+		return "deps.json"
+	case bundleFileRuntimeConfigJSON:
+		return "runtimeconfig.json"
+	case bundleFileSymbols:
+		return "symbols"
+	}
+	return "unknown"
+}
+
+// BundleEntryPatch applies patches to a file embedded in a .NET single-file
+// bundle and writes the patched file back into the bundle.
+type BundleEntryPatch struct {
+	entry   string
+	patches []Patch
+	report  []string
+}
+
+func NewBundleEntryPatch(entry string, patches []Patch) *BundleEntryPatch {
+	return &BundleEntryPatch{entry: entry, patches: patches}
+}
+
+func (p *BundleEntryPatch) Run(file *os.File) (err error) {
+	p.report = nil
+
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	// Rewriting the bundle invalidates any signature of the apphost, and the
+	// certificate table must stay at the end of the file
+	if bytes.HasPrefix(data, []byte("MZ")) {
+		var stripped bool
+		if data, stripped, err = stripAuthenticode(data); err != nil {
+			return
+		}
+		if stripped {
+			p.report = append(p.report, "stripped Authenticode signature of the apphost")
+		}
+	}
+
+	b, err := parseBundle(data)
+	if err != nil {
+		return
+	}
+
+	e, err := b.entry(p.entry)
+	if err != nil {
+		return
+	}
+
+	content, err := b.entryData(e)
+	if err != nil {
+		return
+	}
+
+	var report []string
+	if content, report, err = patchNestedFile(e.path, content, p.patches); err != nil {
+		return
+	}
+	p.report = append(p.report, report...)
+
+	newData, err := b.replaceEntry(e.path, content)
+	if err != nil {
+		return
+	}
+
+	if err = rewriteWholeFile(file, newData); err != nil {
+		return
+	}
+
+	return
+}
+
+func (p *BundleEntryPatch) Name() string {
+	return fmt.Sprintf("Patch bundled %s", p.entry)
+}
+
+func (p *BundleEntryPatch) Report() []string {
+	return p.report
+}
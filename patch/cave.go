@@ -0,0 +1,223 @@
+package patch
+
+import (
+	"fmt"
+	"slices"
+)
+
+// CaveAllocator finds and reserves zero-filled regions of the target file
+// ("code caves") so that patches placing new data into the file do not
+// collide with each other.
+type CaveAllocator struct {
+	reserved []cave
+
+	// injected holds the names of sections added to the file for patch
+	// payloads, which are used once slack space is exhausted.
+	injected []string
+}
+
+func NewCaveAllocator() *CaveAllocator {
+	return &CaveAllocator{}
+}
+
+// reset drops all reservations, for patching another image with the same patches.
+func (a *CaveAllocator) reset() {
+	a.reserved = nil
+	a.injected = nil
+}
+
+// cave is a reserved region of the target file.
+type cave struct {
+	// offset is the raw file offset of the first byte of the cave
+	offset int64
+	size   int64
+
+	// address is the virtual address of the first byte of the cave
+	address uint64
+
+	section string
+
+	// sectionIndex is the index of the section in the image
+	sectionIndex int
+
+	// slack is set when the cave lies between a section's virtual size and
+	// the size of its raw data.
+	slack bool
+}
+
+// caveRequest describes the space a patch needs.
+type caveRequest struct {
+	size      int64
+	alignment int64
+
+	// sections restricts the search to the named image sections
+	sections []string
+
+	// executable requests space in a section that is mapped executable
+	executable bool
+}
+
+func (c cave) String() string {
+	kind := "zero-filled run"
+	if c.slack {
+		kind = "section slack"
+	}
+	return fmt.Sprintf("0x%X (%s, %s)", c.address, c.section, kind)
+}
+
+// addInjectedSection makes a section added for patch payloads available for allocation.
+func (a *CaveAllocator) addInjectedSection(name string) {
+	a.injected = append(a.injected, name)
+}
+
+// allocate finds and reserves space matching the request. Slack space past a
+// section's virtual size is preferred since nothing in the program can refer
+// to it; the section's virtual size is grown to map the cave. Next come
+// sections injected for patch payloads. Otherwise, zero runs inside read-only
+// sections are used, keeping a guard of zero bytes on both sides and staying
+// clear of PE data directories and ELF and Mach-O metadata.
+func (a *CaveAllocator) allocate(img *image, request caveRequest) (c cave, err error) {
+	if request.alignment <= 0 {
+		request.alignment = 1
+	}
+
+	candidates := func(ours bool, fn func(i int, s *imageSection) (cave, bool)) (cave, bool) {
+		for i := range img.sections {
+			s := &img.sections[i]
+			if s.executable != request.executable {
+				continue
+			}
+			if len(request.sections) > 0 && !slices.Contains(request.sections, s.name) {
+				continue
+			}
+			if !ours && s.writable {
+				// Zero runs in writable sections are likely zero-initialized globals
+				continue
+			}
+			if found, ok := fn(i, s); ok {
+				return found, true
+			}
+		}
+		return cave{}, false
+	}
+
+	var ok bool
+	if c, ok = candidates(true, func(i int, s *imageSection) (cave, bool) {
+		return a.findInRange(img, i, s.offset+s.mappedSize(), s.offset+s.size, 0, request, true)
+	}); ok {
+		section := &img.sections[c.sectionIndex]
+		if err = img.setVirtualSize(section, c.offset+c.size-section.offset); err != nil {
+			return
+		}
+		a.reserved = append(a.reserved, c)
+		return
+	}
+
+	if c, ok = candidates(true, func(i int, s *imageSection) (cave, bool) {
+		if !slices.Contains(a.injected, s.name) {
+			return cave{}, false
+		}
+		return a.findInRange(img, i, s.offset, s.offset+s.mappedSize(), 0, request, false)
+	}); ok {
+		a.reserved = append(a.reserved, c)
+		return
+	}
+
+	const guard = 16
+	if c, ok = candidates(false, func(i int, s *imageSection) (cave, bool) {
+		if slices.Contains(a.injected, s.name) {
+			return cave{}, false
+		}
+		return a.findInRange(img, i, s.offset, s.offset+s.mappedSize(), guard, request, false)
+	}); ok {
+		a.reserved = append(a.reserved, c)
+		return
+	}
+
+	err = fmt.Errorf("no zero-filled space found for 0x%X bytes", request.size)
+	return
+}
+
+// findInRange searches a range of a section's file data for a zero run that
+// fits the request without overlapping an existing reservation.
+func (a *CaveAllocator) findInRange(img *image, sectionIndex int, start int64, end int64, guard int64, request caveRequest, slack bool) (c cave, ok bool) {
+	s := &img.sections[sectionIndex]
+	end = min(end, int64(len(img.data)))
+
+	for runStart := start; runStart < end; {
+		if img.data[runStart] != 0x00 {
+			runStart++
+			continue
+		}
+		runEnd := runStart
+		for runEnd < end && img.data[runEnd] == 0x00 {
+			runEnd++
+		}
+
+		for candidate := runStart + guard; candidate+request.size+guard <= runEnd; candidate++ {
+			address := s.address + uint64(candidate-s.offset)
+			if address%uint64(request.alignment) != 0 {
+				continue
+			}
+			if a.overlapsReservation(candidate, request.size) {
+				continue
+			}
+			if img.overlapsMetadata(candidate, request.size) {
+				continue
+			}
+			return cave{
+				offset:       candidate,
+				size:         request.size,
+				address:      address,
+				section:      s.name,
+				sectionIndex: sectionIndex,
+				slack:        slack,
+			}, true
+		}
+
+		runStart = runEnd
+	}
+
+	return
+}
+
+func (a *CaveAllocator) overlapsReservation(offset int64, size int64) bool {
+	for _, r := range a.reserved {
+		if offset < r.offset+r.size && offset+size > r.offset {
+			return true
+		}
+	}
+	return false
+}
+
+// overlapsMetadata reports whether a range of the file overlaps any PE data
+// directory, ELF metadata section or Mach-O metadata section.
+func (img *image) overlapsMetadata(offset int64, size int64) bool {
+	if img.elf != nil {
+		return img.overlapsELFMetadata(offset, size)
+	}
+	if img.macho != nil {
+		return img.overlapsMachOMetadata(offset, size)
+	}
+	if img.pe == nil {
+		return false
+	}
+	for i := range 16 {
+		// The security directory holds a file offset rather than an RVA
+		if i == imageDirectoryEntrySecurity {
+			continue
+		}
+		dir := img.dataDirectory(i)
+		if dir.VirtualAddress == 0 || dir.Size == 0 {
+			continue
+		}
+		dirOffset, err := img.rvaToOffset(dir.VirtualAddress)
+		if err != nil {
+			continue
+		}
+		if offset < dirOffset+int64(dir.Size) && offset+size > dirOffset {
+			return true
+		}
+	}
+	return false
+}
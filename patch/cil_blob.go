@@ -0,0 +1,158 @@
+package patch
+
+import (
+	"errors"
+	"fmt"
+	"github.com/renorris/openfsd-client-patch-utility/patchfile"
+	"os"
+)
+
+// CilBlobPatch replaces string arguments of .NET custom attributes, whose
+// values are stored in the #Blob heap. Settings default values, for example,
+// are stored as [DefaultSettingValue("...")] attributes.
+type CilBlobPatch struct {
+	patchFile *patchfile.PatchFile
+	patch     *patchfile.CilBlobPatch
+	report    []string
+}
+
+func NewCilBlobPatch(patchFile *patchfile.PatchFile, patch *patchfile.CilBlobPatch) *CilBlobPatch {
+	return &CilBlobPatch{patchFile: patchFile, patch: patch}
+}
+
+func (p *CilBlobPatch) Run(file *os.File) (err error) {
+	p.report = nil
+
+	if p.patch.OldString == "" {
+		err = errors.New("old_string must be set")
+		return
+	}
+
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	img, err := parsePEImage(data)
+	if err != nil {
+		return
+	}
+
+	header, err := img.cliHeader()
+	if err != nil {
+		return
+	}
+
+	tables, err := img.metadataTables(header)
+	if err != nil {
+		return
+	}
+
+	// The entry may be given by the location of its length prefix
+	target := int64(-1)
+	if p.patch.Section != "" {
+		var section *patchfile.Section
+		if section, err = p.patchFile.GetSection(p.patch.Section); err != nil {
+			return
+		}
+		target = section.RawOffset + (p.patch.SectionAddress - section.VirtualStart)
+	}
+
+	// Identical values share a single #Blob entry
+	patched := make(map[int64]bool)
+
+	for row := uint32(1); row <= tables.rows[tableCustomAttribute]; row++ {
+		offset, headerSize, value, blobErr := img.heapBlob(header, tables.cell(tableCustomAttribute, row, customAttributeValue))
+		if blobErr != nil || patched[offset] || (target >= 0 && offset != target) {
+			continue
+		}
+
+		attribute, decodeErr := img.decodeCustomAttributeRow(header, tables, row, value)
+		if decodeErr != nil {
+			if target >= 0 {
+				err = fmt.Errorf("error decoding custom attribute at 0x%X: %w", offset, decodeErr)
+				return
+			}
+			continue
+		}
+
+		replaced := 0
+		for _, arg := range attribute.strings() {
+			if !arg.null && arg.str == p.patch.OldString {
+				arg.str = p.patch.NewString
+				replaced++
+			}
+		}
+		if replaced == 0 {
+			continue
+		}
+
+		// The new value must fit in the space of the existing entry
+		newValue := attribute.encode()
+		var lengthHeader []byte
+		if lengthHeader, err = encodeLength(len(newValue)); err != nil {
+			return
+		}
+		available := headerSize + len(value)
+		if len(lengthHeader)+len(newValue) > available {
+			err = fmt.Errorf("new custom attribute value at 0x%X needs %d bytes, only %d are available", offset, len(lengthHeader)+len(newValue), available)
+			return
+		}
+
+		entry := make([]byte, available)
+		copy(entry, lengthHeader)
+		copy(entry[len(lengthHeader):], newValue)
+		if _, err = file.WriteAt(entry, offset); err != nil {
+			return
+		}
+
+		patched[offset] = true
+		p.report = append(p.report, fmt.Sprintf("0x%X: replaced %d argument(s) of custom attribute %d", offset, replaced, row))
+	}
+
+	if len(patched) == 0 {
+		err = fmt.Errorf("no custom attribute has an argument %q", p.patch.OldString)
+		return
+	}
+
+	return
+}
+
+// decodeCustomAttributeRow decodes the value of a CustomAttribute table row
+// using the signature of the attribute's constructor.
+func (img *image) decodeCustomAttributeRow(header *cliHeader, tables *metadataTables, row uint32, value []byte) (attribute *customAttributeBlob, err error) {
+	// CustomAttributeType coded index: 3 tag bits, 2 = MethodDef, 3 = MemberRef
+	constructor := tables.cell(tableCustomAttribute, row, customAttributeType)
+	constructorRow := constructor >> 3
+
+	var signatureIndex uint32
+	switch constructor & 0x7 {
+	case 2:
+		signatureIndex = tables.cell(tableMethodDef, constructorRow, methodDefSignature)
+	case 3:
+		signatureIndex = tables.cell(tableMemberRef, constructorRow, memberRefSignature)
+	default:
+		err = fmt.Errorf("invalid custom attribute constructor 0x%X", constructor)
+		return
+	}
+
+	_, _, signature, err := img.heapBlob(header, signatureIndex)
+	if err != nil {
+		return
+	}
+
+	params, err := constructorParams(signature)
+	if err != nil {
+		return
+	}
+
+	return decodeCustomAttribute(value, params)
+}
+
+func (p *CilBlobPatch) Name() string {
+	return p.patch.Name
+}
+
+func (p *CilBlobPatch) Report() []string {
+	return p.report
+}
@@ -0,0 +1,345 @@
+package patch
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// https://ecma-international.org/wp-content/uploads/ECMA-335_6th_edition_june_2012.pdf
+// II.23.3 Custom attributes and II.23.2 Blobs and signatures
+
+// Element types used in signatures and custom attribute values
+const (
+	elementTypeVoid      = 0x01
+	elementTypeBoolean   = 0x02
+	elementTypeChar      = 0x03
+	elementTypeI1        = 0x04
+	elementTypeU1        = 0x05
+	elementTypeI2        = 0x06
+	elementTypeU2        = 0x07
+	elementTypeI4        = 0x08
+	elementTypeU4        = 0x09
+	elementTypeI8        = 0x0A
+	elementTypeU8        = 0x0B
+	elementTypeR4        = 0x0C
+	elementTypeR8        = 0x0D
+	elementTypeString    = 0x0E
+	elementTypeValueType = 0x11
+	elementTypeClass     = 0x12
+	elementTypeObject    = 0x1C
+	elementTypeSZArray   = 0x1D
+
+	// Types only found in custom attribute values
+	elementTypeSystemType = 0x50
+	elementTypeBoxed      = 0x51
+	elementTypeEnum       = 0x55
+)
+
+const customAttributeProlog = 0x0001
+
+// Columns of the CustomAttribute, MethodDef and MemberRef tables
+const (
+	customAttributeType  = 1
+	customAttributeValue = 2
+	methodDefSignature   = 4
+	memberRefSignature   = 2
+)
+
+var UnsupportedCustomAttributeErr = errors.New("error: custom attribute value uses unsupported types")
+
+// customAttributeArg is a decoded custom attribute argument. String values
+// (including System.Type names and boxed strings) are decoded, other values
+// keep their encoding.
+type customAttributeArg struct {
+	isString bool
+	null     bool
+	str      string
+
+	// boxed holds the type tag preceding a string passed as object
+	boxed []byte
+
+	raw []byte
+}
+
+// customAttributeBlob is a decoded custom attribute value. The named
+// arguments are kept in encoded form after the first one that cannot be decoded.
+type customAttributeBlob struct {
+	fixed []customAttributeArg
+
+	namedCount uint16
+
+	// named holds the decoded named arguments, each preceded by its encoded
+	// kind, type and name in prefix
+	named []customAttributeNamedArg
+
+	// rest holds named arguments that could not be decoded
+	rest []byte
+}
+
+type customAttributeNamedArg struct {
+	prefix []byte
+	value  customAttributeArg
+}
+
+// strings returns pointers to all decoded string arguments.
+func (b *customAttributeBlob) strings() (args []*customAttributeArg) {
+	for i := range b.fixed {
+		if b.fixed[i].isString {
+			args = append(args, &b.fixed[i])
+		}
+	}
+	for i := range b.named {
+		if b.named[i].value.isString {
+			args = append(args, &b.named[i].value)
+		}
+	}
+	return
+}
+
+// constructorParams parses the parameter types of a custom attribute's
+// constructor from its method signature.
+func constructorParams(signature []byte) (params [][]byte, err error) {
+	r := &blobReader{data: signature}
+	callingConvention := r.readByte()
+	if callingConvention&0x10 != 0 {
+		// Generic parameter count
+		r.readCompressed()
+	}
+	count := r.readCompressed()
+	if r.readByte() != elementTypeVoid {
+		err = errors.New("custom attribute constructor does not return void")
+		return
+	}
+
+	for range count {
+		start := r.pos
+		r.skipType()
+		params = append(params, signature[start:r.pos])
+	}
+	if r.err != nil {
+		err = fmt.Errorf("invalid constructor signature: %w", r.err)
+	}
+	return
+}
+
+// decodeCustomAttribute decodes a custom attribute value given the parameter
+// types of its constructor.
+func decodeCustomAttribute(value []byte, params [][]byte) (b *customAttributeBlob, err error) {
+	r := &blobReader{data: value}
+	if r.readUint16() != customAttributeProlog {
+		err = errors.New("custom attribute value has no prolog")
+		return
+	}
+
+	b = &customAttributeBlob{}
+	for _, param := range params {
+		var arg customAttributeArg
+		if arg, err = r.elem(param); err != nil {
+			return
+		}
+		b.fixed = append(b.fixed, arg)
+	}
+
+	b.namedCount = r.readUint16()
+	for range b.namedCount {
+		start := r.pos
+		kind := r.readByte()
+		if kind != 0x53 && kind != 0x54 {
+			err = fmt.Errorf("invalid named argument kind 0x%02X", kind)
+			return
+		}
+		typeStart := r.pos
+		r.skipFieldOrPropType()
+		fieldType := value[typeStart:r.pos]
+		r.readSerString()
+		prefix := value[start:r.pos]
+
+		arg, elemErr := r.elem(fieldType)
+		if elemErr != nil {
+			// Keep this and all following named arguments as they are
+			b.rest = value[start:]
+			break
+		}
+		b.named = append(b.named, customAttributeNamedArg{prefix: prefix, value: arg})
+	}
+
+	if r.err != nil {
+		err = fmt.Errorf("custom attribute value is truncated: %w", r.err)
+	}
+	return
+}
+
+// encode serializes the custom attribute value.
+func (b *customAttributeBlob) encode() (value []byte) {
+	value = binary.LittleEndian.AppendUint16(value, customAttributeProlog)
+	for _, arg := range b.fixed {
+		value = arg.encode(value)
+	}
+	value = binary.LittleEndian.AppendUint16(value, b.namedCount)
+	for _, named := range b.named {
+		value = append(value, named.prefix...)
+		value = named.value.encode(value)
+	}
+	return append(value, b.rest...)
+}
+
+func (a *customAttributeArg) encode(value []byte) []byte {
+	if !a.isString {
+		return append(value, a.raw...)
+	}
+	value = append(value, a.boxed...)
+	if a.null {
+		return append(value, 0xFF)
+	}
+	header, _ := encodeLength(len(a.str))
+	value = append(value, header...)
+	return append(value, a.str...)
+}
+
+// blobReader reads signatures and custom attribute values. The first read past
+// the end of the data sets err and all further reads return zero.
+type blobReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *blobReader) next(n int) []byte {
+	if r.err != nil || n < 0 || r.pos+n > len(r.data) {
+		if r.err == nil {
+			r.err = errors.New("unexpected end of blob")
+		}
+		return make([]byte, max(n, 0))
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *blobReader) readByte() byte     { return r.next(1)[0] }
+func (r *blobReader) readUint16() uint16 { return binary.LittleEndian.Uint16(r.next(2)) }
+func (r *blobReader) readUint32() uint32 { return binary.LittleEndian.Uint32(r.next(4)) }
+
+// readCompressed reads a compressed unsigned integer (II.23.2).
+func (r *blobReader) readCompressed() int {
+	if r.err != nil || r.pos >= len(r.data) {
+		r.next(1)
+		return 0
+	}
+	var header [4]byte
+	copy(header[:], r.data[r.pos:])
+	value, size, err := decodeLength(header)
+	if err != nil {
+		r.err = err
+		return 0
+	}
+	r.next(size)
+	return value
+}
+
+// readSerString reads a SerString: a compressed length followed by UTF-8 bytes,
+// or 0xFF for null.
+func (r *blobReader) readSerString() (str string, null bool) {
+	if r.pos < len(r.data) && r.data[r.pos] == 0xFF {
+		r.pos++
+		return "", true
+	}
+	return string(r.next(r.readCompressed())), false
+}
+
+// skipType skips a type in a method signature.
+func (r *blobReader) skipType() {
+	switch t := r.readByte(); t {
+	case elementTypeValueType, elementTypeClass:
+		r.readCompressed()
+	case elementTypeSZArray:
+		r.skipType()
+	default:
+		if t < elementTypeBoolean || (t > elementTypeString && t != elementTypeObject) {
+			if r.err == nil {
+				r.err = UnsupportedCustomAttributeErr
+			}
+		}
+	}
+}
+
+// skipFieldOrPropType skips the type of a named argument or boxed value.
+func (r *blobReader) skipFieldOrPropType() {
+	switch r.readByte() {
+	case elementTypeSZArray:
+		r.skipFieldOrPropType()
+	case elementTypeEnum:
+		r.readSerString()
+	}
+}
+
+// elem reads a value of the given signature or FieldOrPropType type.
+func (r *blobReader) elem(elemType []byte) (arg customAttributeArg, err error) {
+	start := r.pos
+	if err = r.skipElem(elemType); err != nil {
+		return
+	}
+	if r.err != nil {
+		err = r.err
+		return
+	}
+
+	boxedString := (elemType[0] == elementTypeObject || elemType[0] == elementTypeBoxed) && r.data[start] == elementTypeString
+
+	switch {
+	case boxedString:
+		arg.boxed = r.data[start : start+1]
+		start++
+		fallthrough
+	case elemType[0] == elementTypeString, elemType[0] == elementTypeClass, elemType[0] == elementTypeSystemType:
+		r.pos = start
+		arg.isString = true
+		arg.str, arg.null = r.readSerString()
+		if !utf8.ValidString(arg.str) {
+			err = errors.New("custom attribute string is not valid UTF-8")
+		}
+	default:
+		arg.raw = r.data[start:r.pos]
+	}
+	return
+}
+
+// skipElem skips a value of the given type.
+func (r *blobReader) skipElem(elemType []byte) (err error) {
+	switch t := elemType[0]; t {
+	case elementTypeBoolean, elementTypeI1, elementTypeU1:
+		r.next(1)
+	case elementTypeChar, elementTypeI2, elementTypeU2:
+		r.next(2)
+	case elementTypeI4, elementTypeU4, elementTypeR4:
+		r.next(4)
+	case elementTypeI8, elementTypeU8, elementTypeR8:
+		r.next(8)
+	case elementTypeString, elementTypeClass, elementTypeSystemType:
+		// System.Type arguments are serialized as type name strings
+		r.readSerString()
+	case elementTypeObject, elementTypeBoxed:
+		typeStart := r.pos
+		r.skipFieldOrPropType()
+		if r.err == nil {
+			err = r.skipElem(r.data[typeStart:r.pos])
+		}
+	case elementTypeSZArray:
+		count := r.readUint32()
+		if count == 0xFFFFFFFF {
+			return
+		}
+		for range count {
+			if err = r.skipElem(elemType[1:]); err != nil || r.err != nil {
+				return
+			}
+		}
+	default:
+		// Enums need the size of their underlying type, which is only
+		// known from the enum's definition
+		err = UnsupportedCustomAttributeErr
+	}
+	return
+}
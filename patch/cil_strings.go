@@ -0,0 +1,135 @@
+package patch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/renorris/openfsd-client-patch-utility/patchfile"
+	"os"
+	"strings"
+)
+
+// CilStringsPatch replaces an identifier in the #Strings heap of a .NET
+// assembly, such as a manifest resource name. Entries are null-terminated
+// UTF-8 and may be shared: an index can point into the middle of another
+// entry to reuse its suffix, so an entry is only replaced when nothing
+// refers to its suffix.
+type CilStringsPatch struct {
+	patchFile *patchfile.PatchFile
+	patch     *patchfile.CilStringsPatch
+	report    []string
+}
+
+func NewCilStringsPatch(patchFile *patchfile.PatchFile, patch *patchfile.CilStringsPatch) *CilStringsPatch {
+	return &CilStringsPatch{patchFile: patchFile, patch: patch}
+}
+
+func (p *CilStringsPatch) Run(file *os.File) (err error) {
+	p.report = nil
+
+	if p.patch.OldString == "" {
+		err = errors.New("old_string must be set")
+		return
+	}
+	if strings.ContainsRune(p.patch.NewString, 0) {
+		err = errors.New("new_string cannot contain null characters")
+		return
+	}
+	if len(p.patch.NewString) > len(p.patch.OldString) {
+		err = fmt.Errorf("new string cannot exceed available bytes (%d > %d)", len(p.patch.NewString), len(p.patch.OldString))
+		return
+	}
+
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	img, err := parsePEImage(data)
+	if err != nil {
+		return
+	}
+
+	header, err := img.cliHeader()
+	if err != nil {
+		return
+	}
+
+	stream, err := header.stream("#Strings")
+	if err != nil {
+		return
+	}
+
+	tables, err := img.metadataTables(header)
+	if err != nil {
+		return
+	}
+
+	var indexes []uint32
+	if p.patch.Section != "" {
+		var section *patchfile.Section
+		if section, err = p.patchFile.GetSection(p.patch.Section); err != nil {
+			return
+		}
+		offset := section.RawOffset + (p.patch.SectionAddress - section.VirtualStart)
+		if !stream.contains(offset) {
+			err = fmt.Errorf("0x%X is not inside the #Strings heap", offset)
+			return
+		}
+		indexes = append(indexes, uint32(offset-stream.offset))
+	} else {
+		heap := data[stream.offset : stream.offset+stream.size]
+		needle := append([]byte(p.patch.OldString), 0x00)
+		for i := 0; ; {
+			found := bytes.Index(heap[i:], needle)
+			if found < 0 {
+				break
+			}
+			// Only whole entries, not suffixes of longer ones
+			if i+found == 0 || heap[i+found-1] == 0x00 {
+				indexes = append(indexes, uint32(i+found))
+			}
+			i += found + 1
+		}
+	}
+	if len(indexes) == 0 {
+		err = fmt.Errorf("identifier %q not found in the #Strings heap", p.patch.OldString)
+		return
+	}
+
+	references := tables.stringReferences()
+	for _, index := range indexes {
+		var existing string
+		if existing, err = img.heapString(header, index); err != nil {
+			return
+		}
+		if existing != p.patch.OldString {
+			err = fmt.Errorf("#Strings entry 0x%X is %q, expected %q", index, existing, p.patch.OldString)
+			return
+		}
+
+		for _, reference := range references {
+			if reference > index && reference < index+uint32(len(existing)) {
+				err = fmt.Errorf("#Strings entry 0x%X shares its suffix %q with another identifier", index, existing[reference-index:])
+				return
+			}
+		}
+
+		entry := make([]byte, len(existing))
+		copy(entry, p.patch.NewString)
+		if _, err = file.WriteAt(entry, stream.offset+int64(index)); err != nil {
+			return
+		}
+		p.report = append(p.report, fmt.Sprintf("0x%X: replaced #Strings entry 0x%X", stream.offset+int64(index), index))
+	}
+
+	return
+}
+
+func (p *CilStringsPatch) Name() string {
+	return p.patch.Name
+}
+
+func (p *CilStringsPatch) Report() []string {
+	return p.report
+}
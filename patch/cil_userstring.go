@@ -61,7 +61,7 @@ func (p *CilUserstringPatch) readString(file *os.File) (str string, err error) {
 	}
 
 	var dataLength, headerSize int
-	if dataLength, headerSize, err = p.decodeLength([4]byte(lengthHeader)); err != nil {
+	if dataLength, headerSize, err = decodeLength([4]byte(lengthHeader)); err != nil {
 		return
 	}
 
@@ -99,6 +99,34 @@ func (p *CilUserstringPatch) readString(file *os.File) (str string, err error) {
 // writeString writes a string on the #US heap at the specified
 // file offset using the provided UTF-8 encoded string `str`.
 func (p *CilUserstringPatch) writeString(file *os.File, str string) (err error) {
+	encoded, err := encodeUserString(str)
+	if err != nil {
+		return
+	}
+
+	// Get raw offset
+	section, err := p.patchFile.GetSection(p.patch.Section)
+	if err != nil {
+		return
+	}
+	rawOffset := section.RawOffset + (p.patch.SectionAddress - section.VirtualStart)
+
+	// Seek to the file offset
+	if _, err = file.Seek(rawOffset, io.SeekStart); err != nil {
+		return
+	}
+
+	// Write the header and utf16 string bytes
+	if _, err = io.Copy(file, bytes.NewReader(encoded)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// encodeUserString encodes a UTF-8 string as a #US heap entry, including its
+// length header and terminal byte.
+func encodeUserString(str string) (encoded []byte, err error) {
 	// Convert UTF-8 characters into UTF-16 string
 	encoder := unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).NewEncoder()
 
@@ -143,39 +171,18 @@ func (p *CilUserstringPatch) writeString(file *os.File, str string) (err error)
 
 	// Encode the length of utf16Bytes
 	var header []byte
-	if header, err = p.encodeLength(len(utf16Bytes)); err != nil {
+	if header, err = encodeLength(len(utf16Bytes)); err != nil {
 		return
 	}
 
-	// Get raw offset
-	section, err := p.patchFile.GetSection(p.patch.Section)
-	if err != nil {
-		return
-	}
-	rawOffset := section.RawOffset + (p.patch.SectionAddress - section.VirtualStart)
-
-	// Seek to the file offset
-	if _, err = file.Seek(rawOffset, io.SeekStart); err != nil {
-		return
-	}
-
-	// Write the header
-	if _, err = io.Copy(file, bytes.NewReader(header)); err != nil {
-		return err
-	}
-
-	// Write the utf16 string bytes
-	if _, err = io.Copy(file, bytes.NewReader(utf16Bytes)); err != nil {
-		return err
-	}
-
-	return nil
+	encoded = append(header, utf16Bytes...)
+	return
 }
 
 // decodeLength decodes the length of a #US or #Blob string.
 // https://ecma-international.org/wp-content/uploads/ECMA-335_6th_edition_june_2012.pdf
 // II.24.2.4 #US and #Blob heaps
-func (p *CilUserstringPatch) decodeLength(header [4]byte) (length int, headerSize int, err error) {
+func decodeLength(header [4]byte) (length int, headerSize int, err error) {
 	if header[0]>>7 == 0 {
 		// Length is the 7 LSBs of header[0]
 		length = int(header[0])
@@ -208,7 +215,7 @@ func (p *CilUserstringPatch) decodeLength(header [4]byte) (length int, headerSiz
 // encodeLength encodes the length of a #US or #Blob string.
 // https://ecma-international.org/wp-content/uploads/ECMA-335_6th_edition_june_2012.pdf
 // II.24.2.4 #US and #Blob heaps
-func (p *CilUserstringPatch) encodeLength(length int) (header []byte, err error) {
+func encodeLength(length int) (header []byte, err error) {
 	if length < 0 {
 		err = errors.New("cannot encode negative length")
 		return
@@ -0,0 +1,150 @@
+package patch
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// https://ecma-international.org/wp-content/uploads/ECMA-335_6th_edition_june_2012.pdf
+// II.25.3.3 CLI header and II.24.2.1 Metadata root
+
+const imageDirectoryEntryComDescriptor = 14
+
+const metadataRootSignature = 0x424A5342
+
+var NotDotNetErr = errors.New("error: image is not a .NET assembly")
+
+// cliHeader describes the location of the CLI header and its metadata streams.
+type cliHeader struct {
+	// offset is the raw file offset of the CLI header
+	offset int64
+
+	flags uint32
+
+	// resources is the data directory of the embedded manifest resources
+	resources pe.DataDirectory
+
+	// strongNameSignature and managedNativeHeader are the data directories of
+	// the strong name signature and the ReadyToRun header
+	strongNameSignature pe.DataDirectory
+	managedNativeHeader pe.DataDirectory
+
+	// metadataOffset is the raw file offset of the metadata root
+	metadataOffset int64
+
+	streams []cliStream
+}
+
+// cliStream is a metadata stream such as #US or #Strings.
+type cliStream struct {
+	name string
+
+	// offset is the raw file offset of the first byte of the stream
+	offset int64
+	size   int64
+}
+
+// cliHeader parses the CLI header and metadata stream headers of a .NET assembly.
+func (img *image) cliHeader() (header *cliHeader, err error) {
+	if img.pe == nil {
+		err = NotDotNetErr
+		return
+	}
+
+	dir := img.dataDirectory(imageDirectoryEntryComDescriptor)
+	if dir.VirtualAddress == 0 {
+		err = NotDotNetErr
+		return
+	}
+
+	header = &cliHeader{}
+	if header.offset, err = img.rvaToOffset(dir.VirtualAddress); err != nil {
+		return
+	}
+	if header.offset+72 > int64(len(img.data)) {
+		err = errors.New("CLI header is truncated")
+		return
+	}
+
+	raw := img.data[header.offset:]
+	metadataRVA := binary.LittleEndian.Uint32(raw[8:12])
+	header.flags = binary.LittleEndian.Uint32(raw[16:20])
+	header.resources = pe.DataDirectory{
+		VirtualAddress: binary.LittleEndian.Uint32(raw[24:28]),
+		Size:           binary.LittleEndian.Uint32(raw[28:32]),
+	}
+	header.strongNameSignature = pe.DataDirectory{
+		VirtualAddress: binary.LittleEndian.Uint32(raw[32:36]),
+		Size:           binary.LittleEndian.Uint32(raw[36:40]),
+	}
+	header.managedNativeHeader = pe.DataDirectory{
+		VirtualAddress: binary.LittleEndian.Uint32(raw[64:68]),
+		Size:           binary.LittleEndian.Uint32(raw[68:72]),
+	}
+
+	if header.metadataOffset, err = img.rvaToOffset(metadataRVA); err != nil {
+		return
+	}
+
+	root := img.data[header.metadataOffset:]
+	if len(root) < 16 || binary.LittleEndian.Uint32(root[0:4]) != metadataRootSignature {
+		err = errors.New("invalid metadata root signature")
+		return
+	}
+
+	versionLength := int(binary.LittleEndian.Uint32(root[12:16]))
+	pos := 16 + versionLength
+	if pos+4 > len(root) {
+		err = errors.New("metadata root is truncated")
+		return
+	}
+	streamCount := int(binary.LittleEndian.Uint16(root[pos+2 : pos+4]))
+	pos += 4
+
+	for range streamCount {
+		if pos+8 > len(root) {
+			err = errors.New("metadata stream header is truncated")
+			return
+		}
+		streamOffset := binary.LittleEndian.Uint32(root[pos : pos+4])
+		streamSize := binary.LittleEndian.Uint32(root[pos+4 : pos+8])
+		pos += 8
+
+		nameEnd := bytes.IndexByte(root[pos:], 0x00)
+		if nameEnd < 0 {
+			err = errors.New("metadata stream name is not terminated")
+			return
+		}
+		name := string(root[pos : pos+nameEnd])
+
+		// Stream names are padded to the next 4-byte boundary
+		pos += (nameEnd + 4) &^ 3
+
+		header.streams = append(header.streams, cliStream{
+			name:   name,
+			offset: header.metadataOffset + int64(streamOffset),
+			size:   int64(streamSize),
+		})
+	}
+
+	return
+}
+
+// stream returns the metadata stream with the given name, e.g. #US.
+func (h *cliHeader) stream(name string) (stream *cliStream, err error) {
+	for i := range h.streams {
+		if h.streams[i].name == name {
+			return &h.streams[i], nil
+		}
+	}
+	err = fmt.Errorf("metadata stream %s not found", name)
+	return
+}
+
+// contains reports whether the given raw file offset lies inside the stream.
+func (s *cliStream) contains(offset int64) bool {
+	return offset >= s.offset && offset < s.offset+s.size
+}
@@ -0,0 +1,389 @@
+package patch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// https://ecma-international.org/wp-content/uploads/ECMA-335_6th_edition_june_2012.pdf
+// II.24.2.6 #~ stream and II.22 Metadata logical format: tables
+
+// Metadata table numbers
+const (
+	tableModule                 = 0x00
+	tableTypeRef                = 0x01
+	tableTypeDef                = 0x02
+	tableFieldPtr               = 0x03
+	tableField                  = 0x04
+	tableMethodPtr              = 0x05
+	tableMethodDef              = 0x06
+	tableParamPtr               = 0x07
+	tableParam                  = 0x08
+	tableInterfaceImpl          = 0x09
+	tableMemberRef              = 0x0A
+	tableConstant               = 0x0B
+	tableCustomAttribute        = 0x0C
+	tableFieldMarshal           = 0x0D
+	tableDeclSecurity           = 0x0E
+	tableClassLayout            = 0x0F
+	tableFieldLayout            = 0x10
+	tableStandAloneSig          = 0x11
+	tableEventMap               = 0x12
+	tableEventPtr               = 0x13
+	tableEvent                  = 0x14
+	tablePropertyMap            = 0x15
+	tablePropertyPtr            = 0x16
+	tableProperty               = 0x17
+	tableMethodSemantics        = 0x18
+	tableMethodImpl             = 0x19
+	tableModuleRef              = 0x1A
+	tableTypeSpec               = 0x1B
+	tableImplMap                = 0x1C
+	tableFieldRVA               = 0x1D
+	tableEncLog                 = 0x1E
+	tableEncMap                 = 0x1F
+	tableAssembly               = 0x20
+	tableAssemblyProcessor      = 0x21
+	tableAssemblyOS             = 0x22
+	tableAssemblyRef            = 0x23
+	tableAssemblyRefProcessor   = 0x24
+	tableAssemblyRefOS          = 0x25
+	tableFile                   = 0x26
+	tableExportedType           = 0x27
+	tableManifestResource       = 0x28
+	tableNestedClass            = 0x29
+	tableGenericParam           = 0x2A
+	tableMethodSpec             = 0x2B
+	tableGenericParamConstraint = 0x2C
+
+	tableCount = 0x2D
+)
+
+// columnKind is the type of a metadata table column.
+type columnKind int
+
+const (
+	columnUint16 columnKind = iota
+	columnUint32
+	columnString
+	columnGUID
+	columnBlob
+
+	// columnTable is an index into the table given by the column's ref
+	columnTable
+
+	// columnCoded is a coded index of the kind given by the column's ref
+	columnCoded
+)
+
+type metadataColumn struct {
+	kind columnKind
+	ref  int
+}
+
+// Coded index kinds (II.24.2.6)
+const (
+	codedTypeDefOrRef = iota
+	codedHasConstant
+	codedHasCustomAttribute
+	codedHasFieldMarshal
+	codedHasDeclSecurity
+	codedMemberRefParent
+	codedHasSemantics
+	codedMethodDefOrRef
+	codedMemberForwarded
+	codedImplementation
+	codedCustomAttributeType
+	codedResolutionScope
+	codedTypeOrMethodDef
+)
+
+// codedIndexTables lists the tables each coded index kind can refer to, in
+// tag order. -1 marks unused tags.
+var codedIndexTables = [][]int{
+	codedTypeDefOrRef:        {tableTypeDef, tableTypeRef, tableTypeSpec},
+	codedHasConstant:         {tableField, tableParam, tableProperty},
+	codedHasCustomAttribute:  {tableMethodDef, tableField, tableTypeRef, tableTypeDef, tableParam, tableInterfaceImpl, tableMemberRef, tableModule, tableDeclSecurity, tableProperty, tableEvent, tableStandAloneSig, tableModuleRef, tableTypeSpec, tableAssembly, tableAssemblyRef, tableFile, tableExportedType, tableManifestResource, tableGenericParam, tableGenericParamConstraint, tableMethodSpec},
+	codedHasFieldMarshal:     {tableField, tableParam},
+	codedHasDeclSecurity:     {tableTypeDef, tableMethodDef, tableAssembly},
+	codedMemberRefParent:     {tableTypeDef, tableTypeRef, tableModuleRef, tableMethodDef, tableTypeSpec},
+	codedHasSemantics:        {tableEvent, tableProperty},
+	codedMethodDefOrRef:      {tableMethodDef, tableMemberRef},
+	codedMemberForwarded:     {tableField, tableMethodDef},
+	codedImplementation:      {tableFile, tableAssemblyRef, tableExportedType},
+	codedCustomAttributeType: {-1, -1, tableMethodDef, tableMemberRef, -1},
+	codedResolutionScope:     {tableModule, tableModuleRef, tableAssemblyRef, tableTypeRef},
+	codedTypeOrMethodDef:     {tableTypeDef, tableMethodDef},
+}
+
+var (
+	colUint16 = metadataColumn{kind: columnUint16}
+	colUint32 = metadataColumn{kind: columnUint32}
+	colString = metadataColumn{kind: columnString}
+	colGUID   = metadataColumn{kind: columnGUID}
+	colBlob   = metadataColumn{kind: columnBlob}
+)
+
+func colTable(table int) metadataColumn { return metadataColumn{kind: columnTable, ref: table} }
+func colCoded(kind int) metadataColumn  { return metadataColumn{kind: columnCoded, ref: kind} }
+
+// metadataSchema lists the columns of each metadata table.
+var metadataSchema = [tableCount][]metadataColumn{
+	tableModule:                 {colUint16, colString, colGUID, colGUID, colGUID},
+	tableTypeRef:                {colCoded(codedResolutionScope), colString, colString},
+	tableTypeDef:                {colUint32, colString, colString, colCoded(codedTypeDefOrRef), colTable(tableField), colTable(tableMethodDef)},
+	tableFieldPtr:               {colTable(tableField)},
+	tableField:                  {colUint16, colString, colBlob},
+	tableMethodPtr:              {colTable(tableMethodDef)},
+	tableMethodDef:              {colUint32, colUint16, colUint16, colString, colBlob, colTable(tableParam)},
+	tableParamPtr:               {colTable(tableParam)},
+	tableParam:                  {colUint16, colUint16, colString},
+	tableInterfaceImpl:          {colTable(tableTypeDef), colCoded(codedTypeDefOrRef)},
+	tableMemberRef:              {colCoded(codedMemberRefParent), colString, colBlob},
+	tableConstant:               {colUint16, colCoded(codedHasConstant), colBlob},
+	tableCustomAttribute:        {colCoded(codedHasCustomAttribute), colCoded(codedCustomAttributeType), colBlob},
+	tableFieldMarshal:           {colCoded(codedHasFieldMarshal), colBlob},
+	tableDeclSecurity:           {colUint16, colCoded(codedHasDeclSecurity), colBlob},
+	tableClassLayout:            {colUint16, colUint32, colTable(tableTypeDef)},
+	tableFieldLayout:            {colUint32, colTable(tableField)},
+	tableStandAloneSig:          {colBlob},
+	tableEventMap:               {colTable(tableTypeDef), colTable(tableEvent)},
+	tableEventPtr:               {colTable(tableEvent)},
+	tableEvent:                  {colUint16, colString, colCoded(codedTypeDefOrRef)},
+	tablePropertyMap:            {colTable(tableTypeDef), colTable(tableProperty)},
+	tablePropertyPtr:            {colTable(tableProperty)},
+	tableProperty:               {colUint16, colString, colBlob},
+	tableMethodSemantics:        {colUint16, colTable(tableMethodDef), colCoded(codedHasSemantics)},
+	tableMethodImpl:             {colTable(tableTypeDef), colCoded(codedMethodDefOrRef), colCoded(codedMethodDefOrRef)},
+	tableModuleRef:              {colString},
+	tableTypeSpec:               {colBlob},
+	tableImplMap:                {colUint16, colCoded(codedMemberForwarded), colString, colTable(tableModuleRef)},
+	tableFieldRVA:               {colUint32, colTable(tableField)},
+	tableEncLog:                 {colUint32, colUint32},
+	tableEncMap:                 {colUint32},
+	tableAssembly:               {colUint32, colUint16, colUint16, colUint16, colUint16, colUint32, colBlob, colString, colString},
+	tableAssemblyProcessor:      {colUint32},
+	tableAssemblyOS:             {colUint32, colUint32, colUint32},
+	tableAssemblyRef:            {colUint16, colUint16, colUint16, colUint16, colUint32, colBlob, colString, colString, colBlob},
+	tableAssemblyRefProcessor:   {colUint32, colTable(tableAssemblyRef)},
+	tableAssemblyRefOS:          {colUint32, colUint32, colUint32, colTable(tableAssemblyRef)},
+	tableFile:                   {colUint32, colString, colBlob},
+	tableExportedType:           {colUint32, colUint32, colString, colString, colCoded(codedImplementation)},
+	tableManifestResource:       {colUint32, colUint32, colString, colCoded(codedImplementation)},
+	tableNestedClass:            {colTable(tableTypeDef), colTable(tableTypeDef)},
+	tableGenericParam:           {colUint16, colUint16, colCoded(codedTypeOrMethodDef), colString},
+	tableMethodSpec:             {colCoded(codedMethodDefOrRef), colBlob},
+	tableGenericParamConstraint: {colTable(tableGenericParam), colCoded(codedTypeDefOrRef)},
+}
+
+// metadataTables describes the layout of the #~ stream of a .NET assembly.
+type metadataTables struct {
+	heapSizes byte
+	rows      [tableCount]uint32
+
+	// offsets holds the raw file offset of each table
+	offsets [tableCount]int64
+
+	// columnOffsets and rowSizes describe the layout of each table's rows
+	columnOffsets [tableCount][]int
+	rowSizes      [tableCount]int
+
+	data []byte
+}
+
+// metadataTables parses the table header of the #~ stream.
+func (img *image) metadataTables(header *cliHeader) (t *metadataTables, err error) {
+	stream, err := header.stream("#~")
+	if err != nil {
+		// Unoptimized metadata uses #- with the same layout
+		if stream, err = header.stream("#-"); err != nil {
+			return
+		}
+	}
+
+	raw := img.data[stream.offset : stream.offset+stream.size]
+	if len(raw) < 24 {
+		err = errors.New("metadata table stream is truncated")
+		return
+	}
+
+	t = &metadataTables{data: img.data, heapSizes: raw[6]}
+	valid := binary.LittleEndian.Uint64(raw[8:16])
+
+	pos := 24
+	for i := range 64 {
+		if valid&(1<<i) == 0 {
+			continue
+		}
+		if pos+4 > len(raw) {
+			err = errors.New("metadata table row counts are truncated")
+			return
+		}
+		if i >= tableCount {
+			err = fmt.Errorf("unsupported metadata table 0x%02X", i)
+			return
+		}
+		t.rows[i] = binary.LittleEndian.Uint32(raw[pos:])
+		pos += 4
+	}
+
+	// Uncompressed streams may carry an extra 4-byte value after the row counts
+	if t.heapSizes&0x40 != 0 {
+		pos += 4
+	}
+
+	offset := stream.offset + int64(pos)
+	for i := range tableCount {
+		columnOffset := 0
+		for _, column := range metadataSchema[i] {
+			t.columnOffsets[i] = append(t.columnOffsets[i], columnOffset)
+			columnOffset += t.columnSize(column)
+		}
+		t.rowSizes[i] = columnOffset
+		t.offsets[i] = offset
+		offset += int64(t.rows[i]) * int64(columnOffset)
+	}
+
+	if offset > stream.offset+stream.size {
+		err = errors.New("metadata tables exceed the table stream")
+	}
+	return
+}
+
+// columnSize returns the width of a column in bytes.
+func (t *metadataTables) columnSize(column metadataColumn) int {
+	switch column.kind {
+	case columnUint16:
+		return 2
+	case columnUint32:
+		return 4
+	case columnString:
+		return t.heapIndexSize(0x01)
+	case columnGUID:
+		return t.heapIndexSize(0x02)
+	case columnBlob:
+		return t.heapIndexSize(0x04)
+	case columnTable:
+		if t.rows[column.ref] > 0xFFFF {
+			return 4
+		}
+		return 2
+	case columnCoded:
+		tables := codedIndexTables[column.ref]
+		tagBits := bits.Len(uint(len(tables) - 1))
+		for _, table := range tables {
+			if table >= 0 && t.rows[table] >= 1<<(16-tagBits) {
+				return 4
+			}
+		}
+		return 2
+	}
+	return 0
+}
+
+func (t *metadataTables) heapIndexSize(flag byte) int {
+	if t.heapSizes&flag != 0 {
+		return 4
+	}
+	return 2
+}
+
+// cellOffset returns the raw file offset and width of a cell. Rows are
+// numbered from 1 as in metadata tokens.
+func (t *metadataTables) cellOffset(table int, row uint32, column int) (offset int64, size int) {
+	offset = t.offsets[table] + int64(row-1)*int64(t.rowSizes[table]) + int64(t.columnOffsets[table][column])
+	size = t.columnSize(metadataSchema[table][column])
+	return
+}
+
+// cell reads the value of a cell.
+func (t *metadataTables) cell(table int, row uint32, column int) uint32 {
+	offset, size := t.cellOffset(table, row, column)
+	if size == 2 {
+		return uint32(binary.LittleEndian.Uint16(t.data[offset:]))
+	}
+	return binary.LittleEndian.Uint32(t.data[offset:])
+}
+
+// setCell writes the value of a cell into data.
+func (t *metadataTables) setCell(data []byte, table int, row uint32, column int, value uint32) (err error) {
+	offset, size := t.cellOffset(table, row, column)
+	if size == 2 {
+		if value > 0xFFFF {
+			err = fmt.Errorf("value 0x%X does not fit in a 2-byte metadata column", value)
+			return
+		}
+		binary.LittleEndian.PutUint16(data[offset:], uint16(value))
+		return
+	}
+	binary.LittleEndian.PutUint32(data[offset:], value)
+	return
+}
+
+// heapString reads a null-terminated string from the #Strings heap.
+func (img *image) heapString(header *cliHeader, index uint32) (s string, err error) {
+	stream, err := header.stream("#Strings")
+	if err != nil {
+		return
+	}
+	if int64(index) >= stream.size {
+		err = fmt.Errorf("#Strings index 0x%X is out of range", index)
+		return
+	}
+
+	raw := img.data[stream.offset+int64(index) : stream.offset+stream.size]
+	end := bytes.IndexByte(raw, 0x00)
+	if end < 0 {
+		err = fmt.Errorf("#Strings entry 0x%X is not terminated", index)
+		return
+	}
+	s = string(raw[:end])
+	return
+}
+
+// heapBlob returns the location and contents of a #Blob heap entry. offset is
+// the raw file offset of the entry's length prefix.
+func (img *image) heapBlob(header *cliHeader, index uint32) (offset int64, headerSize int, blob []byte, err error) {
+	stream, err := header.stream("#Blob")
+	if err != nil {
+		return
+	}
+	if int64(index) >= stream.size {
+		err = fmt.Errorf("#Blob index 0x%X is out of range", index)
+		return
+	}
+
+	offset = stream.offset + int64(index)
+	var lengthHeader [4]byte
+	copy(lengthHeader[:], img.data[offset:stream.offset+stream.size])
+
+	var length int
+	if length, headerSize, err = decodeLength(lengthHeader); err != nil {
+		return
+	}
+	if offset+int64(headerSize+length) > stream.offset+stream.size {
+		err = fmt.Errorf("#Blob entry 0x%X exceeds the heap", index)
+		return
+	}
+
+	blob = img.data[offset+int64(headerSize) : offset+int64(headerSize+length)]
+	return
+}
+
+// stringReferences returns every #Strings index referenced by the metadata tables.
+func (t *metadataTables) stringReferences() (indexes []uint32) {
+	for table := range tableCount {
+		for column, kind := range metadataSchema[table] {
+			if kind != colString {
+				continue
+			}
+			for row := uint32(1); row <= t.rows[table]; row++ {
+				indexes = append(indexes, t.cell(table, row, column))
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,79 @@
+package patch
+
+import (
+	"errors"
+	"fmt"
+	"github.com/renorris/openfsd-client-patch-utility/patchfile"
+	"os"
+)
+
+// CodeCavePatch locates and reserves a code cave, then registers it as a
+// section so that later patches can place data in it and refer to it.
+type CodeCavePatch struct {
+	patchFile *patchfile.PatchFile
+	patch     *patchfile.CodeCave
+	caves     *CaveAllocator
+	report    []string
+}
+
+func NewCodeCavePatch(patchFile *patchfile.PatchFile, patch *patchfile.CodeCave, caves *CaveAllocator) *CodeCavePatch {
+	return &CodeCavePatch{patchFile: patchFile, patch: patch, caves: caves}
+}
+
+func (p *CodeCavePatch) Run(file *os.File) (err error) {
+	p.report = nil
+
+	if p.patch.Size <= 0 {
+		err = errors.New("code cave size must be positive")
+		return
+	}
+	if _, sectionErr := p.patchFile.GetSection(p.patch.Name); sectionErr == nil {
+		err = fmt.Errorf("a section named %s already exists", p.patch.Name)
+		return
+	}
+
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	img, err := parseImage(data)
+	if err != nil {
+		return
+	}
+
+	c, err := p.caves.allocate(img, caveRequest{
+		size:       p.patch.Size,
+		alignment:  p.patch.Alignment,
+		sections:   p.patch.Sections,
+		executable: p.patch.Executable,
+	})
+	if err != nil {
+		return
+	}
+
+	// Growing a section's virtual size modifies its header
+	if c.slack {
+		if _, err = file.WriteAt(data, 0); err != nil {
+			return
+		}
+	}
+
+	p.patchFile.AddSection(patchfile.Section{
+		Name:         p.patch.Name,
+		RawOffset:    c.offset,
+		VirtualStart: 0,
+		ImageAddress: int64(c.address),
+	})
+
+	p.report = append(p.report, fmt.Sprintf("reserved 0x%X bytes at %s", c.size, c))
+	return
+}
+
+func (p *CodeCavePatch) Name() string {
+	return fmt.Sprintf("Allocate code cave %s", p.patch.Name)
+}
+
+func (p *CodeCavePatch) Report() []string {
+	return p.report
+}
@@ -0,0 +1,193 @@
+package patch
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/renorris/openfsd-client-patch-utility/patchfile"
+	"os"
+)
+
+// https://ecma-international.org/wp-content/uploads/ECMA-335_6th_edition_june_2012.pdf
+// II.25.3.3.1 Runtime flags, and
+// https://github.com/dotnet/runtime/blob/main/docs/design/coreclr/botr/readytorun-format.md
+
+const (
+	comImageFlagsILOnly           = 0x00000001
+	comImageFlagsILLibrary        = 0x00000004
+	comImageFlagsStrongNameSigned = 0x00000008
+)
+
+// Offsets of CLI header fields
+const (
+	cliHeaderFlags               = 16
+	cliHeaderManagedNativeHeader = 64
+)
+
+const readyToRunSignature = 0x00525452 // "RTR"
+
+// DotNetImageInfo describes how a .NET assembly is signed and compiled.
+type DotNetImageInfo struct {
+	// StrongNameSigned is set when the CLI header claims a strong name signature
+	StrongNameSigned bool
+
+	// ReadyToRun is set when the assembly contains precompiled native code,
+	// which the runtime may execute instead of the (patched) IL
+	ReadyToRun bool
+
+	// ReadyToRunVersion is the major.minor version of the ReadyToRun header
+	ReadyToRunVersion string
+
+	ILOnly bool
+}
+
+// InspectDotNetImage reports the strong name and ReadyToRun status of a .NET
+// assembly. NotDotNetErr is returned for native images.
+func InspectDotNetImage(file *os.File) (info *DotNetImageInfo, err error) {
+	return InspectNestedDotNetImage(file, "", "")
+}
+
+// InspectNestedDotNetImage is InspectDotNetImage for the assembly binary patches
+// apply to: a file inside a .NET single-file bundle, an embedded manifest
+// resource, or a manifest resource of a file inside a bundle.
+func InspectNestedDotNetImage(file *os.File, bundleEntry string, manifestResource string) (info *DotNetImageInfo, err error) {
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	if bundleEntry != "" {
+		if data, err = bundleEntryData(data, bundleEntry); err != nil {
+			return
+		}
+	}
+	if manifestResource != "" {
+		if data, err = manifestResourceData(data, manifestResource); err != nil {
+			return
+		}
+	}
+
+	img, err := parsePEImage(data)
+	if err != nil {
+		return
+	}
+
+	return img.dotNetImageInfo()
+}
+
+func (img *image) dotNetImageInfo() (info *DotNetImageInfo, err error) {
+	header, err := img.cliHeader()
+	if err != nil {
+		return
+	}
+
+	info = &DotNetImageInfo{
+		StrongNameSigned: header.flags&comImageFlagsStrongNameSigned != 0,
+		ILOnly:           header.flags&comImageFlagsILOnly != 0,
+	}
+
+	var major, minor uint16
+	if major, minor, info.ReadyToRun = img.readyToRunHeader(header); info.ReadyToRun {
+		info.ReadyToRunVersion = fmt.Sprintf("%d.%d", major, minor)
+	}
+	return
+}
+
+// readyToRunHeader locates the ReadyToRun header referenced by the CLI header,
+// the same way the runtime does.
+func (img *image) readyToRunHeader(header *cliHeader) (major uint16, minor uint16, ok bool) {
+	dir := header.managedNativeHeader
+	if dir.VirtualAddress == 0 || dir.Size < 8 {
+		return
+	}
+
+	offset, err := img.rvaToOffset(dir.VirtualAddress)
+	if err != nil || offset+8 > int64(len(img.data)) {
+		return
+	}
+
+	raw := img.data[offset:]
+	if binary.LittleEndian.Uint32(raw[0:4]) != readyToRunSignature {
+		return
+	}
+
+	return binary.LittleEndian.Uint16(raw[4:6]), binary.LittleEndian.Uint16(raw[6:8]), true
+}
+
+// DotNetImagePatch clears the strong name flag and/or drops the ReadyToRun
+// header of a .NET assembly so that IL and metadata patches take effect.
+type DotNetImagePatch struct {
+	patch  *patchfile.DotNetImage
+	report []string
+}
+
+func NewDotNetImagePatch(patch *patchfile.DotNetImage) *DotNetImagePatch {
+	return &DotNetImagePatch{patch: patch}
+}
+
+func (p *DotNetImagePatch) Run(file *os.File) (err error) {
+	p.report = nil
+
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	img, err := parsePEImage(data)
+	if err != nil {
+		return
+	}
+
+	header, err := img.cliHeader()
+	if err != nil {
+		return
+	}
+
+	flags := header.flags
+
+	if p.patch.ClearStrongNameFlag {
+		if flags&comImageFlagsStrongNameSigned != 0 {
+			flags &^= comImageFlagsStrongNameSigned
+			p.report = append(p.report, "cleared strong name signed flag")
+		} else {
+			p.report = append(p.report, "assembly is not strong name signed")
+		}
+	}
+
+	if p.patch.RemoveReadyToRun {
+		if _, _, ok := img.readyToRunHeader(header); ok {
+			// Without a ManagedNativeHeader the runtime ignores the precompiled
+			// code and JIT compiles the IL instead. The OS-specific machine
+			// value is only accepted on ReadyToRun images.
+			binary.LittleEndian.PutUint64(data[header.offset+cliHeaderManagedNativeHeader:], 0)
+			flags &^= comImageFlagsILLibrary
+
+			normalizeMachine(data)
+			p.report = append(p.report, "removed ReadyToRun header")
+		} else {
+			p.report = append(p.report, "assembly is not compiled ReadyToRun")
+		}
+	}
+
+	binary.LittleEndian.PutUint32(data[header.offset+cliHeaderFlags:], flags)
+
+	if _, err = file.WriteAt(data, 0); err != nil {
+		return
+	}
+
+	return
+}
+
+// normalizeMachine replaces an OS-specific ReadyToRun machine value with the
+// plain machine type, which IL-only images are expected to carry.
+func normalizeMachine(data []byte) {
+	machineOffset := int64(binary.LittleEndian.Uint32(data[0x3C:])) + 4
+	copy(data[machineOffset:machineOffset+2], peHeaderView(data)[machineOffset:])
+}
+
+func (p *DotNetImagePatch) Name() string {
+	return "Update .NET image flags"
+}
+
+func (p *DotNetImagePatch) Report() []string {
+	return p.report
+}
@@ -0,0 +1,332 @@
+package patch
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/renorris/openfsd-client-patch-utility/patchfile"
+	"os"
+	"slices"
+	"unicode/utf16"
+)
+
+// .resources files are written by System.Resources.ResourceWriter and embedded
+// as manifest resources, e.g. MyApp.Properties.Resources.resources.
+// https://github.com/dotnet/runtime/blob/main/src/libraries/System.Private.CoreLib/src/System/Resources/ResourceReader.cs
+
+const resourcesMagic = 0xBEEFCACE
+
+// resourceTypeString is the type code of string values in version 2 .resources files
+const resourceTypeString = 0x01
+
+// resourcesFile is a parsed .resources file.
+type resourcesFile struct {
+	data []byte
+
+	// dataSectionOffset is the offset of the data section from the start of the file
+	dataSectionOffset int64
+
+	entries []resourcesEntry
+}
+
+// resourcesEntry is a named resource.
+type resourcesEntry struct {
+	name string
+
+	// dataOffsetPosition is the position of the entry's data offset in the name section
+	dataOffsetPosition int64
+
+	// dataOffset is the offset of the entry's value from the start of the data section
+	dataOffset int64
+}
+
+// parseResources parses a version 2 .resources file.
+func parseResources(data []byte) (f *resourcesFile, err error) {
+	r := &blobReader{data: data}
+	if r.readUint32() != resourcesMagic {
+		err = errors.New("resource is not a .resources file")
+		return
+	}
+
+	// Resource manager header: version, then the length of the reader and
+	// resource set type names to skip
+	r.readUint32()
+	r.next(int(int32(r.readUint32())))
+
+	version := r.readUint32()
+	if version != 2 {
+		err = fmt.Errorf("unsupported .resources version %d", version)
+		return
+	}
+	count := int(int32(r.readUint32()))
+	typeCount := int(int32(r.readUint32()))
+	for range typeCount {
+		r.next(r.read7BitEncodedInt())
+	}
+
+	// The hash and position arrays are 8-byte aligned with "PAD" bytes
+	r.next(alignmentPadding(uint64(r.pos), 8))
+	r.next(4 * count) // name hashes
+
+	positions := make([]int64, count)
+	for i := range positions {
+		positions[i] = int64(r.readUint32())
+	}
+
+	f = &resourcesFile{data: data, dataSectionOffset: int64(r.readUint32())}
+	nameSectionOffset := int64(r.pos)
+	if r.err != nil {
+		err = fmt.Errorf(".resources header is truncated: %w", r.err)
+		return
+	}
+
+	for _, position := range positions {
+		nr := &blobReader{data: data, pos: int(nameSectionOffset + position)}
+		entry := resourcesEntry{name: decodeUTF16LE(nr.next(nr.read7BitEncodedInt()))}
+		entry.dataOffsetPosition = int64(nr.pos)
+		entry.dataOffset = int64(nr.readUint32())
+		if nr.err != nil || f.dataSectionOffset+entry.dataOffset > int64(len(data)) {
+			err = fmt.Errorf(".resources name section is invalid")
+			return
+		}
+		f.entries = append(f.entries, entry)
+	}
+
+	return
+}
+
+// valueRanges returns the start and end of every distinct value in the data
+// section, in file order. Values of user types carry no length, so each value
+// extends to the start of the next.
+func (f *resourcesFile) valueRanges() (starts []int64, ends map[int64]int64) {
+	for _, e := range f.entries {
+		if !slices.Contains(starts, e.dataOffset) {
+			starts = append(starts, e.dataOffset)
+		}
+	}
+	slices.Sort(starts)
+
+	ends = make(map[int64]int64)
+	for i, start := range starts {
+		end := int64(len(f.data)) - f.dataSectionOffset
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		ends[start] = end
+	}
+	return
+}
+
+// entry returns the resource with the given name.
+func (f *resourcesFile) entry(name string) (e *resourcesEntry, err error) {
+	for i := range f.entries {
+		if f.entries[i].name == name {
+			return &f.entries[i], nil
+		}
+	}
+	err = fmt.Errorf("no resource named %s", name)
+	return
+}
+
+// stringValue reads the value of a resource if it is a string.
+func (f *resourcesFile) stringValue(e *resourcesEntry) (value string, ok bool) {
+	r := &blobReader{data: f.data, pos: int(f.dataSectionOffset + e.dataOffset)}
+	if r.read7BitEncodedInt() != resourceTypeString {
+		return
+	}
+	value = string(r.next(r.read7BitEncodedInt()))
+	return value, r.err == nil
+}
+
+// replaceString rebuilds the .resources file with a new string value for one
+// resource. Names, and therefore their hashes and positions, stay the same;
+// the data section is laid out again and the data offsets are updated.
+func (f *resourcesFile) replaceString(name string, value string) (newData []byte, err error) {
+	e, err := f.entry(name)
+	if err != nil {
+		return
+	}
+	if _, ok := f.stringValue(e); !ok {
+		err = fmt.Errorf("resource %s is not a string", name)
+		return
+	}
+
+	replaced := appendDotNetString([]byte{resourceTypeString}, value)
+
+	starts, ends := f.valueRanges()
+	newData = slices.Clone(f.data[:f.dataSectionOffset])
+	newOffsets := make(map[int64]int64)
+	for _, start := range starts {
+		newOffsets[start] = int64(len(newData)) - f.dataSectionOffset
+		if start == e.dataOffset {
+			newData = append(newData, replaced...)
+		} else {
+			newData = append(newData, f.data[f.dataSectionOffset+start:f.dataSectionOffset+ends[start]]...)
+		}
+	}
+
+	for _, entry := range f.entries {
+		binary.LittleEndian.PutUint32(newData[entry.dataOffsetPosition:], uint32(newOffsets[entry.dataOffset]))
+	}
+	return
+}
+
+func (r *blobReader) read7BitEncodedInt() int {
+	if r.err != nil {
+		return 0
+	}
+	value, size, err := read7BitEncodedInt(r.data[min(r.pos, len(r.data)):])
+	if err != nil {
+		r.err = err
+		return 0
+	}
+	r.pos += size
+	return value
+}
+
+func decodeUTF16LE(data []byte) string {
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(data[i*2:])
+	}
+	return string(utf16.Decode(units))
+}
+
+// ResourcesStringPatch replaces a string in a .resources file embedded as a
+// manifest resource, such as a server list in Properties.Resources.
+type ResourcesStringPatch struct {
+	patch  *patchfile.ResourcesStringPatch
+	report []string
+}
+
+func NewResourcesStringPatch(patch *patchfile.ResourcesStringPatch) *ResourcesStringPatch {
+	return &ResourcesStringPatch{patch: patch}
+}
+
+func (p *ResourcesStringPatch) Run(file *os.File) (err error) {
+	p.report = nil
+
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	img, err := parsePEImage(data)
+	if err != nil {
+		return
+	}
+
+	header, err := img.cliHeader()
+	if err != nil {
+		return
+	}
+
+	tables, err := img.metadataTables(header)
+	if err != nil {
+		return
+	}
+
+	resources, err := img.manifestResources(header, tables)
+	if err != nil {
+		return
+	}
+
+	r, err := findManifestResource(resources, p.patch.Resource)
+	if err != nil {
+		return
+	}
+
+	resourcesData, err := parseResources(data[r.dataOffset : r.dataOffset+r.size])
+	if err != nil {
+		err = fmt.Errorf("%s: %w", r.name, err)
+		return
+	}
+
+	e, err := resourcesData.entry(p.patch.Key)
+	if err != nil {
+		return
+	}
+	oldValue, _ := resourcesData.stringValue(e)
+
+	newResources, err := resourcesData.replaceString(p.patch.Key, p.patch.NewString)
+	if err != nil {
+		return
+	}
+	p.report = append(p.report, fmt.Sprintf("%s: %q -> %q", p.patch.Key, oldValue, p.patch.NewString))
+
+	var line string
+	if data, line, err = img.replaceManifestResource(header, tables, resources, r, newResources); err != nil {
+		return
+	}
+	p.report = append(p.report, line)
+
+	if err = rewriteWholeFile(file, data); err != nil {
+		return
+	}
+
+	return
+}
+
+func (p *ResourcesStringPatch) Name() string {
+	return p.patch.Name
+}
+
+func (p *ResourcesStringPatch) Report() []string {
+	return p.report
+}
+
+// ResourceInfo describes a manifest resource and, for .resources files, the
+// string values it holds.
+type ResourceInfo struct {
+	Name    string
+	Size    int64
+	Strings []ResourceString
+}
+
+type ResourceString struct {
+	Key   string
+	Value string
+}
+
+// ListResources returns the manifest resources embedded in a .NET assembly.
+func ListResources(file *os.File) (resources []ResourceInfo, err error) {
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	img, err := parsePEImage(data)
+	if err != nil {
+		return
+	}
+
+	header, err := img.cliHeader()
+	if err != nil {
+		return
+	}
+
+	tables, err := img.metadataTables(header)
+	if err != nil {
+		return
+	}
+
+	embedded, err := img.manifestResources(header, tables)
+	if err != nil {
+		return
+	}
+
+	for _, r := range embedded {
+		info := ResourceInfo{Name: r.name, Size: r.size}
+		if f, parseErr := parseResources(data[r.dataOffset : r.dataOffset+r.size]); parseErr == nil {
+			for i := range f.entries {
+				if value, ok := f.stringValue(&f.entries[i]); ok {
+					info.Strings = append(info.Strings, ResourceString{Key: f.entries[i].name, Value: value})
+				}
+			}
+			slices.SortFunc(info.Strings, func(a, b ResourceString) int { return cmp.Compare(a.Key, b.Key) })
+		}
+		resources = append(resources, info)
+	}
+	return
+}
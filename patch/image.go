@@ -0,0 +1,265 @@
+package patch
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// image is a format-independent view of an executable's layout. It is used by
+// patches that locate their targets by searching the binary rather than relying
+// on sections declared by hand in the patchfile.
+type image struct {
+	data      []byte
+	is64      bool
+	imageBase uint64
+	sections  []imageSection
+
+	// x86 is set for x86 and x86-64 images, whose code can be searched for references
+	x86 bool
+
+	// pe is set when the image is a PE file.
+	pe *pe.File
+
+	// elf is set when the image is an ELF file.
+	elf *elf.File
+
+	// macho is set when the image is a single-architecture Mach-O file.
+	macho *macho.File
+
+	// segments holds the PT_LOAD segments of an ELF file, named LOAD0, LOAD1,
+	// ..., or the segments of a Mach-O file, named as in __TEXT
+	segments []imageSection
+}
+
+// imageSection describes where a section lives in the file and in memory.
+type imageSection struct {
+	name string
+
+	// offset is the raw file offset of the section's data
+	offset int64
+
+	// size is the number of bytes of section data present in the file
+	size int64
+
+	// address is the virtual address of the section's first byte once loaded
+	address uint64
+
+	// virtualSize is the size of the section once loaded
+	virtualSize int64
+
+	executable bool
+	writable   bool
+
+	// headerOffset is the raw file offset of the PE or ELF section header
+	headerOffset int64
+
+	// segmentHeader is the raw file offset of the program header of the ELF
+	// segment this section ends, and segmentOffset the segment's file offset
+	segmentHeader int64
+	segmentOffset int64
+}
+
+const imageDirectoryEntrySecurity = 4
+
+var UnknownImageFormatErr = errors.New("error: unknown executable format")
+
+// parseImage parses the layout of an executable held in memory.
+func parseImage(data []byte) (img *image, err error) {
+	if bytes.HasPrefix(data, []byte("MZ")) {
+		return parsePEImage(data)
+	}
+	if bytes.HasPrefix(data, []byte(elf.ELFMAG)) {
+		return parseELFImage(data)
+	}
+	if isMachO(data) {
+		return parseMachOImage(data)
+	}
+	if isFatMachO(data) {
+		err = UniversalBinaryErr
+		return
+	}
+
+	err = UnknownImageFormatErr
+	return
+}
+
+func parsePEImage(data []byte) (img *image, err error) {
+	peFile, err := pe.NewFile(bytes.NewReader(peHeaderView(data)))
+	if err != nil {
+		return
+	}
+
+	img = &image{data: data, pe: peFile}
+	img.x86 = peFile.Machine == pe.IMAGE_FILE_MACHINE_I386 || peFile.Machine == pe.IMAGE_FILE_MACHINE_AMD64
+
+	switch header := peFile.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		img.imageBase = uint64(header.ImageBase)
+	case *pe.OptionalHeader64:
+		img.imageBase = header.ImageBase
+		img.is64 = true
+	default:
+		err = errors.New("PE file has no optional header")
+		return
+	}
+
+	sectionTableOffset := int64(binary.LittleEndian.Uint32(data[0x3C:])) + 4 + 20 + int64(peFile.FileHeader.SizeOfOptionalHeader)
+
+	for i, s := range peFile.Sections {
+		img.sections = append(img.sections, imageSection{
+			name:        s.Name,
+			offset:      int64(s.Offset),
+			size:        int64(s.Size),
+			address:     img.imageBase + uint64(s.VirtualAddress),
+			virtualSize: int64(s.VirtualSize),
+			executable:  s.Characteristics&pe.IMAGE_SCN_MEM_EXECUTE != 0,
+			writable:    s.Characteristics&pe.IMAGE_SCN_MEM_WRITE != 0,
+
+			headerOffset: sectionTableOffset + int64(i)*40,
+		})
+	}
+
+	return
+}
+
+// ReadyToRun images built for a non-Windows OS XOR their machine field with an
+// OS-specific value, which debug/pe does not recognize.
+// https://github.com/dotnet/runtime/blob/main/src/coreclr/inc/pedecoder.h
+var readyToRunMachineOverrides = []uint16{
+	0x7B79, // Linux
+	0x4644, // Apple
+	0xADC4, // FreeBSD
+	0x1993, // NetBSD
+	0x1992, // SunOS
+}
+
+// peHeaderView returns the data to hand to debug/pe. If the machine field holds
+// an OS-specific ReadyToRun value, a copy with the plain machine is returned.
+func peHeaderView(data []byte) []byte {
+	if len(data) < 0x40 {
+		return data
+	}
+	machineOffset := int64(binary.LittleEndian.Uint32(data[0x3C:])) + 4
+	if machineOffset+2 > int64(len(data)) {
+		return data
+	}
+
+	machine := binary.LittleEndian.Uint16(data[machineOffset:])
+	for _, override := range readyToRunMachineOverrides {
+		switch machine ^ override {
+		case pe.IMAGE_FILE_MACHINE_I386, pe.IMAGE_FILE_MACHINE_AMD64, pe.IMAGE_FILE_MACHINE_ARMNT, pe.IMAGE_FILE_MACHINE_ARM64:
+			view := bytes.Clone(data)
+			binary.LittleEndian.PutUint16(view[machineOffset:], machine^override)
+			return view
+		}
+	}
+	return data
+}
+
+// dataDirectory returns the PE data directory at the given index.
+func (img *image) dataDirectory(index int) (dir pe.DataDirectory) {
+	switch header := img.pe.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		if index < int(header.NumberOfRvaAndSizes) {
+			dir = header.DataDirectory[index]
+		}
+	case *pe.OptionalHeader64:
+		if index < int(header.NumberOfRvaAndSizes) {
+			dir = header.DataDirectory[index]
+		}
+	}
+	return
+}
+
+// sectionAtOffset returns the section whose file data contains the given offset.
+func (img *image) sectionAtOffset(offset int64) (section *imageSection, ok bool) {
+	for i := range img.sections {
+		s := &img.sections[i]
+		if offset >= s.offset && offset < s.offset+s.mappedSize() {
+			return s, true
+		}
+	}
+	return
+}
+
+// offsetToAddress converts a raw file offset into a virtual address.
+func (img *image) offsetToAddress(offset int64) (address uint64, ok bool) {
+	section, ok := img.sectionAtOffset(offset)
+	if !ok {
+		return
+	}
+	address = section.address + uint64(offset-section.offset)
+	return
+}
+
+// addressToOffset converts a virtual address into a raw file offset.
+func (img *image) addressToOffset(address uint64) (offset int64, ok bool) {
+	for i := range img.sections {
+		s := &img.sections[i]
+		if address >= s.address && address < s.address+uint64(s.mappedSize()) {
+			return s.offset + int64(address-s.address), true
+		}
+	}
+	return
+}
+
+// rvaToOffset converts a relative virtual address into a raw file offset.
+func (img *image) rvaToOffset(rva uint32) (offset int64, err error) {
+	offset, ok := img.addressToOffset(img.imageBase + uint64(rva))
+	if !ok {
+		err = fmt.Errorf("RVA 0x%X is not backed by file data", rva)
+	}
+	return
+}
+
+// mappedSize returns the number of bytes of the section that are both present
+// in the file and mapped into memory.
+func (s *imageSection) mappedSize() int64 {
+	if s.virtualSize != 0 && s.virtualSize < s.size {
+		return s.virtualSize
+	}
+	return s.size
+}
+
+// setVirtualSize grows or shrinks the loaded size of a PE section, or of the
+// ELF segment a section ends.
+func (img *image) setVirtualSize(section *imageSection, virtualSize int64) (err error) {
+	if img.pe == nil && img.elf == nil {
+		err = errors.New("virtual size can only be changed for PE and ELF sections")
+		return
+	}
+
+	// The section must not overlap the next section once loaded
+	for _, other := range img.sections {
+		if other.address > section.address && section.address+uint64(virtualSize) > other.address {
+			err = fmt.Errorf("section %s cannot grow to 0x%X bytes without overlapping %s", section.name, virtualSize, other.name)
+			return
+		}
+	}
+
+	if img.elf != nil {
+		if err = img.setSegmentSize(section, virtualSize); err != nil {
+			return
+		}
+	} else {
+		var layout peLayout
+		if layout, err = img.layout(); err != nil {
+			return
+		}
+		binary.LittleEndian.PutUint32(img.data[section.headerOffset+8:], uint32(virtualSize))
+
+		// The loader rejects sections that end past SizeOfImage
+		sizeOfImageOffset := layout.optionalHeaderOffset + optionalHeaderSizeOfImage
+		sizeOfImage := alignUp(int64(section.address-img.imageBase)+virtualSize, layout.sectionAlignment)
+		if sizeOfImage > int64(binary.LittleEndian.Uint32(img.data[sizeOfImageOffset:])) {
+			binary.LittleEndian.PutUint32(img.data[sizeOfImageOffset:], uint32(sizeOfImage))
+		}
+	}
+	section.virtualSize = virtualSize
+	return
+}
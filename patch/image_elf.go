@@ -0,0 +1,202 @@
+package patch
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"slices"
+)
+
+// ELF images are described by their section headers when present, and by
+// their PT_LOAD segments otherwise. Sections keep their link-time virtual
+// addresses; position-independent images are loaded at a base of 0.
+
+// elfPageSize is the largest page size segments are aligned to on x86 and x86-64.
+const elfPageSize = 0x1000
+
+// elfMetadataSections are allocated sections holding data the loader, the
+// C++ runtime or the unwinder walks, which must not be used as code caves
+// even though they contain zero bytes.
+var elfMetadataSections = []string{
+	".eh_frame", ".eh_frame_hdr", ".gcc_except_table",
+	".init_array", ".fini_array", ".preinit_array", ".ctors", ".dtors",
+	".got", ".got.plt", ".tdata", ".interp",
+}
+
+func parseELFImage(data []byte) (img *image, err error) {
+	elfFile, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+
+	img = &image{
+		data: data,
+		elf:  elfFile,
+		is64: elfFile.Class == elf.ELFCLASS64,
+		x86:  elfFile.Machine == elf.EM_386 || elfFile.Machine == elf.EM_X86_64,
+	}
+
+	phoff, phentsize, shoff, shentsize := elfHeaderTables(elfFile, data)
+
+	for i, prog := range elfFile.Progs {
+		if prog.Type != elf.PT_LOAD {
+			continue
+		}
+		img.segments = append(img.segments, imageSection{
+			name:          fmt.Sprintf("LOAD%d", len(img.segments)),
+			offset:        int64(prog.Off),
+			size:          int64(prog.Filesz),
+			address:       prog.Vaddr,
+			virtualSize:   int64(prog.Filesz),
+			executable:    prog.Flags&elf.PF_X != 0,
+			writable:      prog.Flags&elf.PF_W != 0,
+			segmentHeader: phoff + int64(i)*phentsize,
+			segmentOffset: int64(prog.Off),
+		})
+	}
+
+	for i, s := range elfFile.Sections {
+		if s.Flags&elf.SHF_ALLOC == 0 || s.Type == elf.SHT_NOBITS || s.Size == 0 {
+			continue
+		}
+		img.sections = append(img.sections, imageSection{
+			name:         s.Name,
+			offset:       int64(s.Offset),
+			size:         int64(s.Size),
+			address:      s.Addr,
+			virtualSize:  int64(s.Size),
+			executable:   s.Flags&elf.SHF_EXECINSTR != 0,
+			writable:     s.Flags&elf.SHF_WRITE != 0,
+			headerOffset: shoff + int64(i)*shentsize,
+		})
+	}
+
+	// Images stripped of their section headers are described by their segments
+	if len(img.sections) == 0 {
+		img.sections = slices.Clone(img.segments)
+	}
+
+	img.addSegmentSlack()
+	return
+}
+
+// elfHeaderTables returns the file offsets and entry sizes of the program and
+// section header tables.
+func elfHeaderTables(elfFile *elf.File, data []byte) (phoff int64, phentsize int64, shoff int64, shentsize int64) {
+	order := elfFile.ByteOrder
+	if elfFile.Class == elf.ELFCLASS64 {
+		return int64(order.Uint64(data[32:])), int64(order.Uint16(data[54:])), int64(order.Uint64(data[40:])), int64(order.Uint16(data[58:]))
+	}
+	return int64(order.Uint32(data[28:])), int64(order.Uint16(data[42:])), int64(order.Uint32(data[32:])), int64(order.Uint16(data[46:]))
+}
+
+// addSegmentSlack gives the section ending each PT_LOAD segment the padding
+// between the end of the segment's file data and whatever follows it in the
+// file, as long as mapping it would not run into the next segment's pages.
+// Like PE section slack, it becomes usable by growing the segment.
+func (img *image) addSegmentSlack() {
+	_, _, shoff, _ := elfHeaderTables(img.elf, img.data)
+
+	for _, segment := range img.segments {
+		prog := img.segmentProg(segment)
+		if prog.Memsz != prog.Filesz {
+			// The segment is followed by zero-initialized memory
+			continue
+		}
+		segmentEnd := segment.offset + segment.size
+
+		fileLimit := int64(len(img.data))
+		if shoff >= segmentEnd {
+			fileLimit = min(fileLimit, shoff)
+		}
+		for _, s := range img.elf.Sections {
+			if s.Type != elf.SHT_NOBITS && s.Size > 0 && int64(s.Offset) >= segmentEnd {
+				fileLimit = min(fileLimit, int64(s.Offset))
+			}
+		}
+		for _, other := range img.segments {
+			if other.offset >= segmentEnd {
+				fileLimit = min(fileLimit, other.offset)
+			}
+			// The last segment in memory can grow up to the end of the file data
+			if other.address > segment.address {
+				fileLimit = min(fileLimit, segment.offset+int64(other.address&^(elfPageSize-1))-int64(segment.address))
+			}
+		}
+		if fileLimit <= segmentEnd {
+			continue
+		}
+
+		// The section whose data ends the segment takes the slack
+		last := img.lastSectionEnd(segment)
+		for i := range img.sections {
+			s := &img.sections[i]
+			if s.offset >= segment.offset && s.offset+s.size == last {
+				s.virtualSize = segmentEnd - s.offset
+				s.size = fileLimit - s.offset
+				s.segmentHeader = segment.segmentHeader
+				s.segmentOffset = segment.offset
+				break
+			}
+		}
+	}
+}
+
+// lastSectionEnd returns the file offset at which the data of the last section
+// inside the segment ends.
+func (img *image) lastSectionEnd(segment imageSection) (end int64) {
+	for _, s := range img.sections {
+		if s.offset >= segment.offset && s.offset+s.size <= segment.offset+segment.size {
+			end = max(end, s.offset+s.size)
+		}
+	}
+	return
+}
+
+// segmentProg returns the program header of a segment.
+func (img *image) segmentProg(segment imageSection) *elf.Prog {
+	for _, prog := range img.elf.Progs {
+		if prog.Type == elf.PT_LOAD && int64(prog.Off) == segment.offset && prog.Vaddr == segment.address {
+			return prog
+		}
+	}
+	return nil
+}
+
+// setSegmentSize sets the file and memory size of the segment holding a
+// section so that it maps the section's first virtualSize bytes.
+func (img *image) setSegmentSize(section *imageSection, virtualSize int64) (err error) {
+	if section.segmentHeader == 0 {
+		err = fmt.Errorf("section %s does not end a segment and cannot grow", section.name)
+		return
+	}
+
+	size := uint64(section.offset + virtualSize - section.segmentOffset)
+	order := img.elf.ByteOrder
+	header := img.data[section.segmentHeader:]
+	if img.is64 {
+		order.PutUint64(header[32:], size)
+		order.PutUint64(header[40:], size)
+	} else {
+		order.PutUint32(header[16:], uint32(size))
+		order.PutUint32(header[20:], uint32(size))
+	}
+	return
+}
+
+// overlapsELFMetadata reports whether a range of the file overlaps an ELF
+// section that is not plain code or data.
+func (img *image) overlapsELFMetadata(offset int64, size int64) bool {
+	for _, s := range img.elf.Sections {
+		if s.Flags&elf.SHF_ALLOC == 0 || s.Type == elf.SHT_NOBITS {
+			continue
+		}
+		if s.Type == elf.SHT_PROGBITS && !slices.Contains(elfMetadataSections, s.Name) {
+			continue
+		}
+		if offset < int64(s.Offset+s.Size) && offset+size > int64(s.Offset) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package patch
+
+import (
+	"bytes"
+	"debug/macho"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Mach-O images are described by their sections, named segment,section as in
+// __TEXT,__cstring, and by their segments, named as in __DATA. Addresses are
+// link-time virtual addresses. Universal ("fat") binaries hold one Mach-O
+// image per architecture, each of which is patched on its own.
+// https://github.com/apple-oss-distributions/xnu/blob/main/EXTERNAL_HEADERS/mach-o/loader.h
+// https://github.com/apple-oss-distributions/xnu/blob/main/EXTERNAL_HEADERS/mach-o/fat.h
+
+// Mach-O section types and attributes
+const (
+	machoSectionTypeMask        = 0xFF
+	machoSectionRegular         = 0x00
+	machoSectionCStringLiterals = 0x02
+	machoSectionInstructions    = 0x80000400 // S_ATTR_PURE_INSTRUCTIONS | S_ATTR_SOME_INSTRUCTIONS
+)
+
+const (
+	machoLoadCodeSignature = 0x1D // LC_CODE_SIGNATURE
+
+	machoProtWrite   = 0x2 // VM_PROT_WRITE
+	machoProtExecute = 0x4 // VM_PROT_EXECUTE
+)
+
+// machoMetadataSections are sections holding data the unwinder or the
+// Objective-C and Swift runtimes walk, which must not be used as code caves
+// even though they contain zero bytes.
+var machoMetadataSections = []string{"__unwind_info", "__eh_frame", "__gcc_except_tab"}
+
+var machoMetadataPrefixes = []string{"__objc_", "__swift"}
+
+var UniversalBinaryErr = errors.New("error: file is a universal binary, set macho_slice in the patchfile to choose the architectures to patch")
+
+// isMachO reports whether data starts with the magic of a single-architecture
+// Mach-O image of either byte order.
+func isMachO(data []byte) bool {
+	if len(data) < 4 {
+		return false
+	}
+	for _, magic := range []uint32{binary.LittleEndian.Uint32(data), binary.BigEndian.Uint32(data)} {
+		if magic == macho.Magic32 || magic == macho.Magic64 {
+			return true
+		}
+	}
+	return false
+}
+
+// isFatMachO reports whether data starts with the header of a universal
+// binary. Java class files share the magic but have an implausible
+// architecture count in place of their version numbers.
+func isFatMachO(data []byte) bool {
+	if len(data) < 8 || binary.BigEndian.Uint32(data) != macho.MagicFat {
+		return false
+	}
+	count := binary.BigEndian.Uint32(data[4:])
+	return count > 0 && count < 32
+}
+
+func parseMachOImage(data []byte) (img *image, err error) {
+	machoFile, err := macho.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+
+	img = &image{
+		data:  data,
+		macho: machoFile,
+		is64:  machoFile.Magic == macho.Magic64,
+		x86:   machoFile.Cpu == macho.Cpu386 || machoFile.Cpu == macho.CpuAmd64,
+	}
+
+	for _, load := range machoFile.Loads {
+		segment, ok := load.(*macho.Segment)
+		if !ok || segment.Filesz == 0 {
+			// __PAGEZERO has no file data
+			continue
+		}
+		img.segments = append(img.segments, imageSection{
+			name:        segment.Name,
+			offset:      int64(segment.Offset),
+			size:        int64(segment.Filesz),
+			address:     segment.Addr,
+			virtualSize: int64(segment.Filesz),
+			executable:  segment.Prot&machoProtExecute != 0,
+			writable:    segment.Prot&machoProtWrite != 0,
+		})
+	}
+
+	for _, s := range machoFile.Sections {
+		// Zero-fill sections have no file data
+		if s.Offset == 0 || s.Size == 0 {
+			continue
+		}
+		segment := machoFile.Segment(s.Seg)
+		img.sections = append(img.sections, imageSection{
+			name:        s.Seg + "," + s.Name,
+			offset:      int64(s.Offset),
+			size:        int64(s.Size),
+			address:     s.Addr,
+			virtualSize: int64(s.Size),
+			executable:  s.Flags&machoSectionInstructions != 0,
+			writable:    segment != nil && segment.Prot&machoProtWrite != 0,
+		})
+	}
+
+	return
+}
+
+// overlapsMachOMetadata reports whether a range of the file overlaps a
+// Mach-O section that is not plain code, data or C strings.
+func (img *image) overlapsMachOMetadata(offset int64, size int64) bool {
+	for _, s := range img.macho.Sections {
+		if s.Offset == 0 || s.Size == 0 {
+			continue
+		}
+		sectionType := s.Flags & machoSectionTypeMask
+		plain := sectionType == machoSectionRegular || sectionType == machoSectionCStringLiterals
+		if plain && !slices.Contains(machoMetadataSections, s.Name) && !slices.ContainsFunc(machoMetadataPrefixes, func(prefix string) bool {
+			return strings.HasPrefix(s.Name, prefix)
+		}) {
+			continue
+		}
+		if offset < int64(s.Offset)+int64(s.Size) && offset+size > int64(s.Offset) {
+			return true
+		}
+	}
+	return false
+}
+
+// machoCodeSigned reports whether a Mach-O image has an LC_CODE_SIGNATURE
+// load command.
+func machoCodeSigned(machoFile *macho.File) bool {
+	for _, load := range machoFile.Loads {
+		raw := load.Raw()
+		if len(raw) >= 4 && machoFile.ByteOrder.Uint32(raw) == machoLoadCodeSignature {
+			return true
+		}
+	}
+	return false
+}
+
+// machoArchName returns the name lipo and the compilers use for a CPU type.
+func machoArchName(cpu macho.Cpu, subCpu uint32) string {
+	const cpuSubtypeMask = 0x00FFFFFF
+	switch cpu {
+	case macho.Cpu386:
+		return "i386"
+	case macho.CpuAmd64:
+		if subCpu&cpuSubtypeMask == 8 {
+			return "x86_64h"
+		}
+		return "x86_64"
+	case macho.CpuArm:
+		return "arm"
+	case macho.CpuArm64:
+		if subCpu&cpuSubtypeMask == 2 {
+			return "arm64e"
+		}
+		return "arm64"
+	case macho.CpuPpc:
+		return "ppc"
+	case macho.CpuPpc64:
+		return "ppc64"
+	}
+	return fmt.Sprintf("cpu%d", cpu)
+}
@@ -0,0 +1,266 @@
+package patch
+
+import (
+	"errors"
+	"fmt"
+	"github.com/goccy/go-yaml"
+	"github.com/renorris/openfsd-client-patch-utility/patchfile"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// JSONConfigPatch edits a JSON settings file of the client through JSON
+// pointers, keeping the key order and formatting of the file.
+type JSONConfigPatch struct {
+	patchFile *patchfile.PatchFile
+	patch     *patchfile.JSONConfigPatch
+	report    []string
+}
+
+func NewJSONConfigPatch(patchFile *patchfile.PatchFile, patch *patchfile.JSONConfigPatch) *JSONConfigPatch {
+	return &JSONConfigPatch{patchFile: patchFile, patch: patch}
+}
+
+func (p *JSONConfigPatch) Run(_ *os.File) (err error) {
+	p.report = nil
+
+	transforms, err := newTransformRegistry(p.patchFile.Transforms)
+	if err != nil {
+		return
+	}
+
+	path := p.patch.File
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(p.patchFile.GetTargetFileDirectory(), path)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	doc, err := parseJSONDocument(data)
+	if err != nil {
+		err = fmt.Errorf("%s: %w", filepath.Base(path), err)
+		return
+	}
+
+	for _, op := range p.patch.Operations {
+		var line string
+		if line, err = p.runOperation(doc, op, transforms); err != nil {
+			err = fmt.Errorf("%s %s: %w", op.Op, op.Path, err)
+			return
+		}
+		p.report = append(p.report, line)
+	}
+
+	if err = rewriteWholeFile(file, doc.data); err != nil {
+		return
+	}
+
+	return
+}
+
+func (p *JSONConfigPatch) runOperation(doc *jsonDocument, op patchfile.JSONOperation, transforms transformRegistry) (line string, err error) {
+	tokens, err := parseJSONPointer(op.Path)
+	if err != nil {
+		return
+	}
+
+	value, err := encodeJSONStrings(transforms, op.Transform, op.Value)
+	if err != nil {
+		return
+	}
+
+	v, deepest, depth := doc.resolve(tokens)
+	skip := func(reason string) (string, error) {
+		if op.Optional {
+			return fmt.Sprintf("%s %s: %s, skipped", op.Op, op.Path, reason), nil
+		}
+		return "", errors.New(reason)
+	}
+
+	var edit textEdit
+	switch op.Op {
+	case "set":
+		if v != nil {
+			if edit, err = doc.replace(v, value); err != nil {
+				return
+			}
+			line = fmt.Sprintf("set %s: replaced", op.Path)
+			break
+		}
+		if edit, err = doc.add(deepest, tokens[depth:], value); err != nil {
+			return skip(err.Error())
+		}
+		line = fmt.Sprintf("set %s: added", op.Path)
+	case "delete":
+		if v == nil {
+			return skip("path does not exist")
+		}
+		if v == doc.root {
+			err = errors.New("cannot delete the whole document")
+			return
+		}
+		edit = doc.remove(v)
+		line = fmt.Sprintf("delete %s: deleted", op.Path)
+	case "append":
+		if v == nil {
+			return skip("path does not exist")
+		}
+		if v.kind != jsonArray {
+			err = errors.New("path is not an array")
+			return
+		}
+		var values []any
+		for _, element := range op.Values {
+			if element, err = encodeJSONStrings(transforms, op.Transform, element); err != nil {
+				return
+			}
+			values = append(values, element)
+		}
+		if len(values) == 0 {
+			return fmt.Sprintf("append %s: nothing to add", op.Path), nil
+		}
+		if edit, err = doc.addElements(v, values); err != nil {
+			return
+		}
+		line = fmt.Sprintf("append %s: added %d item(s)", op.Path, len(values))
+	case "merge":
+		if v == nil {
+			return skip("path does not exist")
+		}
+		object, ok := value.(yaml.MapSlice)
+		if !ok || v.kind != jsonObject {
+			err = errors.New("merge needs an object at the path and a mapping as value")
+			return
+		}
+		var edits []textEdit
+		var replaced, added int
+		if edits, replaced, added, err = doc.merge(v, object); err != nil {
+			return
+		}
+		line = fmt.Sprintf("merge %s: replaced %d, added %d", op.Path, replaced, added)
+		err = doc.apply(edits)
+		return
+	default:
+		err = fmt.Errorf("unknown operation %q", op.Op)
+		return
+	}
+
+	err = doc.apply([]textEdit{edit})
+	return
+}
+
+// add adds a value under missing tokens below the deepest existing value.
+// Missing intermediate members are created as objects; a missing array
+// element can only be added at the end of the array, with - or its length.
+func (doc *jsonDocument) add(deepest *jsonValue, missing []string, value any) (edit textEdit, err error) {
+	switch deepest.kind {
+	case jsonObject:
+		for i := len(missing) - 1; i > 0; i-- {
+			value = yaml.MapSlice{{Key: missing[i], Value: value}}
+		}
+		return doc.addMembers(deepest, []jsonMemberValue{{key: missing[0], value: value}})
+	case jsonArray:
+		if len(missing) != 1 || (missing[0] != "-" && missing[0] != strconv.Itoa(len(deepest.elements))) {
+			err = errors.New("path does not exist")
+			return
+		}
+		return doc.addElements(deepest, []any{value})
+	default:
+		err = errors.New("path does not exist")
+		return
+	}
+}
+
+// merge sets the members of a mapping in an object, merging nested mappings
+// into existing nested objects.
+func (doc *jsonDocument) merge(object *jsonValue, mapping yaml.MapSlice) (edits []textEdit, replaced int, added int, err error) {
+	var newMembers []jsonMemberValue
+	for _, item := range mapping {
+		key := fmt.Sprint(item.Key)
+		m := object.member(key)
+		if m == nil {
+			newMembers = append(newMembers, jsonMemberValue{key: key, value: item.Value})
+			added++
+			continue
+		}
+
+		if nested, ok := item.Value.(yaml.MapSlice); ok && m.value.kind == jsonObject {
+			var nestedEdits []textEdit
+			var nestedReplaced, nestedAdded int
+			if nestedEdits, nestedReplaced, nestedAdded, err = doc.merge(m.value, nested); err != nil {
+				return
+			}
+			edits = append(edits, nestedEdits...)
+			replaced += nestedReplaced
+			added += nestedAdded
+			continue
+		}
+
+		var edit textEdit
+		if edit, err = doc.replace(m.value, item.Value); err != nil {
+			return
+		}
+		edits = append(edits, edit)
+		replaced++
+	}
+
+	if len(newMembers) > 0 {
+		var edit textEdit
+		if edit, err = doc.addMembers(object, newMembers); err != nil {
+			return
+		}
+		edits = append(edits, edit)
+	}
+	return
+}
+
+// encodeJSONStrings encodes the strings of a value from a patchfile with the
+// named transform.
+func encodeJSONStrings(transforms transformRegistry, name string, value any) (encoded any, err error) {
+	if name == "" {
+		return value, nil
+	}
+
+	switch v := value.(type) {
+	case string:
+		return transforms.encode(name, v)
+	case yaml.MapSlice:
+		var mapping yaml.MapSlice
+		for _, item := range v {
+			if item.Value, err = encodeJSONStrings(transforms, name, item.Value); err != nil {
+				return
+			}
+			mapping = append(mapping, item)
+		}
+		return mapping, nil
+	case []any:
+		var elements []any
+		for _, element := range v {
+			if element, err = encodeJSONStrings(transforms, name, element); err != nil {
+				return
+			}
+			elements = append(elements, element)
+		}
+		return elements, nil
+	default:
+		return value, nil
+	}
+}
+
+func (p *JSONConfigPatch) Name() string {
+	return p.patch.Name
+}
+
+func (p *JSONConfigPatch) Report() []string {
+	return p.report
+}
@@ -0,0 +1,124 @@
+package patch
+
+import (
+	"testing"
+
+	"github.com/goccy/go-yaml"
+	"github.com/renorris/openfsd-client-patch-utility/patchfile"
+)
+
+func TestJSONConfigPatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		operations []patchfile.JSONOperation
+		output     string
+	}{
+		{
+			name:       "set keeps BOM, CRLF and key order",
+			input:      "\ufeff{\r\n    \"b\": 1,\r\n    \"a\": \"old\"\r\n}\r\n",
+			operations: []patchfile.JSONOperation{{Op: "set", Path: "/a", Value: "new"}},
+			output:     "\ufeff{\r\n    \"b\": 1,\r\n    \"a\": \"new\"\r\n}\r\n",
+		},
+		{
+			name:       "set adds missing members as objects",
+			input:      "{\n  \"a\": 1\n}\n",
+			operations: []patchfile.JSONOperation{{Op: "set", Path: "/network/host", Value: "fsd.example.com"}},
+			output:     "{\n  \"a\": 1,\n  \"network\": {\n    \"host\": \"fsd.example.com\"\n  }\n}\n",
+		},
+		{
+			name:       "set array element by index and past the end",
+			input:      "{\"servers\": [\"a\", \"b\"]}",
+			operations: []patchfile.JSONOperation{{Op: "set", Path: "/servers/0", Value: "c"}, {Op: "set", Path: "/servers/-", Value: "d"}},
+			output:     "{\"servers\": [\"c\", \"b\", \"d\"]}",
+		},
+		{
+			name:       "set with transform",
+			input:      "{\"password\": \"\"}",
+			operations: []patchfile.JSONOperation{{Op: "set", Path: "/password", Value: "secret", Transform: "hex"}},
+			output:     "{\"password\": \"736563726574\"}",
+		},
+		{
+			name:       "delete first, middle and last members",
+			input:      "{\n  \"a\": 1,\n  \"b\": 2,\n  \"c\": 3,\n  \"d\": 4\n}\n",
+			operations: []patchfile.JSONOperation{{Op: "delete", Path: "/a"}, {Op: "delete", Path: "/c"}, {Op: "delete", Path: "/d"}},
+			output:     "{\n  \"b\": 2\n}\n",
+		},
+		{
+			name:       "append to a multi-line array",
+			input:      "{\n\t\"servers\": [\n\t\t{\"name\": \"a\"}\n\t]\n}",
+			operations: []patchfile.JSONOperation{{Op: "append", Path: "/servers", Values: []any{yaml.MapSlice{{Key: "name", Value: "b"}, {Key: "port", Value: 6809}}}}},
+			output:     "{\n\t\"servers\": [\n\t\t{\"name\": \"a\"},\n\t\t{\n\t\t\t\"name\": \"b\",\n\t\t\t\"port\": 6809\n\t\t}\n\t]\n}",
+		},
+		{
+			name:       "append to an empty array",
+			input:      "{\n  \"servers\": []\n}\n",
+			operations: []patchfile.JSONOperation{{Op: "append", Path: "/servers", Values: []any{"a", "b"}}},
+			output:     "{\n  \"servers\": [\n    \"a\",\n    \"b\"\n  ]\n}\n",
+		},
+		{
+			name:  "merge into nested objects",
+			input: "{\n  \"network\": {\n    \"host\": \"a\",\n    \"tls\": {\"enabled\": false}\n  }\n}\n",
+			operations: []patchfile.JSONOperation{{Op: "merge", Path: "/network", Value: yaml.MapSlice{
+				{Key: "host", Value: "b"},
+				{Key: "tls", Value: yaml.MapSlice{{Key: "enabled", Value: true}, {Key: "verify", Value: true}}},
+				{Key: "port", Value: 6809},
+			}}},
+			output: "{\n  \"network\": {\n    \"host\": \"b\",\n    \"tls\": {\"enabled\": true, \"verify\": true},\n    \"port\": 6809\n  }\n}\n",
+		},
+		{
+			name:       "compact document stays compact",
+			input:      "{\"a\":{},\"b\":[]}",
+			operations: []patchfile.JSONOperation{{Op: "set", Path: "/a/x", Value: yaml.MapSlice{{Key: "y", Value: 1}}}, {Op: "append", Path: "/b", Values: []any{1, 2}}},
+			output:     "{\"a\":{\"x\":{\"y\":1}},\"b\":[1,2]}",
+		},
+		{
+			name:       "optional operation on a missing path",
+			input:      "{\"a\": 1}",
+			operations: []patchfile.JSONOperation{{Op: "delete", Path: "/b", Optional: true}},
+			output:     "{\"a\": 1}",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output, err := runConfigPatch(t, "config.json", test.input, func(patchFile *patchfile.PatchFile, file string) Patch {
+				return NewJSONConfigPatch(patchFile, &patchfile.JSONConfigPatch{File: file, Operations: test.operations})
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if output != test.output {
+				t.Errorf("got:\n%q\nwant:\n%q", output, test.output)
+			}
+		})
+	}
+}
+
+func TestJSONConfigPatchErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		operation patchfile.JSONOperation
+	}{
+		{"delete missing member", "{\"a\": 1}", patchfile.JSONOperation{Op: "delete", Path: "/b"}},
+		{"delete the whole document", "{\"a\": 1}", patchfile.JSONOperation{Op: "delete", Path: ""}},
+		{"set past the end of an array", "{\"a\": [1]}", patchfile.JSONOperation{Op: "set", Path: "/a/5", Value: 2}},
+		{"set below a scalar", "{\"a\": 1}", patchfile.JSONOperation{Op: "set", Path: "/a/b", Value: 2}},
+		{"append to an object", "{\"a\": {}}", patchfile.JSONOperation{Op: "append", Path: "/a", Values: []any{1}}},
+		{"merge a scalar", "{\"a\": {}}", patchfile.JSONOperation{Op: "merge", Path: "/a", Value: 1}},
+		{"invalid pointer", "{\"a\": 1}", patchfile.JSONOperation{Op: "set", Path: "a", Value: 1}},
+		{"invalid JSON", "{\"a\": 1", patchfile.JSONOperation{Op: "set", Path: "/a", Value: 2}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := runConfigPatch(t, "config.json", test.input, func(patchFile *patchfile.PatchFile, file string) Patch {
+				return NewJSONConfigPatch(patchFile, &patchfile.JSONConfigPatch{File: file, Operations: []patchfile.JSONOperation{test.operation}})
+			})
+			if err == nil {
+				t.Errorf("Run() succeeded, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,473 @@
+package patch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/goccy/go-yaml"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// jsonDocument is a parsed JSON file that keeps the byte ranges of its values,
+// so that edits are spliced into the original text and leave the key order
+// and formatting of everything else untouched.
+type jsonDocument struct {
+	textLayout
+	data []byte
+	root *jsonValue
+
+	// compact is set for documents written on a single line
+	compact bool
+}
+
+type jsonKind int
+
+const (
+	jsonObject jsonKind = iota
+	jsonArray
+	jsonString
+	jsonScalar
+)
+
+// jsonValue is a value of a jsonDocument. start and end delimit its text.
+type jsonValue struct {
+	kind     jsonKind
+	start    int
+	end      int
+	members  []*jsonMember
+	elements []*jsonValue
+}
+
+// jsonMember is a member of a JSON object. start and keyEnd delimit its key.
+type jsonMember struct {
+	key    string
+	start  int
+	keyEnd int
+	value  *jsonValue
+}
+
+func parseJSONDocument(data []byte) (doc *jsonDocument, err error) {
+	doc = &jsonDocument{textLayout: detectTextLayout(data), data: data}
+	base := doc.contentStart()
+	if !json.Valid(data[base:]) {
+		err = errors.New("invalid JSON")
+		return
+	}
+
+	parser := jsonParser{data: data, pos: base}
+	doc.root = parser.value()
+	doc.compact = !bytes.Contains(data[doc.root.start:doc.root.end], []byte("\n"))
+	return
+}
+
+// jsonParser records the spans of a document already known to be valid JSON.
+type jsonParser struct {
+	data []byte
+	pos  int
+}
+
+func (p *jsonParser) skipSpace() {
+	for p.pos < len(p.data) && strings.IndexByte(" \t\r\n", p.data[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+func (p *jsonParser) value() (v *jsonValue) {
+	p.skipSpace()
+	v = &jsonValue{start: p.pos}
+
+	switch p.data[p.pos] {
+	case '{':
+		v.kind = jsonObject
+		p.pos++
+		for {
+			p.skipSpace()
+			if p.data[p.pos] == '}' {
+				p.pos++
+				break
+			}
+			if p.data[p.pos] == ',' {
+				p.pos++
+				continue
+			}
+
+			m := &jsonMember{start: p.pos, keyEnd: p.stringEnd()}
+			_ = json.Unmarshal(p.data[m.start:m.keyEnd], &m.key)
+			p.pos = m.keyEnd
+			p.skipSpace()
+			p.pos++ // :
+			m.value = p.value()
+			v.members = append(v.members, m)
+		}
+	case '[':
+		v.kind = jsonArray
+		p.pos++
+		for {
+			p.skipSpace()
+			if p.data[p.pos] == ']' {
+				p.pos++
+				break
+			}
+			if p.data[p.pos] == ',' {
+				p.pos++
+				continue
+			}
+			v.elements = append(v.elements, p.value())
+		}
+	case '"':
+		v.kind = jsonString
+		p.pos = p.stringEnd()
+	default:
+		v.kind = jsonScalar
+		for p.pos < len(p.data) && strings.IndexByte(",]} \t\r\n", p.data[p.pos]) < 0 {
+			p.pos++
+		}
+	}
+
+	v.end = p.pos
+	return
+}
+
+// stringEnd returns the end of the string starting at the current position.
+func (p *jsonParser) stringEnd() int {
+	for i := p.pos + 1; i < len(p.data); i++ {
+		switch p.data[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return len(p.data)
+}
+
+// parseJSONPointer splits a JSON pointer such as /servers/0/host into its
+// reference tokens. The empty pointer refers to the whole document.
+func parseJSONPointer(pointer string) (tokens []string, err error) {
+	if pointer == "" {
+		return
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		err = fmt.Errorf("JSON path %s must start with /", pointer)
+		return
+	}
+	for _, token := range strings.Split(pointer[1:], "/") {
+		tokens = append(tokens, strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~"))
+	}
+	return
+}
+
+// child returns the member value or array element named by a token.
+func (v *jsonValue) child(token string) *jsonValue {
+	switch v.kind {
+	case jsonObject:
+		if m := v.member(token); m != nil {
+			return m.value
+		}
+	case jsonArray:
+		if i, err := strconv.Atoi(token); err == nil && i >= 0 && i < len(v.elements) && strconv.Itoa(i) == token {
+			return v.elements[i]
+		}
+	}
+	return nil
+}
+
+func (v *jsonValue) member(key string) *jsonMember {
+	for _, m := range v.members {
+		if m.key == key {
+			return m
+		}
+	}
+	return nil
+}
+
+// resolve follows tokens as far as they lead. It returns the value they refer
+// to, or nil along with the deepest value found and the number of tokens
+// leading to it.
+func (doc *jsonDocument) resolve(tokens []string) (v *jsonValue, deepest *jsonValue, depth int) {
+	deepest = doc.root
+	for depth < len(tokens) {
+		next := deepest.child(tokens[depth])
+		if next == nil {
+			return
+		}
+		deepest = next
+		depth++
+	}
+	return deepest, deepest, depth
+}
+
+// parent returns the object or array holding a value.
+func (doc *jsonDocument) parent(child *jsonValue) (parent *jsonValue) {
+	var find func(v *jsonValue) *jsonValue
+	find = func(v *jsonValue) *jsonValue {
+		for _, c := range v.children() {
+			if c == child {
+				return v
+			}
+			if found := find(c); found != nil {
+				return found
+			}
+		}
+		return nil
+	}
+	return find(doc.root)
+}
+
+func (v *jsonValue) children() (children []*jsonValue) {
+	for _, m := range v.members {
+		children = append(children, m.value)
+	}
+	return append(children, v.elements...)
+}
+
+// itemSpan returns the text of the i-th member or element of a container.
+func (v *jsonValue) itemSpan(i int) (start int, end int) {
+	if v.kind == jsonObject {
+		return v.members[i].start, v.members[i].value.end
+	}
+	return v.elements[i].start, v.elements[i].end
+}
+
+func (v *jsonValue) itemCount() int {
+	return len(v.members) + len(v.elements)
+}
+
+// apply splices edits into the document and parses it again. Edits must not overlap.
+func (doc *jsonDocument) apply(edits []textEdit) (err error) {
+	ok, err := reparseEdits(doc, doc.data, edits, parseJSONDocument)
+	if err == nil && !ok {
+		err = errors.New("JSON edits overlap")
+	}
+	return
+}
+
+// replace replaces a value.
+func (doc *jsonDocument) replace(v *jsonValue, value any) (edit textEdit, err error) {
+	parent := doc.parent(v)
+	inline := parent != nil && doc.inline(parent)
+	rendered, err := doc.render(value, doc.lineIndent(v.start), inline)
+	if err != nil {
+		return
+	}
+	return textEdit{start: v.start, end: v.end, replacement: rendered}, nil
+}
+
+// remove deletes a member or element along with its separator.
+func (doc *jsonDocument) remove(v *jsonValue) textEdit {
+	parent := doc.parent(v)
+	count := parent.itemCount()
+	if count == 1 {
+		return textEdit{start: parent.start + 1, end: parent.end - 1}
+	}
+
+	i := slices.Index(parent.children(), v)
+	start, end := parent.itemSpan(i)
+	if i < count-1 {
+		end, _ = parent.itemSpan(i + 1)
+	} else {
+		_, start = parent.itemSpan(i - 1)
+	}
+	return textEdit{start: start, end: end}
+}
+
+// jsonMemberValue is a member added to an object.
+type jsonMemberValue struct {
+	key   string
+	value any
+}
+
+// addMembers adds members at the end of an object.
+func (doc *jsonDocument) addMembers(object *jsonValue, members []jsonMemberValue) (edit textEdit, err error) {
+	return doc.addItems(object, len(members), func(i int, indent string, inline bool) (item string, err error) {
+		var rendered string
+		if rendered, err = doc.render(members[i].value, indent, inline); err != nil {
+			return
+		}
+		return doc.renderKey(members[i].key) + doc.keySeparator() + rendered, nil
+	})
+}
+
+// addElements adds elements at the end of an array.
+func (doc *jsonDocument) addElements(array *jsonValue, values []any) (edit textEdit, err error) {
+	return doc.addItems(array, len(values), func(i int, indent string, inline bool) (string, error) {
+		return doc.render(values[i], indent, inline)
+	})
+}
+
+// addItems adds items at the end of a container, laid out like its existing
+// items, or on lines of their own one level deeper than the container.
+func (doc *jsonDocument) addItems(container *jsonValue, count int, render func(i int, indent string, inline bool) (string, error)) (edit textEdit, err error) {
+	existing := container.itemCount()
+	inline := doc.inline(container)
+
+	var indent, separator string
+	switch {
+	case existing >= 2:
+		_, end := container.itemSpan(0)
+		start, _ := container.itemSpan(1)
+		separator = string(doc.data[end:start])
+		indent = doc.lineIndent(start)
+	case existing == 1:
+		start, _ := container.itemSpan(0)
+		indent = doc.lineIndent(start)
+		if bytes.Contains(doc.data[container.start:start], []byte("\n")) {
+			separator = "," + doc.newline + indent
+		} else if doc.compact {
+			separator = ","
+		} else {
+			separator = ", "
+		}
+	case doc.compact:
+		separator = ","
+	default:
+		indent = doc.lineIndent(container.start) + doc.indentUnit()
+		separator = "," + doc.newline + indent
+	}
+
+	var items []string
+	for i := range count {
+		var item string
+		if item, err = render(i, indent, inline); err != nil {
+			return
+		}
+		items = append(items, item)
+	}
+	joined := strings.Join(items, separator)
+
+	if existing > 0 {
+		_, end := container.itemSpan(existing - 1)
+		return textEdit{start: end, end: end, replacement: separator + joined}, nil
+	}
+	if doc.compact {
+		return textEdit{start: container.start + 1, end: container.end - 1, replacement: joined}, nil
+	}
+	closing := doc.newline + doc.lineIndent(container.start)
+	return textEdit{start: container.start + 1, end: container.end - 1, replacement: doc.newline + indent + joined + closing}, nil
+}
+
+// inline reports whether the items of a container are written on a single
+// line. Empty containers are laid out on lines of their own unless the whole
+// document is on a single line.
+func (doc *jsonDocument) inline(container *jsonValue) bool {
+	if doc.compact {
+		return true
+	}
+	return container.itemCount() > 0 && !bytes.Contains(doc.data[container.start:container.end], []byte("\n"))
+}
+
+// lineIndent returns the whitespace at the start of the line holding pos.
+func (doc *jsonDocument) lineIndent(pos int) string {
+	lineStart := bytes.LastIndexByte(doc.data[:pos], '\n') + 1
+	line := doc.data[lineStart:pos]
+	return string(line[:len(line)-len(bytes.TrimLeft(line, " \t"))])
+}
+
+// indentUnit returns the indentation added per nesting level, two spaces if
+// the document has no nested lines.
+func (doc *jsonDocument) indentUnit() string {
+	var find func(v *jsonValue) string
+	find = func(v *jsonValue) string {
+		outer := doc.lineIndent(v.start)
+		for i := range v.itemCount() {
+			start, _ := v.itemSpan(i)
+			if inner := doc.lineIndent(start); len(inner) > len(outer) && strings.HasPrefix(inner, outer) {
+				return inner[len(outer):]
+			}
+		}
+		for _, c := range v.children() {
+			if unit := find(c); unit != "" {
+				return unit
+			}
+		}
+		return ""
+	}
+	if unit := find(doc.root); unit != "" {
+		return unit
+	}
+	return "  "
+}
+
+// keySeparator returns the text between keys and values used by the document.
+func (doc *jsonDocument) keySeparator() string {
+	var find func(v *jsonValue) string
+	find = func(v *jsonValue) string {
+		for _, m := range v.members {
+			return string(doc.data[m.keyEnd:m.value.start])
+		}
+		for _, c := range v.children() {
+			if separator := find(c); separator != "" {
+				return separator
+			}
+		}
+		return ""
+	}
+	if separator := find(doc.root); separator != "" {
+		return separator
+	}
+	if doc.compact {
+		return ":"
+	}
+	return ": "
+}
+
+func (doc *jsonDocument) renderKey(key string) string {
+	rendered, _ := marshalJSONScalar(key)
+	return rendered
+}
+
+// render renders a value from a patchfile as JSON, laid out like the document
+// at the indentation of the line it is written on, or on a single line if
+// inline is set. Objects keep their key order.
+func (doc *jsonDocument) render(value any, indent string, inline bool) (rendered string, err error) {
+	var items []string
+	open, close := "[", "]"
+	inner := indent + doc.indentUnit()
+
+	switch v := value.(type) {
+	case yaml.MapSlice:
+		open, close = "{", "}"
+		for _, item := range v {
+			var r string
+			if r, err = doc.render(item.Value, inner, inline); err != nil {
+				return
+			}
+			items = append(items, doc.renderKey(fmt.Sprint(item.Key))+doc.keySeparator()+r)
+		}
+	case []any:
+		for _, element := range v {
+			var r string
+			if r, err = doc.render(element, inner, inline); err != nil {
+				return
+			}
+			items = append(items, r)
+		}
+	default:
+		return marshalJSONScalar(v)
+	}
+
+	if len(items) == 0 {
+		return open + close, nil
+	}
+	if doc.compact {
+		return open + strings.Join(items, ",") + close, nil
+	}
+	if inline {
+		return open + strings.Join(items, ", ") + close, nil
+	}
+	separator := "," + doc.newline + inner
+	return open + doc.newline + inner + strings.Join(items, separator) + doc.newline + indent + close, nil
+}
+
+func marshalJSONScalar(value any) (rendered string, err error) {
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	if err = encoder.Encode(value); err != nil {
+		return
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
@@ -0,0 +1,225 @@
+package patch
+
+import (
+	"bytes"
+	"cmp"
+	"debug/macho"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/renorris/openfsd-client-patch-utility/patchfile"
+	"os"
+	"slices"
+	"strings"
+)
+
+var NotMachOErr = errors.New("error: file is not a Mach-O binary")
+
+// machoSlice is the image of one architecture in a Mach-O file. A file that
+// is not universal is a single slice spanning the whole file.
+type machoSlice struct {
+	arch   string
+	offset int64
+	size   int64
+
+	// align is the power of two the slice's offset is aligned to
+	align uint32
+
+	// headerOffset is the raw file offset of the slice's fat_arch entry
+	headerOffset int64
+}
+
+// parseMachOSlices returns the slices of a thin or universal Mach-O file.
+func parseMachOSlices(data []byte) (machoSlices []machoSlice, err error) {
+	if isMachO(data) {
+		var machoFile *macho.File
+		if machoFile, err = macho.NewFile(bytes.NewReader(data)); err != nil {
+			return
+		}
+		machoSlices = append(machoSlices, machoSlice{
+			arch: machoArchName(machoFile.Cpu, machoFile.SubCpu),
+			size: int64(len(data)),
+		})
+		return
+	}
+	if !isFatMachO(data) {
+		err = NotMachOErr
+		return
+	}
+
+	count := int(binary.BigEndian.Uint32(data[4:]))
+	if 8+count*20 > len(data) {
+		err = errors.New("universal binary header is truncated")
+		return
+	}
+	for i := range count {
+		header := data[8+i*20:]
+		s := machoSlice{
+			arch:         machoArchName(macho.Cpu(binary.BigEndian.Uint32(header)), binary.BigEndian.Uint32(header[4:])),
+			offset:       int64(binary.BigEndian.Uint32(header[8:])),
+			size:         int64(binary.BigEndian.Uint32(header[12:])),
+			align:        binary.BigEndian.Uint32(header[16:]),
+			headerOffset: int64(8 + i*20),
+		}
+		if s.offset+s.size > int64(len(data)) || s.align > 31 {
+			err = fmt.Errorf("universal binary slice %s is out of range", s.arch)
+			return
+		}
+		machoSlices = append(machoSlices, s)
+	}
+	return
+}
+
+// replaceMachOSlices returns the file with the content of its slices replaced.
+// Slices keep their offsets unless one of them changed size, in which case
+// they are laid out again in file order at their required alignment.
+func replaceMachOSlices(data []byte, machoSlices []machoSlice, contents [][]byte) (newData []byte) {
+	if len(machoSlices) == 1 && machoSlices[0].offset == 0 {
+		return contents[0]
+	}
+
+	resized := false
+	for i, s := range machoSlices {
+		resized = resized || int64(len(contents[i])) != s.size
+	}
+	if !resized {
+		newData = bytes.Clone(data)
+		for i, s := range machoSlices {
+			copy(newData[s.offset:], contents[i])
+		}
+		return
+	}
+
+	order := make([]int, len(machoSlices))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a, b int) int { return cmp.Compare(machoSlices[a].offset, machoSlices[b].offset) })
+
+	newData = bytes.Clone(data[:machoSlices[order[0]].offset])
+	for _, i := range order {
+		s := machoSlices[i]
+		offset := alignUp(int64(len(newData)), int64(1)<<s.align)
+		newData = append(newData, make([]byte, offset-int64(len(newData)))...)
+		newData = append(newData, contents[i]...)
+
+		binary.BigEndian.PutUint32(newData[s.headerOffset+8:], uint32(offset))
+		binary.BigEndian.PutUint32(newData[s.headerOffset+12:], uint32(len(contents[i])))
+	}
+	return
+}
+
+// MachOSliceInfo describes one architecture of a Mach-O file.
+type MachOSliceInfo struct {
+	Architecture string
+	Offset       int64
+	Size         int64
+	CodeSigned   bool
+}
+
+// ListMachOSlices lists the architectures of a thin or universal Mach-O file.
+func ListMachOSlices(file *os.File) (infos []MachOSliceInfo, err error) {
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	machoSlices, err := parseMachOSlices(data)
+	if err != nil {
+		return
+	}
+
+	for _, s := range machoSlices {
+		var machoFile *macho.File
+		if machoFile, err = macho.NewFile(bytes.NewReader(data[s.offset : s.offset+s.size])); err != nil {
+			err = fmt.Errorf("slice %s: %w", s.arch, err)
+			return
+		}
+		infos = append(infos, MachOSliceInfo{
+			Architecture: s.arch,
+			Offset:       s.offset,
+			Size:         s.size,
+			CodeSigned:   machoCodeSigned(machoFile),
+		})
+	}
+	return
+}
+
+// MachOSlicePatch runs patches against the slices of a Mach-O file for one
+// architecture, or for all of them. Each slice is patched as a file of its
+// own, so sections declared by name and code caves are resolved per slice.
+type MachOSlicePatch struct {
+	patchFile *patchfile.PatchFile
+
+	// slice is an architecture name such as x86_64 or arm64, or "all"
+	slice   string
+	patches []Patch
+	caves   *CaveAllocator
+	report  []string
+}
+
+func NewMachOSlicePatch(patchFile *patchfile.PatchFile, slice string, patches []Patch, caves *CaveAllocator) *MachOSlicePatch {
+	return &MachOSlicePatch{patchFile: patchFile, slice: slice, patches: patches, caves: caves}
+}
+
+func (p *MachOSlicePatch) Run(file *os.File) (err error) {
+	p.report = nil
+
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	machoSlices, err := parseMachOSlices(data)
+	if err != nil {
+		return
+	}
+
+	// Sections located by name are resolved again for every slice
+	sections := slices.Clone(p.patchFile.Sections)
+	defer func() { p.patchFile.Sections = sections }()
+
+	var archs []string
+	contents := make([][]byte, len(machoSlices))
+	for i, s := range machoSlices {
+		archs = append(archs, s.arch)
+		contents[i] = data[s.offset : s.offset+s.size]
+		if p.slice != "all" && p.slice != s.arch {
+			continue
+		}
+
+		p.patchFile.Sections = slices.Clone(sections)
+		p.caves.reset()
+
+		var report []string
+		if contents[i], report, err = patchNestedFile(s.arch, contents[i], p.patches); err != nil {
+			err = fmt.Errorf("slice %s: %w", s.arch, err)
+			return
+		}
+		p.report = append(p.report, s.arch+":")
+		for _, line := range report {
+			p.report = append(p.report, "    "+line)
+		}
+	}
+	if len(p.report) == 0 {
+		err = fmt.Errorf("file has no %s slice (architectures: %s)", p.slice, strings.Join(archs, ", "))
+		return
+	}
+
+	if err = rewriteWholeFile(file, replaceMachOSlices(data, machoSlices, contents)); err != nil {
+		return
+	}
+
+	return
+}
+
+func (p *MachOSlicePatch) Name() string {
+	if p.slice == "all" {
+		return "Patch all Mach-O slices"
+	}
+	return fmt.Sprintf("Patch %s Mach-O slice", p.slice)
+}
+
+func (p *MachOSlicePatch) Report() []string {
+	return p.report
+}
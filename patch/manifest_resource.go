@@ -0,0 +1,298 @@
+package patch
+
+import (
+	"bytes"
+	"cmp"
+	"compress/flate"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+// Manifest resources embedded in an assembly are stored back to back in the
+// CLI header's resources directory, each prefixed with its 4-byte length. The
+// ManifestResource table maps resource names to offsets in that directory.
+// Costura and similar tools embed dependency assemblies this way, usually
+// deflate compressed, and load them from memory at run time.
+
+// Columns of the ManifestResource table
+const (
+	manifestResourceOffset         = 0
+	manifestResourceName           = 2
+	manifestResourceImplementation = 3
+)
+
+const cliHeaderResources = 24
+
+// manifestResourceSection is the name of the section resources are moved to
+// when a patched resource no longer fits in place.
+const manifestResourceSection = ".mres"
+
+// manifestResource is a resource embedded in the assembly.
+type manifestResource struct {
+	row  uint32
+	name string
+
+	// offset is the resource's offset from the start of the resources directory
+	offset uint32
+
+	// dataOffset is the raw file offset of the resource data following the length prefix
+	dataOffset int64
+	size       int64
+}
+
+// manifestResources lists the resources embedded in the assembly. Resources
+// linked from other files are skipped.
+func (img *image) manifestResources(header *cliHeader, tables *metadataTables) (resources []manifestResource, err error) {
+	dir := header.resources
+	if dir.VirtualAddress == 0 {
+		return
+	}
+
+	dirOffset, err := img.rvaToOffset(dir.VirtualAddress)
+	if err != nil {
+		return
+	}
+
+	for row := uint32(1); row <= tables.rows[tableManifestResource]; row++ {
+		if tables.cell(tableManifestResource, row, manifestResourceImplementation) != 0 {
+			continue
+		}
+
+		r := manifestResource{row: row, offset: tables.cell(tableManifestResource, row, manifestResourceOffset)}
+		if r.name, err = img.heapString(header, tables.cell(tableManifestResource, row, manifestResourceName)); err != nil {
+			return
+		}
+
+		if int64(r.offset)+4 > int64(dir.Size) {
+			err = fmt.Errorf("manifest resource %s is outside the resources directory", r.name)
+			return
+		}
+		r.size = int64(binary.LittleEndian.Uint32(img.data[dirOffset+int64(r.offset):]))
+		r.dataOffset = dirOffset + int64(r.offset) + 4
+		if int64(r.offset)+4+r.size > int64(dir.Size) {
+			err = fmt.Errorf("manifest resource %s exceeds the resources directory", r.name)
+			return
+		}
+
+		resources = append(resources, r)
+	}
+
+	return
+}
+
+// findManifestResource returns the embedded resource with the given name.
+func findManifestResource(resources []manifestResource, name string) (r manifestResource, err error) {
+	i := slices.IndexFunc(resources, func(r manifestResource) bool { return r.name == name })
+	if i < 0 {
+		err = fmt.Errorf("assembly has no embedded resource %s", name)
+		return
+	}
+	r = resources[i]
+	return
+}
+
+// manifestResourceContent returns the assembly held by an embedded resource,
+// which is either stored as is or deflate compressed.
+func manifestResourceContent(data []byte, r manifestResource) (content []byte, compressed bool, err error) {
+	content = data[r.dataOffset : r.dataOffset+r.size]
+	if compressed = !bytes.HasPrefix(content, []byte("MZ")); compressed {
+		if content, err = io.ReadAll(flate.NewReader(bytes.NewReader(content))); err != nil {
+			err = fmt.Errorf("resource %s is neither an assembly nor deflate compressed: %w", r.name, err)
+			return
+		}
+	}
+	return
+}
+
+// manifestResourceData returns the assembly held by the named embedded resource of an assembly.
+func manifestResourceData(data []byte, name string) (content []byte, err error) {
+	img, err := parsePEImage(data)
+	if err != nil {
+		return
+	}
+
+	header, err := img.cliHeader()
+	if err != nil {
+		return
+	}
+
+	tables, err := img.metadataTables(header)
+	if err != nil {
+		return
+	}
+
+	resources, err := img.manifestResources(header, tables)
+	if err != nil {
+		return
+	}
+
+	r, err := findManifestResource(resources, name)
+	if err != nil {
+		return
+	}
+
+	content, _, err = manifestResourceContent(data, r)
+	return
+}
+
+// replaceManifestResource replaces the data of an embedded resource. The data
+// is rewritten in place if it fits, otherwise all resources are relocated.
+func (img *image) replaceManifestResource(header *cliHeader, tables *metadataTables, resources []manifestResource, r manifestResource, content []byte) (newData []byte, report string, err error) {
+	if int64(len(content)) <= r.size {
+		newData = img.data
+		binary.LittleEndian.PutUint32(newData[r.dataOffset-4:], uint32(len(content)))
+		copy(newData[r.dataOffset:], content)
+		clear(newData[r.dataOffset+int64(len(content)) : r.dataOffset+r.size])
+		report = fmt.Sprintf("rewrote resource %s in place (%d -> %d bytes)", r.name, r.size, len(content))
+		return
+	}
+
+	var name string
+	if newData, name, err = img.relocateManifestResources(header, tables, resources, r.row, content); err != nil {
+		return
+	}
+	report = fmt.Sprintf("resource %s grew from %d to %d bytes, moved resources to section %s", r.name, r.size, len(content), name)
+	return
+}
+
+// relocateManifestResources copies all embedded resources into a new section,
+// replacing the data of one of them, and points the CLI header and the
+// ManifestResource table at the copies.
+func (img *image) relocateManifestResources(header *cliHeader, tables *metadataTables, resources []manifestResource, replaced uint32, content []byte) (newData []byte, name string, err error) {
+	slices.SortFunc(resources, func(a, b manifestResource) int {
+		return cmp.Compare(a.offset, b.offset)
+	})
+
+	var blob []byte
+	offsets := make(map[uint32]uint32)
+	for _, r := range resources {
+		data := img.data[r.dataOffset : r.dataOffset+r.size]
+		if r.row == replaced {
+			data = content
+		}
+
+		// Resources are 8-byte aligned
+		blob = append(blob, make([]byte, alignUp(int64(len(blob)), 8)-int64(len(blob)))...)
+		offsets[r.row] = uint32(len(blob))
+		blob = binary.LittleEndian.AppendUint32(blob, uint32(len(data)))
+		blob = append(blob, data...)
+	}
+
+	// Resources that were relocated before are moved again to a fresh section
+	name = img.unusedSectionName(manifestResourceSection)
+
+	newData, section, _, err := appendPESection(img.data, name, int64(len(blob)), pe.IMAGE_SCN_CNT_INITIALIZED_DATA|pe.IMAGE_SCN_MEM_READ)
+	if err != nil {
+		return
+	}
+	copy(newData[section.offset:], blob)
+
+	// Adding the section may have moved the metadata in the file
+	if img, err = parsePEImage(newData); err != nil {
+		return
+	}
+	if header, err = img.cliHeader(); err != nil {
+		return
+	}
+	if tables, err = img.metadataTables(header); err != nil {
+		return
+	}
+
+	for row, offset := range offsets {
+		if err = tables.setCell(newData, tableManifestResource, row, manifestResourceOffset, offset); err != nil {
+			return
+		}
+	}
+
+	binary.LittleEndian.PutUint32(newData[header.offset+cliHeaderResources:], uint32(section.address-img.imageBase))
+	binary.LittleEndian.PutUint32(newData[header.offset+cliHeaderResources+4:], uint32(len(blob)))
+	return
+}
+
+// ManifestResourcePatch applies patches to an assembly embedded as a manifest
+// resource of the target assembly, Costura style. Deflate compressed resources
+// are decompressed for patching and compressed again afterwards.
+type ManifestResourcePatch struct {
+	resource string
+	patches  []Patch
+	report   []string
+}
+
+func NewManifestResourcePatch(resource string, patches []Patch) *ManifestResourcePatch {
+	return &ManifestResourcePatch{resource: resource, patches: patches}
+}
+
+func (p *ManifestResourcePatch) Run(file *os.File) (err error) {
+	p.report = nil
+
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	img, err := parsePEImage(data)
+	if err != nil {
+		return
+	}
+
+	header, err := img.cliHeader()
+	if err != nil {
+		return
+	}
+
+	tables, err := img.metadataTables(header)
+	if err != nil {
+		return
+	}
+
+	resources, err := img.manifestResources(header, tables)
+	if err != nil {
+		return
+	}
+
+	r, err := findManifestResource(resources, p.resource)
+	if err != nil {
+		return
+	}
+
+	content, compressed, err := manifestResourceContent(data, r)
+	if err != nil {
+		return
+	}
+
+	patched, report, err := patchNestedFile(r.name, content, p.patches)
+	if err != nil {
+		return
+	}
+	p.report = append(p.report, report...)
+
+	if compressed {
+		if patched, err = deflate(patched); err != nil {
+			return
+		}
+	}
+
+	var line string
+	if data, line, err = img.replaceManifestResource(header, tables, resources, r, patched); err != nil {
+		return
+	}
+	p.report = append(p.report, line)
+
+	if err = rewriteWholeFile(file, data); err != nil {
+		return
+	}
+
+	return
+}
+
+func (p *ManifestResourcePatch) Name() string {
+	return fmt.Sprintf("Patch embedded resource %s", p.resource)
+}
+
+func (p *ManifestResourcePatch) Report() []string {
+	return p.report
+}
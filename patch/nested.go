@@ -0,0 +1,40 @@
+package patch
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// patchNestedFile applies patches to a file embedded in the target file, such
+// as an assembly inside a bundle or a manifest resource. The content is
+// written to a temporary file for the patches to run against, and the patched
+// content is returned along with the report lines of the nested patches.
+func patchNestedFile(name string, content []byte, patches []Patch) (patched []byte, report []string, err error) {
+	nested, err := os.CreateTemp("", "openfsd-nested-*-"+filepath.Base(name))
+	if err != nil {
+		return
+	}
+	defer os.Remove(nested.Name())
+	defer nested.Close()
+
+	if _, err = nested.Write(content); err != nil {
+		return
+	}
+
+	for _, p := range patches {
+		if err = p.Run(nested); err != nil {
+			err = fmt.Errorf("%s: %w", p.Name(), err)
+			return
+		}
+		report = append(report, p.Name()+": done")
+		if reporter, ok := p.(Reporter); ok {
+			for _, line := range reporter.Report() {
+				report = append(report, "    "+line)
+			}
+		}
+	}
+
+	patched, err = readWholeFile(nested)
+	return
+}
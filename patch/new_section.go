@@ -0,0 +1,78 @@
+package patch
+
+import (
+	"debug/pe"
+	"fmt"
+	"github.com/renorris/openfsd-client-patch-utility/patchfile"
+	"os"
+)
+
+// NewSectionPatch appends a zero-filled section to a PE file for patch
+// payloads, then registers it as a section so that later patches can place
+// data in it and refer to it.
+type NewSectionPatch struct {
+	patchFile *patchfile.PatchFile
+	patch     *patchfile.NewSection
+	caves     *CaveAllocator
+	report    []string
+}
+
+func NewNewSectionPatch(patchFile *patchfile.PatchFile, patch *patchfile.NewSection, caves *CaveAllocator) *NewSectionPatch {
+	return &NewSectionPatch{patchFile: patchFile, patch: patch, caves: caves}
+}
+
+func (p *NewSectionPatch) Run(file *os.File) (err error) {
+	p.report = nil
+
+	if _, sectionErr := p.patchFile.GetSection(p.patch.Name); sectionErr == nil {
+		err = fmt.Errorf("a section named %s already exists", p.patch.Name)
+		return
+	}
+
+	characteristics := uint32(pe.IMAGE_SCN_CNT_INITIALIZED_DATA | pe.IMAGE_SCN_MEM_READ)
+	if p.patch.Executable {
+		characteristics |= pe.IMAGE_SCN_CNT_CODE | pe.IMAGE_SCN_MEM_EXECUTE
+	}
+	if p.patch.Writable {
+		characteristics |= pe.IMAGE_SCN_MEM_WRITE
+	}
+
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	newData, section, shift, err := appendPESection(data, p.patch.Name, p.patch.Size, characteristics)
+	if err != nil {
+		return
+	}
+
+	// Growing the headers moved the raw data of every section
+	if shift != 0 {
+		shiftSections(p.patchFile, shift)
+		p.report = append(p.report, fmt.Sprintf("grew the PE headers, moving section data by 0x%X bytes", shift))
+	}
+
+	if _, err = file.WriteAt(newData, 0); err != nil {
+		return
+	}
+
+	p.patchFile.AddSection(patchfile.Section{
+		Name:         p.patch.Name,
+		RawOffset:    section.offset,
+		VirtualStart: 0,
+		ImageAddress: int64(section.address),
+	})
+	p.caves.addInjectedSection(p.patch.Name)
+
+	p.report = append(p.report, fmt.Sprintf("added section at 0x%X (0x%X bytes at file offset 0x%X)", section.address, section.virtualSize, section.offset))
+	return
+}
+
+func (p *NewSectionPatch) Name() string {
+	return fmt.Sprintf("Add section %s", p.patch.Name)
+}
+
+func (p *NewSectionPatch) Report() []string {
+	return p.report
+}
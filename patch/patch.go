@@ -8,3 +8,20 @@ type Patch interface {
 	// Run performs the patch on a given file.
 	Run(file *os.File) (err error)
 }
+
+// Reporter is implemented by patches that decide at run time how to apply
+// themselves. Report returns one line per decision made during the last Run.
+type Reporter interface {
+	Report() []string
+}
+
+// RevertablePatch is implemented by patches that undo their own changes to a
+// file, leaving other changes made since intact, rather than having the file
+// restored from its backup. Revert returns the files it reverted.
+type RevertablePatch interface {
+	Revert() (files []string, err error)
+}
+
+// JournalSuffix names the journal in which a RevertablePatch records its
+// changes to a file, kept next to the file.
+const JournalSuffix = ".openfsd-journal"
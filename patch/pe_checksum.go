@@ -0,0 +1,113 @@
+package patch
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// Offset of the CheckSum field in the optional header, shared by PE32 and PE32+
+const optionalHeaderCheckSum = 64
+
+// peChecksum computes the PE image checksum the same way as the Windows
+// CheckSumMappedFile function: a 16-bit one's complement style sum of the file,
+// skipping the stored checksum field, plus the length of the file.
+func peChecksum(data []byte, checksumOffset int64) uint32 {
+	var sum uint64
+	for i := int64(0); i < int64(len(data)); i += 2 {
+		if i == checksumOffset || i == checksumOffset+2 {
+			continue
+		}
+		word := uint64(data[i])
+		if i+1 < int64(len(data)) {
+			word |= uint64(data[i+1]) << 8
+		}
+		sum += word
+		sum = (sum & 0xFFFF) + (sum >> 16)
+	}
+	sum = (sum & 0xFFFF) + (sum >> 16)
+	return uint32(sum) + uint32(len(data))
+}
+
+// checksumOffset returns the raw file offset of the optional header CheckSum field.
+func (img *image) checksumOffset() (offset int64, err error) {
+	layout, err := img.layout()
+	if err != nil {
+		return
+	}
+	offset = layout.optionalHeaderOffset + optionalHeaderCheckSum
+	return
+}
+
+// PEChecksumPatch recomputes the optional header checksum of a PE file. It is
+// run after all other patches so that the checksum covers their changes.
+type PEChecksumPatch struct {
+	report []string
+}
+
+func NewPEChecksumPatch() *PEChecksumPatch {
+	return &PEChecksumPatch{}
+}
+
+func (p *PEChecksumPatch) Run(file *os.File) (err error) {
+	p.report = nil
+
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	img, err := parsePEImage(data)
+	if err != nil {
+		return
+	}
+
+	offset, err := img.checksumOffset()
+	if err != nil {
+		return
+	}
+
+	stored := binary.LittleEndian.Uint32(data[offset:])
+	computed := peChecksum(data, offset)
+
+	var encoded [4]byte
+	binary.LittleEndian.PutUint32(encoded[:], computed)
+	if _, err = file.WriteAt(encoded[:], offset); err != nil {
+		return
+	}
+
+	p.report = append(p.report, fmt.Sprintf("checksum 0x%08X -> 0x%08X", stored, computed))
+	return
+}
+
+func (p *PEChecksumPatch) Name() string {
+	return "Update PE checksum"
+}
+
+func (p *PEChecksumPatch) Report() []string {
+	return p.report
+}
+
+// VerifyPEChecksum reads the stored PE checksum of a file and computes the
+// checksum it should have. A stored checksum of 0 means the file does not
+// carry a checksum.
+func VerifyPEChecksum(file *os.File) (stored uint32, computed uint32, err error) {
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	img, err := parsePEImage(data)
+	if err != nil {
+		return
+	}
+
+	offset, err := img.checksumOffset()
+	if err != nil {
+		return
+	}
+
+	stored = binary.LittleEndian.Uint32(data[offset:])
+	computed = peChecksum(data, offset)
+	return
+}
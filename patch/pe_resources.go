@@ -0,0 +1,418 @@
+package patch
+
+import (
+	"cmp"
+	"debug/pe"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf16"
+)
+
+// https://learn.microsoft.com/en-us/windows/win32/debug/pe-format#the-rsrc-section
+// Resources form a tree of directories, usually three levels deep: type,
+// name and language. The leaves are data entries pointing at the resource
+// data by RVA.
+
+const imageDirectoryEntryResource = 2
+
+// Resource types
+const (
+	resourceTypeStringTable = 6  // RT_STRING
+	resourceTypeVersion     = 16 // RT_VERSION
+)
+
+// resourceSection is the name of the section a rebuilt resource tree is
+// written to when it no longer fits in place.
+const resourceSection = ".rsrc"
+
+// resourceDirectory is a directory of the resource tree. Named entries come
+// first, sorted by name, followed by ID entries sorted by ID.
+type resourceDirectory struct {
+	characteristics uint32
+	timeDateStamp   uint32
+	majorVersion    uint16
+	minorVersion    uint16
+	entries         []*resourceDirectoryEntry
+}
+
+// resourceDirectoryEntry is either a subdirectory or a data entry.
+type resourceDirectoryEntry struct {
+	// name is set for named entries, id for all others
+	named bool
+	name  string
+	id    uint32
+
+	dir  *resourceDirectory
+	data *resourceData
+}
+
+// resourceData is a leaf of the resource tree.
+type resourceData struct {
+	rva      uint32
+	size     uint32
+	codePage uint32
+
+	// entryOffset is the raw file offset of the data entry, or 0 for added data
+	entryOffset int64
+
+	// content holds new data for the resource, or nil if it is unchanged
+	content []byte
+}
+
+// resources parses the resource tree of the image.
+func (img *image) resources() (root *resourceDirectory, err error) {
+	dir := img.dataDirectory(imageDirectoryEntryResource)
+	if dir.VirtualAddress == 0 {
+		err = errors.New("PE file has no resources")
+		return
+	}
+
+	base, err := img.rvaToOffset(dir.VirtualAddress)
+	if err != nil {
+		return
+	}
+
+	return img.resourceDirectory(base, 0, 0)
+}
+
+// resourceDirectory parses the directory at offset from the start of the
+// resource tree at base.
+func (img *image) resourceDirectory(base int64, offset uint32, depth int) (dir *resourceDirectory, err error) {
+	// Deeper trees are not produced by any resource compiler, and limiting the
+	// depth keeps directories that refer to their parents from looping forever
+	if depth > 3 {
+		err = errors.New("resource tree is too deep")
+		return
+	}
+
+	start := base + int64(offset)
+	if start+16 > int64(len(img.data)) {
+		err = fmt.Errorf("resource directory at 0x%X is truncated", start)
+		return
+	}
+	header := img.data[start : start+16]
+	dir = &resourceDirectory{
+		characteristics: binary.LittleEndian.Uint32(header[0:]),
+		timeDateStamp:   binary.LittleEndian.Uint32(header[4:]),
+		majorVersion:    binary.LittleEndian.Uint16(header[8:]),
+		minorVersion:    binary.LittleEndian.Uint16(header[10:]),
+	}
+	count := int64(binary.LittleEndian.Uint16(header[12:])) + int64(binary.LittleEndian.Uint16(header[14:]))
+	if start+16+count*8 > int64(len(img.data)) {
+		err = fmt.Errorf("resource directory at 0x%X is truncated", start)
+		return
+	}
+
+	for i := range count {
+		raw := img.data[start+16+i*8:]
+		nameField := binary.LittleEndian.Uint32(raw[0:])
+		offsetField := binary.LittleEndian.Uint32(raw[4:])
+
+		entry := &resourceDirectoryEntry{id: nameField}
+		if nameField&0x80000000 != 0 {
+			entry.named = true
+			entry.id = 0
+			if entry.name, err = img.resourceName(base, nameField&0x7FFFFFFF); err != nil {
+				return
+			}
+		}
+
+		if offsetField&0x80000000 != 0 {
+			if entry.dir, err = img.resourceDirectory(base, offsetField&0x7FFFFFFF, depth+1); err != nil {
+				return
+			}
+		} else {
+			entryOffset := base + int64(offsetField)
+			if entryOffset+16 > int64(len(img.data)) {
+				err = fmt.Errorf("resource data entry at 0x%X is truncated", entryOffset)
+				return
+			}
+			raw := img.data[entryOffset:]
+			entry.data = &resourceData{
+				rva:         binary.LittleEndian.Uint32(raw[0:]),
+				size:        binary.LittleEndian.Uint32(raw[4:]),
+				codePage:    binary.LittleEndian.Uint32(raw[8:]),
+				entryOffset: entryOffset,
+			}
+		}
+		dir.entries = append(dir.entries, entry)
+	}
+	return
+}
+
+// resourceName reads a length-prefixed UTF-16 resource name.
+func (img *image) resourceName(base int64, offset uint32) (name string, err error) {
+	start := base + int64(offset)
+	if start+2 > int64(len(img.data)) {
+		err = fmt.Errorf("resource name at 0x%X is truncated", start)
+		return
+	}
+	length := int64(binary.LittleEndian.Uint16(img.data[start:]))
+	if start+2+length*2 > int64(len(img.data)) {
+		err = fmt.Errorf("resource name at 0x%X is truncated", start)
+		return
+	}
+	name = decodeUTF16LE(img.data[start+2 : start+2+length*2])
+	return
+}
+
+// resourceData returns the current data of a resource.
+func (img *image) resourceData(data *resourceData) (content []byte, err error) {
+	if data.content != nil {
+		return data.content, nil
+	}
+	offset, err := img.rvaToOffset(data.rva)
+	if err != nil {
+		return
+	}
+	if offset+int64(data.size) > int64(len(img.data)) {
+		err = fmt.Errorf("resource data at 0x%X is truncated", offset)
+		return
+	}
+	content = img.data[offset : offset+int64(data.size)]
+	return
+}
+
+// find returns the ID entry with the given ID.
+func (d *resourceDirectory) find(id uint32) (entry *resourceDirectoryEntry, ok bool) {
+	for _, e := range d.entries {
+		if !e.named && e.id == id {
+			return e, true
+		}
+	}
+	return
+}
+
+// add inserts an ID entry, keeping the entries sorted.
+func (d *resourceDirectory) add(entry *resourceDirectoryEntry) {
+	i, _ := slices.BinarySearchFunc(d.entries, entry, func(a, b *resourceDirectoryEntry) int {
+		if a.named {
+			return -1
+		}
+		return cmp.Compare(a.id, b.id)
+	})
+	d.entries = slices.Insert(d.entries, i, entry)
+}
+
+// languages returns the data entries of all languages of a resource.
+func (d *resourceDirectory) languages() (entries []*resourceDirectoryEntry) {
+	for _, e := range d.entries {
+		if e.data != nil {
+			entries = append(entries, e)
+		}
+	}
+	return
+}
+
+// walk calls fn for every data entry in the tree.
+func (d *resourceDirectory) walk(fn func(data *resourceData)) {
+	for _, e := range d.entries {
+		if e.dir != nil {
+			e.dir.walk(fn)
+		} else {
+			fn(e.data)
+		}
+	}
+}
+
+// writeResources writes a modified resource tree back to the image. Changed
+// resources that fit are written in place; otherwise the whole tree is
+// rebuilt in a new section, with unchanged resources left where they are.
+// shift is the number of bytes section data moved by if the PE headers had to
+// grow.
+func (img *image) writeResources(root *resourceDirectory) (newData []byte, report string, shift int64, err error) {
+	inPlace := true
+	root.walk(func(data *resourceData) {
+		if data.content != nil && (data.entryOffset == 0 || len(data.content) > int(data.size)) {
+			inPlace = false
+		}
+	})
+
+	if inPlace {
+		newData = img.data
+		var changed int
+		root.walk(func(data *resourceData) {
+			if data.content == nil || err != nil {
+				return
+			}
+			var offset int64
+			if offset, err = img.rvaToOffset(data.rva); err != nil {
+				return
+			}
+			copy(newData[offset:], data.content)
+			clear(newData[offset+int64(len(data.content)) : offset+int64(data.size)])
+			binary.LittleEndian.PutUint32(newData[data.entryOffset+4:], uint32(len(data.content)))
+			changed++
+		})
+		report = fmt.Sprintf("rewrote %d resource(s) in place", changed)
+		return
+	}
+
+	// A tree rebuilt by an earlier patch is rebuilt in its section again if it
+	// still fits. Resources stored in the section are copied first.
+	dir := img.dataDirectory(imageDirectoryEntryResource)
+	for i := range img.sections {
+		s := &img.sections[i]
+		if s.name == resourceSection || !strings.HasPrefix(s.name, resourceSection) || uint64(dir.VirtualAddress) != s.address-img.imageBase {
+			continue
+		}
+		root.walk(func(data *resourceData) {
+			if data.content == nil && uint64(data.rva) >= s.address-img.imageBase && uint64(data.rva) < s.address-img.imageBase+uint64(s.mappedSize()) {
+				content, _ := img.resourceData(data)
+				data.content = slices.Clone(content)
+			}
+		})
+		if tree := root.encode(dir.VirtualAddress); int64(len(tree)) <= s.size {
+			newData = img.data
+			if int64(len(tree)) > s.virtualSize {
+				if err = img.setVirtualSize(s, int64(len(tree))); err != nil {
+					return
+				}
+			}
+			copy(newData[s.offset:], tree)
+			clear(newData[s.offset+int64(len(tree)) : s.offset+s.size])
+
+			var layout peLayout
+			if layout, err = img.layout(); err != nil {
+				return
+			}
+			if err = setDataDirectory(newData, layout, imageDirectoryEntryResource, dir.VirtualAddress, uint32(len(tree))); err != nil {
+				return
+			}
+			report = fmt.Sprintf("rebuilt the resource tree in section %s", s.name)
+			return
+		}
+	}
+
+	// The size of the tree does not depend on where it is placed
+	size := len(root.encode(0))
+
+	name := img.unusedSectionName(resourceSection)
+	newData, section, shift, err := appendPESection(img.data, name, int64(size), pe.IMAGE_SCN_CNT_INITIALIZED_DATA|pe.IMAGE_SCN_MEM_READ)
+	if err != nil {
+		return
+	}
+
+	rva := uint32(section.address - img.imageBase)
+	copy(newData[section.offset:], root.encode(rva))
+
+	newImg, err := parsePEImage(newData)
+	if err != nil {
+		return
+	}
+	layout, err := newImg.layout()
+	if err != nil {
+		return
+	}
+	if err = setDataDirectory(newData, layout, imageDirectoryEntryResource, rva, uint32(size)); err != nil {
+		return
+	}
+
+	report = fmt.Sprintf("rebuilt the resource tree in section %s", name)
+	return
+}
+
+// encode serializes the resource tree for placement at the given RVA: all
+// directories, then names, then data entries, then the data of changed
+// resources. Unchanged resources keep their RVAs.
+func (root *resourceDirectory) encode(rva uint32) (tree []byte) {
+	// Lay out the directories breadth first
+	dirs := []*resourceDirectory{root}
+	for i := 0; i < len(dirs); i++ {
+		for _, e := range dirs[i].entries {
+			if e.dir != nil {
+				dirs = append(dirs, e.dir)
+			}
+		}
+	}
+
+	dirOffsets := make(map[*resourceDirectory]uint32)
+	var offset uint32
+	for _, d := range dirs {
+		dirOffsets[d] = offset
+		offset += 16 + 8*uint32(len(d.entries))
+	}
+
+	nameOffsets := make(map[*resourceDirectoryEntry]uint32)
+	for _, d := range dirs {
+		for _, e := range d.entries {
+			if e.named {
+				nameOffsets[e] = offset
+				offset += 2 + 2*uint32(len(utf16.Encode([]rune(e.name))))
+			}
+		}
+	}
+
+	offset = uint32(alignUp(int64(offset), 4))
+	dataEntryOffsets := make(map[*resourceData]uint32)
+	var changed []*resourceData
+	root.walk(func(data *resourceData) {
+		dataEntryOffsets[data] = offset
+		offset += 16
+		if data.content != nil {
+			changed = append(changed, data)
+		}
+	})
+
+	contentOffsets := make(map[*resourceData]uint32)
+	for _, data := range changed {
+		offset = uint32(alignUp(int64(offset), 8))
+		contentOffsets[data] = offset
+		offset += uint32(len(data.content))
+	}
+
+	tree = make([]byte, offset)
+	for _, d := range dirs {
+		raw := tree[dirOffsets[d]:]
+		binary.LittleEndian.PutUint32(raw[0:], d.characteristics)
+		binary.LittleEndian.PutUint32(raw[4:], d.timeDateStamp)
+		binary.LittleEndian.PutUint16(raw[8:], d.majorVersion)
+		binary.LittleEndian.PutUint16(raw[10:], d.minorVersion)
+
+		var namedCount uint16
+		for _, e := range d.entries {
+			if e.named {
+				namedCount++
+			}
+		}
+		binary.LittleEndian.PutUint16(raw[12:], namedCount)
+		binary.LittleEndian.PutUint16(raw[14:], uint16(len(d.entries))-namedCount)
+
+		for i, e := range d.entries {
+			entry := raw[16+i*8:]
+			if e.named {
+				binary.LittleEndian.PutUint32(entry[0:], nameOffsets[e]|0x80000000)
+				name := tree[nameOffsets[e]:]
+				units := utf16.Encode([]rune(e.name))
+				binary.LittleEndian.PutUint16(name, uint16(len(units)))
+				for j, unit := range units {
+					binary.LittleEndian.PutUint16(name[2+j*2:], unit)
+				}
+			} else {
+				binary.LittleEndian.PutUint32(entry[0:], e.id)
+			}
+
+			if e.dir != nil {
+				binary.LittleEndian.PutUint32(entry[4:], dirOffsets[e.dir]|0x80000000)
+			} else {
+				binary.LittleEndian.PutUint32(entry[4:], dataEntryOffsets[e.data])
+			}
+		}
+	}
+
+	root.walk(func(data *resourceData) {
+		raw := tree[dataEntryOffsets[data]:]
+		dataRVA, size := data.rva, data.size
+		if data.content != nil {
+			dataRVA, size = rva+contentOffsets[data], uint32(len(data.content))
+			copy(tree[contentOffsets[data]:], data.content)
+		}
+		binary.LittleEndian.PutUint32(raw[0:], dataRVA)
+		binary.LittleEndian.PutUint32(raw[4:], size)
+		binary.LittleEndian.PutUint32(raw[8:], data.codePage)
+	})
+	return
+}
@@ -0,0 +1,290 @@
+package patch
+
+import (
+	"debug/pe"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/renorris/openfsd-client-patch-utility/patchfile"
+	"slices"
+)
+
+// peLayout holds the offsets of the PE header fields that change when
+// sections are added to or grown in a PE file.
+type peLayout struct {
+	// fileHeaderOffset is the raw file offset of the COFF file header
+	fileHeaderOffset int64
+
+	// optionalHeaderOffset is the raw file offset of the optional header
+	optionalHeaderOffset int64
+
+	// sectionTableOffset is the raw file offset of the first section header
+	sectionTableOffset int64
+
+	sizeOfHeaders    int64
+	fileAlignment    int64
+	sectionAlignment int64
+}
+
+// layout returns the offsets of mutable PE header fields.
+func (img *image) layout() (layout peLayout, err error) {
+	if img.pe == nil {
+		err = errors.New("image is not a PE file")
+		return
+	}
+
+	layout.fileHeaderOffset = int64(binary.LittleEndian.Uint32(img.data[0x3C:])) + 4
+	layout.optionalHeaderOffset = layout.fileHeaderOffset + 20
+	layout.sectionTableOffset = layout.optionalHeaderOffset + int64(img.pe.FileHeader.SizeOfOptionalHeader)
+
+	switch header := img.pe.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		layout.sizeOfHeaders = int64(header.SizeOfHeaders)
+		layout.fileAlignment = int64(header.FileAlignment)
+		layout.sectionAlignment = int64(header.SectionAlignment)
+	case *pe.OptionalHeader64:
+		layout.sizeOfHeaders = int64(header.SizeOfHeaders)
+		layout.fileAlignment = int64(header.FileAlignment)
+		layout.sectionAlignment = int64(header.SectionAlignment)
+	}
+
+	if layout.fileAlignment == 0 || layout.sectionAlignment == 0 {
+		err = errors.New("PE file has invalid alignment values")
+	}
+	return
+}
+
+// Offsets of optional header fields shared by PE32 and PE32+
+const (
+	optionalHeaderSizeOfCode            = 4
+	optionalHeaderSizeOfInitializedData = 8
+	optionalHeaderSizeOfImage           = 56
+	optionalHeaderSizeOfHeaders         = 60
+)
+
+const imageDirectoryEntryDebug = 6
+
+// appendPESection adds a new zero-filled section after the last section of a
+// PE file. Any data following the last section (e.g. a certificate table or
+// an appended archive) is moved to follow the new section. If the headers
+// have no room for another section header they are grown, moving the raw data
+// of all sections by shift bytes.
+func appendPESection(data []byte, name string, size int64, characteristics uint32) (newData []byte, section imageSection, shift int64, err error) {
+	if len(name) == 0 || len(name) > 8 {
+		err = fmt.Errorf("section name must be 1 to 8 bytes long: %q", name)
+		return
+	}
+	if size <= 0 {
+		err = errors.New("section size must be positive")
+		return
+	}
+
+	img, err := parsePEImage(data)
+	if err != nil {
+		return
+	}
+	for _, s := range img.sections {
+		if s.name == name {
+			err = fmt.Errorf("PE file already has a section named %s", name)
+			return
+		}
+	}
+
+	layout, err := img.layout()
+	if err != nil {
+		return
+	}
+
+	// Check that the section table has room for another header
+	headerOffset := layout.sectionTableOffset + int64(len(img.sections))*40
+	headerSpace := layout.sizeOfHeaders
+	for _, s := range img.sections {
+		if s.size > 0 && s.offset < headerSpace {
+			headerSpace = s.offset
+		}
+	}
+	if headerOffset+40 > headerSpace {
+		if headerSpace < layout.sizeOfHeaders {
+			err = fmt.Errorf("no room in the PE headers for another section header (0x%X > 0x%X)", headerOffset+40, headerSpace)
+			return
+		}
+		if data, shift, err = growPEHeaders(data); err != nil {
+			return
+		}
+		newData, section, _, err = appendPESection(data, name, size, characteristics)
+		return
+	}
+	for _, b := range data[headerOffset : headerOffset+40] {
+		if b != 0x00 {
+			err = errors.New("the space after the section table is in use (e.g. by bound imports)")
+			return
+		}
+	}
+
+	// Place the section after the last section, both in memory and in the file
+	var virtualEnd, rawEnd uint64
+	for _, s := range img.sections {
+		virtualEnd = max(virtualEnd, s.address-img.imageBase+uint64(max(s.virtualSize, s.size)))
+		rawEnd = max(rawEnd, uint64(s.offset+s.size))
+	}
+	virtualAddress := alignUp(int64(virtualEnd), layout.sectionAlignment)
+	rawOffset := alignUp(int64(rawEnd), layout.fileAlignment)
+	rawSize := alignUp(size, layout.fileAlignment)
+
+	// Insert the section data before anything appended to the file
+	newData = make([]byte, 0, int64(len(data))+rawSize+layout.fileAlignment)
+	newData = append(newData, data[:min(rawOffset, int64(len(data)))]...)
+	newData = append(newData, make([]byte, rawOffset-int64(len(newData))+rawSize)...)
+	if rawOffset < int64(len(data)) {
+		newData = append(newData, data[rawOffset:]...)
+	}
+
+	// Move the certificate table along with the rest of the appended data
+	if security := img.dataDirectory(imageDirectoryEntrySecurity); security.VirtualAddress != 0 && int64(security.VirtualAddress) >= rawOffset {
+		if err = setDataDirectory(newData, layout, imageDirectoryEntrySecurity, security.VirtualAddress+uint32(rawSize), security.Size); err != nil {
+			return
+		}
+	}
+
+	header := newData[headerOffset : headerOffset+40]
+	copy(header[0:8], name)
+	binary.LittleEndian.PutUint32(header[8:], uint32(size))
+	binary.LittleEndian.PutUint32(header[12:], uint32(virtualAddress))
+	binary.LittleEndian.PutUint32(header[16:], uint32(rawSize))
+	binary.LittleEndian.PutUint32(header[20:], uint32(rawOffset))
+	binary.LittleEndian.PutUint32(header[36:], characteristics)
+
+	binary.LittleEndian.PutUint16(newData[layout.fileHeaderOffset+2:], uint16(len(img.sections)+1))
+
+	sizeOfImage := alignUp(virtualAddress+size, layout.sectionAlignment)
+	binary.LittleEndian.PutUint32(newData[layout.optionalHeaderOffset+optionalHeaderSizeOfImage:], uint32(sizeOfImage))
+
+	sizeField := layout.optionalHeaderOffset + optionalHeaderSizeOfInitializedData
+	if characteristics&pe.IMAGE_SCN_CNT_CODE != 0 {
+		sizeField = layout.optionalHeaderOffset + optionalHeaderSizeOfCode
+	}
+	binary.LittleEndian.PutUint32(newData[sizeField:], binary.LittleEndian.Uint32(newData[sizeField:])+uint32(rawSize))
+
+	section = imageSection{
+		name:         name,
+		offset:       rawOffset,
+		size:         rawSize,
+		address:      img.imageBase + uint64(virtualAddress),
+		virtualSize:  size,
+		executable:   characteristics&pe.IMAGE_SCN_MEM_EXECUTE != 0,
+		writable:     characteristics&pe.IMAGE_SCN_MEM_WRITE != 0,
+		headerOffset: headerOffset,
+	}
+	return
+}
+
+// unusedSectionName returns base, or base followed by a number if the image
+// already has a section of that name, e.g. after patching an image twice.
+func (img *image) unusedSectionName(base string) (name string) {
+	name = base
+	for i := 1; slices.ContainsFunc(img.sections, func(s imageSection) bool { return s.name == name }); i++ {
+		name = fmt.Sprintf("%s%d", base, i)
+	}
+	return
+}
+
+// shiftSections moves the raw offsets of the patchfile's sections after the
+// PE headers grew by shift bytes.
+func shiftSections(patchFile *patchfile.PatchFile, shift int64) {
+	for i := range patchFile.Sections {
+		patchFile.Sections[i].RawOffset += shift
+	}
+}
+
+// growPEHeaders grows the PE headers by one file alignment unit to make room
+// for more section headers. The raw data of all sections, and everything that
+// refers to it by file offset, moves by shift bytes. Virtual addresses do not
+// change.
+func growPEHeaders(data []byte) (newData []byte, shift int64, err error) {
+	img, err := parsePEImage(data)
+	if err != nil {
+		return
+	}
+	layout, err := img.layout()
+	if err != nil {
+		return
+	}
+
+	shift = layout.fileAlignment
+	sizeOfHeaders := layout.sizeOfHeaders + shift
+
+	// The headers are mapped below the first section
+	for _, s := range img.sections {
+		if s.address-img.imageBase < uint64(sizeOfHeaders) {
+			err = fmt.Errorf("no room in the PE headers for another section header, and the headers cannot grow without overlapping %s", s.name)
+			return
+		}
+	}
+
+	newData = make([]byte, 0, int64(len(data))+shift)
+	newData = append(newData, data[:layout.sizeOfHeaders]...)
+	newData = append(newData, make([]byte, shift)...)
+	newData = append(newData, data[layout.sizeOfHeaders:]...)
+
+	binary.LittleEndian.PutUint32(newData[layout.optionalHeaderOffset+optionalHeaderSizeOfHeaders:], uint32(sizeOfHeaders))
+
+	for _, s := range img.sections {
+		if s.offset != 0 {
+			binary.LittleEndian.PutUint32(newData[s.headerOffset+20:], uint32(s.offset+shift))
+		}
+	}
+
+	if security := img.dataDirectory(imageDirectoryEntrySecurity); security.VirtualAddress != 0 {
+		if err = setDataDirectory(newData, layout, imageDirectoryEntrySecurity, security.VirtualAddress+uint32(shift), security.Size); err != nil {
+			return
+		}
+	}
+
+	// Debug directory entries locate their data by file offset as well
+	if debug := img.dataDirectory(imageDirectoryEntryDebug); debug.VirtualAddress != 0 {
+		var debugOffset int64
+		if debugOffset, err = img.rvaToOffset(debug.VirtualAddress); err != nil {
+			return
+		}
+		for entry := debugOffset + shift; entry+28 <= debugOffset+shift+int64(debug.Size); entry += 28 {
+			if pointer := binary.LittleEndian.Uint32(newData[entry+24:]); pointer != 0 {
+				binary.LittleEndian.PutUint32(newData[entry+24:], pointer+uint32(shift))
+			}
+		}
+	}
+
+	return
+}
+
+// dataDirectoryOffset returns the raw file offset of a PE data directory entry.
+func dataDirectoryOffset(data []byte, layout peLayout, index int) (offset int64, err error) {
+	// The data directories start at offset 96 in PE32 and 112 in PE32+
+	magic := binary.LittleEndian.Uint16(data[layout.optionalHeaderOffset:])
+	offset = layout.optionalHeaderOffset + 96
+	if magic == 0x20B {
+		offset = layout.optionalHeaderOffset + 112
+	}
+	offset += int64(index) * 8
+
+	if offset+8 > layout.sectionTableOffset {
+		err = fmt.Errorf("PE file has no data directory %d", index)
+	}
+	return
+}
+
+// setDataDirectory overwrites a PE data directory entry.
+func setDataDirectory(data []byte, layout peLayout, index int, virtualAddress uint32, size uint32) (err error) {
+	entryOffset, err := dataDirectoryOffset(data, layout, index)
+	if err != nil {
+		return
+	}
+
+	binary.LittleEndian.PutUint32(data[entryOffset:], virtualAddress)
+	binary.LittleEndian.PutUint32(data[entryOffset+4:], size)
+	return
+}
+
+// alignUp rounds value up to the next multiple of alignment.
+func alignUp(value int64, alignment int64) int64 {
+	return (value + alignment - 1) / alignment * alignment
+}
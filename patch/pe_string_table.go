@@ -0,0 +1,158 @@
+package patch
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/renorris/openfsd-client-patch-utility/patchfile"
+	"os"
+	"unicode/utf16"
+)
+
+// String tables are stored in blocks of 16 strings. String n is in block
+// n/16+1 at index n%16. Each string is a UTF-16 code unit count followed by
+// the code units, without a null terminator.
+
+// decodeStringBlock decodes the 16 strings of an RT_STRING block.
+func decodeStringBlock(data []byte) (block [16][]uint16, err error) {
+	pos := 0
+	for i := range block {
+		if pos+2 > len(data) {
+			err = fmt.Errorf("string table block is truncated")
+			return
+		}
+		length := int(binary.LittleEndian.Uint16(data[pos:]))
+		pos += 2
+		if pos+length*2 > len(data) {
+			err = fmt.Errorf("string table block is truncated")
+			return
+		}
+		block[i] = make([]uint16, length)
+		for j := range length {
+			block[i][j] = binary.LittleEndian.Uint16(data[pos+j*2:])
+		}
+		pos += length * 2
+	}
+	return
+}
+
+func encodeStringBlock(block [16][]uint16) (data []byte) {
+	for _, str := range block {
+		data = binary.LittleEndian.AppendUint16(data, uint16(len(str)))
+		for _, unit := range str {
+			data = binary.LittleEndian.AppendUint16(data, unit)
+		}
+	}
+	return
+}
+
+// StringTablePatch sets a string in the RT_STRING resources of a PE file,
+// where native clients keep UI strings and defaults loaded with LoadString.
+type StringTablePatch struct {
+	patchFile *patchfile.PatchFile
+	patch     *patchfile.StringTablePatch
+	report    []string
+}
+
+func NewStringTablePatch(patchFile *patchfile.PatchFile, patch *patchfile.StringTablePatch) *StringTablePatch {
+	return &StringTablePatch{patchFile: patchFile, patch: patch}
+}
+
+func (p *StringTablePatch) Run(file *os.File) (err error) {
+	p.report = nil
+
+	if len(utf16.Encode([]rune(p.patch.NewString))) > 0xFFFF {
+		err = fmt.Errorf("new string is too long")
+		return
+	}
+
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	img, err := parsePEImage(data)
+	if err != nil {
+		return
+	}
+
+	root, err := img.resources()
+	if err != nil {
+		return
+	}
+
+	blockID := uint32(p.patch.ID)/16 + 1
+	index := p.patch.ID % 16
+
+	typeEntry, ok := root.find(resourceTypeStringTable)
+	if !ok {
+		typeEntry = &resourceDirectoryEntry{id: resourceTypeStringTable, dir: &resourceDirectory{}}
+		root.add(typeEntry)
+	}
+	blockEntry, ok := typeEntry.dir.find(blockID)
+	if !ok {
+		blockEntry = &resourceDirectoryEntry{id: blockID, dir: &resourceDirectory{}}
+		typeEntry.dir.add(blockEntry)
+	}
+
+	// Patch every language of the block unless a language is given
+	var languages []*resourceDirectoryEntry
+	for _, e := range blockEntry.dir.languages() {
+		if p.patch.Language == 0 || e.id == uint32(p.patch.Language) {
+			languages = append(languages, e)
+		}
+	}
+	if len(languages) == 0 {
+		if p.patch.OldString != "" {
+			err = fmt.Errorf("string %d does not exist", p.patch.ID)
+			return
+		}
+		e := &resourceDirectoryEntry{id: uint32(p.patch.Language), data: &resourceData{content: encodeStringBlock([16][]uint16{})}}
+		blockEntry.dir.add(e)
+		languages = append(languages, e)
+		p.report = append(p.report, fmt.Sprintf("added string table block %d (language %d)", blockID, p.patch.Language))
+	}
+
+	for _, e := range languages {
+		var content []byte
+		if content, err = img.resourceData(e.data); err != nil {
+			return
+		}
+
+		var block [16][]uint16
+		if block, err = decodeStringBlock(content); err != nil {
+			err = fmt.Errorf("string table block %d (language %d): %w", blockID, e.id, err)
+			return
+		}
+
+		oldString := string(utf16.Decode(block[index]))
+		if p.patch.OldString != "" && oldString != p.patch.OldString {
+			err = fmt.Errorf("string %d (language %d) is %q, expected %q", p.patch.ID, e.id, oldString, p.patch.OldString)
+			return
+		}
+
+		block[index] = utf16.Encode([]rune(p.patch.NewString))
+		e.data.content = encodeStringBlock(block)
+		p.report = append(p.report, fmt.Sprintf("string %d (language %d): %q -> %q", p.patch.ID, e.id, oldString, p.patch.NewString))
+	}
+
+	newData, line, shift, err := img.writeResources(root)
+	if err != nil {
+		return
+	}
+	p.report = append(p.report, line)
+	shiftSections(p.patchFile, shift)
+
+	if err = rewriteWholeFile(file, newData); err != nil {
+		return
+	}
+
+	return
+}
+
+func (p *StringTablePatch) Name() string {
+	return p.patch.Name
+}
+
+func (p *StringTablePatch) Report() []string {
+	return p.report
+}
@@ -0,0 +1,294 @@
+package patch
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/renorris/openfsd-client-patch-utility/patchfile"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+// https://learn.microsoft.com/en-us/windows/win32/menurc/vs-versioninfo
+// Version information is a tree of blocks. Each block has a length, a value
+// length, a type (1 for text, 0 for binary), a null-terminated UTF-16 key and
+// a value, followed by its children, each aligned to 4 bytes. The root
+// VS_VERSIONINFO holds a VS_FIXEDFILEINFO; its StringFileInfo child holds one
+// StringTable per language and code page, which in turn holds the strings.
+
+const (
+	fixedFileInfoSignature = 0xFEEF04BD
+
+	// Offsets in VS_FIXEDFILEINFO
+	fixedFileInfoFlagsMask = 24
+	fixedFileInfoFlags     = 28
+)
+
+// VS_FIXEDFILEINFO file flags
+const (
+	versionFlagPatched      = 0x04 // VS_FF_PATCHED
+	versionFlagPrivateBuild = 0x08 // VS_FF_PRIVATEBUILD
+	versionFlagSpecialBuild = 0x20 // VS_FF_SPECIALBUILD
+)
+
+// defaultStringTable is the StringTable key used when a version resource has
+// no StringFileInfo: U.S. English, Unicode.
+const defaultStringTable = "040904B0"
+
+// versionBlock is a block of a version resource.
+type versionBlock struct {
+	key       string
+	valueType uint16
+
+	// valueLength is kept as stored, since not all resource compilers agree
+	// on whether text lengths count bytes or characters
+	valueLength uint16
+	value       []byte
+
+	children []*versionBlock
+}
+
+// parseVersionBlock parses the block at pos. Offsets are relative to the start
+// of the resource, which is 4-byte aligned.
+func parseVersionBlock(data []byte, pos int) (block *versionBlock, end int, err error) {
+	if pos+6 > len(data) {
+		err = errors.New("version block is truncated")
+		return
+	}
+	length := int(binary.LittleEndian.Uint16(data[pos:]))
+	end = pos + length
+	if length < 6 || end > len(data) {
+		err = errors.New("version block has an invalid length")
+		return
+	}
+
+	block = &versionBlock{
+		valueLength: binary.LittleEndian.Uint16(data[pos+2:]),
+		valueType:   binary.LittleEndian.Uint16(data[pos+4:]),
+	}
+
+	p := pos + 6
+	var key []uint16
+	for {
+		if p+2 > end {
+			err = errors.New("version block key is not terminated")
+			return
+		}
+		unit := binary.LittleEndian.Uint16(data[p:])
+		p += 2
+		if unit == 0 {
+			break
+		}
+		key = append(key, unit)
+	}
+	block.key = string(utf16.Decode(key))
+
+	p = int(alignUp(int64(p), 4))
+	valueSize := int(block.valueLength)
+	if block.valueType == 1 {
+		valueSize *= 2
+	}
+	valueEnd := min(p+valueSize, end)
+	if p < valueEnd {
+		block.value = data[p:valueEnd]
+	}
+
+	for p = int(alignUp(int64(valueEnd), 4)); p < end; p = int(alignUp(int64(p), 4)) {
+		// Some resource compilers count padding after the last child
+		if p+2 > end || binary.LittleEndian.Uint16(data[p:]) == 0 {
+			break
+		}
+		var child *versionBlock
+		if child, p, err = parseVersionBlock(data, p); err != nil {
+			return
+		}
+		block.children = append(block.children, child)
+	}
+	return
+}
+
+// encode serializes the block. The block is assumed to start 4-byte aligned.
+func (b *versionBlock) encode() (data []byte) {
+	data = make([]byte, 6)
+	binary.LittleEndian.PutUint16(data[2:], b.valueLength)
+	binary.LittleEndian.PutUint16(data[4:], b.valueType)
+	for _, unit := range utf16.Encode([]rune(b.key)) {
+		data = binary.LittleEndian.AppendUint16(data, unit)
+	}
+	data = append(data, 0, 0)
+
+	data = append(data, make([]byte, alignUp(int64(len(data)), 4)-int64(len(data)))...)
+	data = append(data, b.value...)
+	for _, child := range b.children {
+		data = append(data, make([]byte, alignUp(int64(len(data)), 4)-int64(len(data)))...)
+		data = append(data, child.encode()...)
+	}
+
+	binary.LittleEndian.PutUint16(data[0:], uint16(len(data)))
+	return
+}
+
+func (b *versionBlock) child(key string) (child *versionBlock, ok bool) {
+	for _, c := range b.children {
+		if c.key == key {
+			return c, true
+		}
+	}
+	return
+}
+
+// text returns the value of a text block without its null terminator.
+func (b *versionBlock) text() string {
+	units := make([]uint16, len(b.value)/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(b.value[i*2:])
+	}
+	return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+}
+
+func (b *versionBlock) setText(text string) {
+	units := append(utf16.Encode([]rune(text)), 0)
+	b.value = make([]byte, 0, len(units)*2)
+	for _, unit := range units {
+		b.value = binary.LittleEndian.AppendUint16(b.value, unit)
+	}
+	b.valueType = 1
+	b.valueLength = uint16(len(units))
+}
+
+// VersionInfoPatch sets or appends to a string of the RT_VERSION resource of
+// a PE file, e.g. FileDescription or PrivateBuild, in every language. It also
+// sets VS_FF_PATCHED, so patched binaries can be told apart in Explorer and
+// by other tools.
+type VersionInfoPatch struct {
+	patchFile *patchfile.PatchFile
+	patch     *patchfile.VersionInfoPatch
+	report    []string
+}
+
+func NewVersionInfoPatch(patchFile *patchfile.PatchFile, patch *patchfile.VersionInfoPatch) *VersionInfoPatch {
+	return &VersionInfoPatch{patchFile: patchFile, patch: patch}
+}
+
+func (p *VersionInfoPatch) Run(file *os.File) (err error) {
+	p.report = nil
+
+	if p.patch.Key == "" {
+		err = errors.New("key must be set")
+		return
+	}
+
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	img, err := parsePEImage(data)
+	if err != nil {
+		return
+	}
+
+	root, err := img.resources()
+	if err != nil {
+		return
+	}
+
+	typeEntry, ok := root.find(resourceTypeVersion)
+	if !ok || typeEntry.dir == nil {
+		err = errors.New("PE file has no version information")
+		return
+	}
+
+	flags := uint32(versionFlagPatched)
+	switch p.patch.Key {
+	case "PrivateBuild":
+		flags |= versionFlagPrivateBuild
+	case "SpecialBuild":
+		flags |= versionFlagSpecialBuild
+	}
+
+	for _, nameEntry := range typeEntry.dir.entries {
+		if nameEntry.dir == nil {
+			continue
+		}
+		for _, e := range nameEntry.dir.languages() {
+			var content []byte
+			if content, err = img.resourceData(e.data); err != nil {
+				return
+			}
+
+			var info *versionBlock
+			if info, _, err = parseVersionBlock(content, 0); err != nil {
+				err = fmt.Errorf("version resource (language %d): %w", e.id, err)
+				return
+			}
+			if err = p.patchVersionInfo(info, e.id, flags); err != nil {
+				return
+			}
+			e.data.content = info.encode()
+		}
+	}
+
+	newData, line, shift, err := img.writeResources(root)
+	if err != nil {
+		return
+	}
+	p.report = append(p.report, line)
+	shiftSections(p.patchFile, shift)
+
+	if err = rewriteWholeFile(file, newData); err != nil {
+		return
+	}
+
+	return
+}
+
+// patchVersionInfo updates the string in every StringTable and sets the file flags.
+func (p *VersionInfoPatch) patchVersionInfo(info *versionBlock, language uint32, flags uint32) (err error) {
+	if len(info.value) < 52 || binary.LittleEndian.Uint32(info.value) != fixedFileInfoSignature {
+		err = fmt.Errorf("version resource (language %d) has no VS_FIXEDFILEINFO", language)
+		return
+	}
+
+	stringFileInfo, ok := info.child("StringFileInfo")
+	if !ok {
+		stringFileInfo = &versionBlock{key: "StringFileInfo", valueType: 1}
+		info.children = append([]*versionBlock{stringFileInfo}, info.children...)
+	}
+	if len(stringFileInfo.children) == 0 {
+		stringFileInfo.children = append(stringFileInfo.children, &versionBlock{key: defaultStringTable, valueType: 1})
+	}
+
+	for _, table := range stringFileInfo.children {
+		str, ok := table.child(p.patch.Key)
+		if !ok {
+			str = &versionBlock{key: p.patch.Key}
+			table.children = append(table.children, str)
+		}
+
+		oldValue := str.text()
+		newValue := p.patch.Value
+		if p.patch.Append {
+			newValue = oldValue + p.patch.Value
+		}
+		str.setText(newValue)
+		p.report = append(p.report, fmt.Sprintf("%s (%s): %q -> %q", p.patch.Key, table.key, oldValue, newValue))
+	}
+
+	// Copy the value before changing it, as it may still refer to the image
+	info.value = append([]byte(nil), info.value...)
+	mask := binary.LittleEndian.Uint32(info.value[fixedFileInfoFlagsMask:])
+	fileFlags := binary.LittleEndian.Uint32(info.value[fixedFileInfoFlags:])
+	binary.LittleEndian.PutUint32(info.value[fixedFileInfoFlagsMask:], mask|flags)
+	binary.LittleEndian.PutUint32(info.value[fixedFileInfoFlags:], fileFlags|flags)
+	return
+}
+
+func (p *VersionInfoPatch) Name() string {
+	return p.patch.Name
+}
+
+func (p *VersionInfoPatch) Report() []string {
+	return p.report
+}
@@ -0,0 +1,577 @@
+package patch
+
+import (
+	"bytes"
+	"cmp"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/renorris/openfsd-client-patch-utility/patchfile"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"unicode/utf16"
+)
+
+// The Qt resource compiler (rcc) turns .qrc files into three tables compiled
+// into the binary and registered with qRegisterResourceData:
+//
+//   - the tree: one node per file or directory, 14 bytes in format version 1
+//     and 22 bytes from version 2 on, which adds a last modified time. Each
+//     node holds a name offset and flags, followed by a child count and first
+//     child index for directories, or a locale and data offset for files.
+//   - the names: a big-endian UTF-16 name with its length and qt_hash.
+//   - the data: each file's content prefixed with its size. zlib-compressed
+//     content starts with its uncompressed size (qCompress), zstd-compressed
+//     content is a zstd frame.
+//
+// The tables carry no signature, so they are found through the root node of
+// the tree, whose name offsets must lead to names with matching hashes.
+// https://github.com/qt/qtbase/blob/dev/src/tools/rcc/rcc.cpp
+// https://github.com/qt/qtbase/blob/dev/src/corelib/io/qresource.cpp
+
+// Qt resource node flags
+const (
+	qtResourceCompressed     = 0x01
+	qtResourceDirectory      = 0x02
+	qtResourceCompressedZstd = 0x04
+)
+
+// zstdMagic starts every zstd frame.
+var zstdMagic = []byte{0x28, 0xB5, 0x2F, 0xFD}
+
+// qtResourceMaxName is the longest file name considered, as no file system allows longer ones.
+const qtResourceMaxName = 255
+
+// qtResourceRoot is the start of the root node: name offset 0 and the directory flag.
+var qtResourceRoot = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x02}
+
+// qtResources is a resource blob registered by one compiled .qrc file.
+type qtResources struct {
+	// tree, names and data are the raw file offsets of the tables
+	tree  int64
+	names int64
+	data  int64
+
+	nodeSize int64
+	files    []qtResourceFile
+}
+
+// qtResourceFile is a file node of a resource tree.
+type qtResourceFile struct {
+	path  string
+	flags uint16
+
+	// node is the raw file offset of the tree node
+	node int64
+
+	// offset is the raw file offset of the data entry, i.e. of the size preceding the content
+	offset int64
+	size   int64
+}
+
+func (f *qtResourceFile) compression() string {
+	switch {
+	case f.flags&qtResourceCompressedZstd != 0:
+		return "zstd"
+	case f.flags&qtResourceCompressed != 0:
+		return "zlib"
+	}
+	return ""
+}
+
+// qtHash is the hash rcc stores next to each name.
+func qtHash(name []uint16) (h uint32) {
+	for _, c := range name {
+		h = (h << 4) + uint32(c)
+		h ^= (h & 0xF0000000) >> 23
+		h &= 0x0FFFFFFF
+	}
+	return
+}
+
+// qtResourceNode is a node of a resource tree read relative to its tables.
+type qtResourceNode struct {
+	nameOffset int64
+	flags      uint16
+	childCount int64
+	firstChild int64
+	dataOffset int64
+}
+
+// findQtResources locates the resource blobs compiled into a binary.
+func findQtResources(data []byte) (blobs []*qtResources) {
+	for pos := 0; ; pos++ {
+		index := bytes.Index(data[pos:], qtResourceRoot)
+		if index < 0 {
+			break
+		}
+		pos += index
+		if pos+14 > len(data) || binary.BigEndian.Uint32(data[pos+10:]) != 1 {
+			continue
+		}
+
+		// Format version 2 and later add a last modified time to every node
+		for _, nodeSize := range []int64{22, 14} {
+			if r, ok := parseQtResources(data, int64(pos), nodeSize); ok {
+				blobs = append(blobs, r)
+				break
+			}
+		}
+	}
+	return
+}
+
+// parseQtResources parses the resource tree starting at a candidate root node
+// and locates its names and data tables.
+func parseQtResources(data []byte, tree int64, nodeSize int64) (r *qtResources, ok bool) {
+	r = &qtResources{tree: tree, nodeSize: nodeSize}
+
+	node := func(index int64) (n qtResourceNode, ok bool) {
+		offset := tree + index*nodeSize
+		if index < 0 || offset+nodeSize > int64(len(data)) {
+			return
+		}
+		n.nameOffset = int64(binary.BigEndian.Uint32(data[offset:]))
+		n.flags = binary.BigEndian.Uint16(data[offset+4:])
+		if n.flags&^(qtResourceCompressed|qtResourceDirectory|qtResourceCompressedZstd) != 0 {
+			return
+		}
+		if n.flags&qtResourceDirectory != 0 {
+			n.childCount = int64(binary.BigEndian.Uint32(data[offset+6:]))
+			n.firstChild = int64(binary.BigEndian.Uint32(data[offset+10:]))
+		} else {
+			n.dataOffset = int64(binary.BigEndian.Uint32(data[offset+10:]))
+		}
+		return n, true
+	}
+
+	// Walk the tree, collecting the name offsets to locate the names table
+	type visit struct {
+		index int64
+		path  []int64
+	}
+	var (
+		nameOffsets []int64
+		files       []visit
+		nodes       = map[int64]qtResourceNode{}
+	)
+	queue := []visit{{index: 0}}
+	for len(queue) > 0 {
+		v := queue[0]
+		queue = queue[1:]
+
+		n, ok := node(v.index)
+		if !ok || len(nodes) > 1<<16 {
+			return nil, false
+		}
+		if _, seen := nodes[v.index]; seen {
+			return nil, false
+		}
+		nodes[v.index] = n
+
+		if v.index != 0 {
+			nameOffsets = append(nameOffsets, n.nameOffset)
+		}
+		if n.flags&qtResourceDirectory == 0 {
+			files = append(files, v)
+			continue
+		}
+		if n.childCount == 0 || n.childCount > 1<<16 || n.firstChild <= v.index {
+			return nil, false
+		}
+		for i := range n.childCount {
+			queue = append(queue, visit{index: n.firstChild + i, path: append(slices.Clone(v.path), n.firstChild+i)})
+		}
+	}
+	if len(files) == 0 {
+		return nil, false
+	}
+
+	names, ok := findQtResourceNames(data, nameOffsets)
+	if !ok {
+		return nil, false
+	}
+	r.names = names
+
+	var fileNodes []qtResourceNode
+	for _, f := range files {
+		fileNodes = append(fileNodes, nodes[f.index])
+	}
+	if r.data, ok = findQtResourceData(data, fileNodes, names); !ok {
+		return nil, false
+	}
+
+	for _, f := range files {
+		n := nodes[f.index]
+		var parts []string
+		for _, index := range f.path {
+			parts = append(parts, qtResourceName(data, names+nodes[index].nameOffset))
+		}
+		offset := r.data + n.dataOffset
+		r.files = append(r.files, qtResourceFile{
+			path:   strings.Join(parts, "/"),
+			flags:  n.flags,
+			node:   tree + f.index*nodeSize,
+			offset: offset,
+			size:   int64(binary.BigEndian.Uint32(data[offset:])),
+		})
+	}
+	return r, true
+}
+
+// findQtResourceNames returns the raw file offset of the names table the given
+// name offsets refer to. Names are stored back to back, so the distance
+// between two consecutive offsets gives the length of the first name.
+func findQtResourceNames(data []byte, nameOffsets []int64) (names int64, ok bool) {
+	offsets := slices.Clone(nameOffsets)
+	slices.Sort(offsets)
+	offsets = slices.Compact(offsets)
+
+	var firstLength int64 = -1
+	if len(offsets) > 1 {
+		firstLength = (offsets[1] - offsets[0] - 6) / 2
+	}
+
+	for pos := int64(0); pos+6 <= int64(len(data)); pos++ {
+		length := int64(binary.BigEndian.Uint16(data[pos:]))
+		if length == 0 || length > qtResourceMaxName || (firstLength >= 0 && length != firstLength) {
+			continue
+		}
+		base := pos - offsets[0]
+		if base < 0 {
+			continue
+		}
+		if !slices.ContainsFunc(offsets, func(offset int64) bool { return !isQtResourceName(data, base+offset) }) {
+			return base, true
+		}
+	}
+	return
+}
+
+// isQtResourceName reports whether a valid name entry starts at pos.
+func isQtResourceName(data []byte, pos int64) bool {
+	if pos+6 > int64(len(data)) {
+		return false
+	}
+	length := int64(binary.BigEndian.Uint16(data[pos:]))
+	if length == 0 || length > qtResourceMaxName || pos+6+length*2 > int64(len(data)) {
+		return false
+	}
+	name := make([]uint16, length)
+	for i := range name {
+		name[i] = binary.BigEndian.Uint16(data[pos+6+int64(i)*2:])
+	}
+	return qtHash(name) == binary.BigEndian.Uint32(data[pos+2:])
+}
+
+func qtResourceName(data []byte, pos int64) string {
+	length := int64(binary.BigEndian.Uint16(data[pos:]))
+	name := make([]uint16, length)
+	for i := range name {
+		name[i] = binary.BigEndian.Uint16(data[pos+6+int64(i)*2:])
+	}
+	return string(utf16.Decode(name))
+}
+
+// findQtResourceData returns the raw file offset of the data table holding
+// entries at the given offsets. Entries are stored back to back, although an
+// entry may be followed by unused space once it has been patched, so each
+// entry must fit before the next. Candidates are scored by the number of
+// entries ending right where the next begins and of compressed entries with a
+// valid header, less empty entries; ties go to the one ending closest to the
+// names table, which rcc writes right after the data table.
+func findQtResourceData(data []byte, files []qtResourceNode, names int64) (base int64, ok bool) {
+	files = slices.Clone(files)
+	slices.SortFunc(files, func(a, b qtResourceNode) int { return cmp.Compare(a.dataOffset, b.dataOffset) })
+
+	// Both tables come from one object file and end up in the same section
+	start, limit := int64(0), int64(len(data))
+	if img, err := parseImage(data); err == nil {
+		if section, found := img.sectionAtOffset(names); found {
+			start, limit = section.offset, section.offset+section.mappedSize()
+		}
+	}
+
+	// fits returns the end of the table and its score if every entry fits at the candidate
+	fits := func(candidate int64) (end int64, score int, ok bool) {
+		var empty int
+		for i, file := range files {
+			offset := file.dataOffset
+			pos := candidate + offset
+			if pos+4 > limit {
+				return
+			}
+			size := int64(binary.BigEndian.Uint32(data[pos:]))
+			end = pos + 4 + size
+			if end > limit {
+				return
+			}
+			if i+1 < len(files) {
+				next := candidate + files[i+1].dataOffset
+				if end > next {
+					return
+				}
+				if end == next {
+					score++
+				}
+			}
+			if size == 0 {
+				empty++
+				score--
+			}
+			if isQtCompressed(data[pos+4:end], file.flags) {
+				score++
+			}
+		}
+		// Zero-filled space would fit any table of empty files
+		return end, score, empty < len(files)
+	}
+
+	base = -1
+	var bestEnd int64
+	var bestScore int
+	last := files[len(files)-1].dataOffset
+	zeroEnd := int64(-1)
+	for candidate := start; candidate+last+4 <= limit; candidate++ {
+		// Candidates whose entries all lie in a run of zeros only hold empty
+		// entries, so the search resumes with the first reaching past the run
+		first := candidate + files[0].dataOffset
+		if first >= zeroEnd && data[first] == 0 {
+			zeroEnd = first + int64(len(data[first:limit])-len(bytes.TrimLeft(data[first:limit], "\x00")))
+		}
+		if first < zeroEnd && candidate+last+4 <= zeroEnd {
+			candidate = zeroEnd - last - 4
+			continue
+		}
+
+		end, score, fit := fits(candidate)
+		if !fit {
+			continue
+		}
+		if base < 0 || score > bestScore || (score == bestScore && qtDistance(end, names) < qtDistance(bestEnd, names)) {
+			base, bestEnd, bestScore = candidate, end, score
+		}
+	}
+	return base, base >= 0
+}
+
+// isQtCompressed reports whether stored content starts with the header its
+// compression flags call for.
+func isQtCompressed(stored []byte, flags uint16) bool {
+	switch {
+	case flags&qtResourceCompressedZstd != 0:
+		return bytes.HasPrefix(stored, zstdMagic)
+	case flags&qtResourceCompressed != 0:
+		// The uncompressed size is followed by a zlib header
+		return len(stored) >= 6 && stored[4]&0x0F == 8 && (uint16(stored[4])<<8|uint16(stored[5]))%31 == 0
+	}
+	return false
+}
+
+func qtDistance(a int64, b int64) int64 {
+	return max(a-b, b-a)
+}
+
+// stored returns the stored bytes of a file, compressed or not.
+func (f *qtResourceFile) stored(data []byte) []byte {
+	return data[f.offset+4 : f.offset+4+f.size]
+}
+
+// content returns the uncompressed content of a file.
+func (f *qtResourceFile) content(data []byte) (content []byte, err error) {
+	stored := f.stored(data)
+	switch f.compression() {
+	case "zstd":
+		err = fmt.Errorf("resource %s is zstd-compressed and can only be replaced as a whole", f.path)
+	case "zlib":
+		if len(stored) < 4 {
+			err = fmt.Errorf("resource %s is truncated", f.path)
+			return
+		}
+		var reader io.ReadCloser
+		if reader, err = zlib.NewReader(bytes.NewReader(stored[4:])); err != nil {
+			return
+		}
+		defer reader.Close()
+		content, err = io.ReadAll(reader)
+	default:
+		content = stored
+	}
+	return
+}
+
+// qCompress compresses content the way qCompress does, as QResource expects
+// for zlib-compressed files.
+func qCompress(content []byte) (compressed []byte, err error) {
+	compressed = binary.BigEndian.AppendUint32(nil, uint32(len(content)))
+	buf := bytes.NewBuffer(compressed)
+	writer, err := zlib.NewWriterLevel(buf, zlib.BestCompression)
+	if err != nil {
+		return
+	}
+	if _, err = writer.Write(content); err != nil {
+		return
+	}
+	if err = writer.Close(); err != nil {
+		return
+	}
+	compressed = buf.Bytes()
+	return
+}
+
+// replace overwrites a file's content in place. Compressed files are
+// recompressed with zlib, since a zstd encoder is not available; QResource
+// reads either. Uncompressed files are compressed when that is the only way
+// to fit the new content.
+func (f *qtResourceFile) replace(data []byte, content []byte) (line string, err error) {
+	stored := content
+	flags := f.flags &^ (qtResourceCompressed | qtResourceCompressedZstd)
+	if f.compression() != "" || int64(len(content)) > f.size {
+		if stored, err = qCompress(content); err != nil {
+			return
+		}
+		flags |= qtResourceCompressed
+	}
+	if int64(len(stored)) > f.size {
+		err = fmt.Errorf("new content of %s needs %d bytes, only %d are available", f.path, len(stored), f.size)
+		return
+	}
+
+	binary.BigEndian.PutUint32(data[f.offset:], uint32(len(stored)))
+	region := data[f.offset+4 : f.offset+4+f.size]
+	clear(region[copy(region, stored):])
+	binary.BigEndian.PutUint16(data[f.node+4:], flags)
+
+	line = fmt.Sprintf(":/%s: %d bytes (%d stored", f.path, len(content), len(stored))
+	if flags&qtResourceCompressed != 0 {
+		line += ", zlib"
+	}
+	line += fmt.Sprintf(", %d free)", f.size-int64(len(stored)))
+	return
+}
+
+// qtResourcePath normalizes a resource path such as :/qml/main.qml or qrc:/qml/main.qml.
+func qtResourcePath(path string) string {
+	path = strings.TrimPrefix(path, "qrc:")
+	path = strings.TrimPrefix(path, ":")
+	return strings.TrimLeft(path, "/")
+}
+
+// QtResourceInfo describes a file compiled into a Qt resource blob.
+type QtResourceInfo struct {
+	Path string
+	Size int64
+
+	// Compression is zlib, zstd or empty
+	Compression string
+}
+
+// ListQtResources lists the files of all Qt resource blobs found in a binary.
+func ListQtResources(file *os.File) (infos []QtResourceInfo, err error) {
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	blobs := findQtResources(data)
+	if len(blobs) == 0 {
+		err = NoQtResourcesErr
+		return
+	}
+	for _, r := range blobs {
+		for _, f := range r.files {
+			infos = append(infos, QtResourceInfo{Path: ":/" + f.path, Size: f.size, Compression: f.compression()})
+		}
+	}
+	return
+}
+
+var NoQtResourcesErr = errors.New("error: no Qt resources found")
+
+// QtResourcePatch replaces the content of a file compiled into a Qt resource
+// blob, or text within it, e.g. a default server list in a QML or JSON file.
+type QtResourcePatch struct {
+	patch  *patchfile.QtResourcePatch
+	report []string
+}
+
+func NewQtResourcePatch(patch *patchfile.QtResourcePatch) *QtResourcePatch {
+	return &QtResourcePatch{patch: patch}
+}
+
+func (p *QtResourcePatch) Run(file *os.File) (err error) {
+	p.report = nil
+
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	blobs := findQtResources(data)
+	if len(blobs) == 0 {
+		err = NoQtResourcesErr
+		return
+	}
+
+	path := qtResourcePath(p.patch.Path)
+	var found bool
+	for _, r := range blobs {
+		for _, f := range r.files {
+			if f.path != path {
+				continue
+			}
+			found = true
+
+			var content []byte
+			if content, err = p.newContent(data, &f); err != nil {
+				return
+			}
+			var line string
+			if line, err = f.replace(data, content); err != nil {
+				return
+			}
+			p.report = append(p.report, line)
+		}
+	}
+	if !found {
+		err = fmt.Errorf("no Qt resource :/%s found", path)
+		return
+	}
+
+	if err = rewriteWholeFile(file, data); err != nil {
+		return
+	}
+
+	return
+}
+
+// newContent returns the patchfile content, or the current content with the
+// replacements applied.
+func (p *QtResourcePatch) newContent(data []byte, f *qtResourceFile) (content []byte, err error) {
+	if len(p.patch.Replacements) == 0 {
+		return []byte(p.patch.Content), nil
+	}
+
+	if content, err = f.content(data); err != nil {
+		return
+	}
+	for _, r := range p.patch.Replacements {
+		if !bytes.Contains(content, []byte(r.Old)) {
+			err = fmt.Errorf("resource :/%s does not contain %q", f.path, r.Old)
+			return
+		}
+		content = bytes.ReplaceAll(content, []byte(r.Old), []byte(r.New))
+	}
+	return
+}
+
+func (p *QtResourcePatch) Name() string {
+	return p.patch.Name
+}
+
+func (p *QtResourcePatch) Report() []string {
+	return p.report
+}
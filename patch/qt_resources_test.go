@@ -0,0 +1,78 @@
+package patch
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"unicode/utf16"
+)
+
+// buildQtResources returns the data, names and tree tables rcc would write for
+// files in the root directory, in format version 2.
+func buildQtResources(files map[string][]byte, order []string) []byte {
+	var data, names, tree []byte
+	node := func(nameOffset uint32, flags uint16, a uint32, b uint32) {
+		n := make([]byte, 22)
+		binary.BigEndian.PutUint32(n[0:], nameOffset)
+		binary.BigEndian.PutUint16(n[4:], flags)
+		binary.BigEndian.PutUint32(n[6:], a)
+		binary.BigEndian.PutUint32(n[10:], b)
+		tree = append(tree, n...)
+	}
+
+	node(0, qtResourceDirectory, uint32(len(order)), 1)
+	for _, name := range order {
+		encoded := utf16.Encode([]rune(name))
+		node(uint32(len(names)), 0, 0, uint32(len(data)))
+
+		names = binary.BigEndian.AppendUint16(names, uint16(len(encoded)))
+		names = binary.BigEndian.AppendUint32(names, qtHash(encoded))
+		for _, c := range encoded {
+			names = binary.BigEndian.AppendUint16(names, c)
+		}
+
+		data = binary.BigEndian.AppendUint32(data, uint32(len(files[name])))
+		data = append(data, files[name]...)
+	}
+
+	blob := append(data, names...)
+	return append(blob, tree...)
+}
+
+func TestFindQtResourcesAfterZeros(t *testing.T) {
+	files := map[string][]byte{}
+	var order []string
+	for i := range 300 {
+		name := fmt.Sprintf("file%03d.txt", i)
+		files[name] = []byte(fmt.Sprintf("content of %s", name))
+		order = append(order, name)
+	}
+	// Empty files too, which zero-filled space would also fit
+	files["empty.txt"] = nil
+	order = append([]string{"empty.txt"}, order...)
+
+	const padding = 8 << 20
+	binary := append(make([]byte, padding), buildQtResources(files, order)...)
+	binary = append(binary, make([]byte, 4096)...)
+
+	blobs := findQtResources(binary)
+	if len(blobs) != 1 {
+		t.Fatalf("found %d resource blobs, want 1", len(blobs))
+	}
+	r := blobs[0]
+	if r.data != padding {
+		t.Errorf("data table found at %d, want %d", r.data, padding)
+	}
+	if len(r.files) != len(order) {
+		t.Fatalf("found %d files, want %d", len(r.files), len(order))
+	}
+	for _, f := range r.files {
+		content, err := f.content(binary)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != string(files[f.path]) {
+			t.Errorf("%s: content %q, want %q", f.path, content, files[f.path])
+		}
+	}
+}
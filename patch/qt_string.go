@@ -0,0 +1,268 @@
+package patch
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/renorris/openfsd-client-patch-utility/patchfile"
+	"os"
+)
+
+// QStringLiteral stores its text as null-terminated UTF-16 in read-only data.
+//
+// In Qt 5, the text follows a static QArrayData header, which code refers to:
+// a reference count of -1, the size in UTF-16 code units, the allocation size
+// and capacity flag (0 for static data), and the offset from the header to the
+// text, pointer aligned. The header is 24 bytes in 64-bit builds and 16 bytes
+// in 32-bit builds.
+// https://github.com/qt/qtbase/blob/5.15/src/corelib/tools/qarraydata.h
+//
+// In Qt 6, the text has no header: code refers to it directly and passes the
+// size as an immediate when filling in the QString.
+// https://github.com/qt/qtbase/blob/6.5/src/corelib/text/qstringliteral.h
+
+// qtString is a QStringLiteral found in the target file.
+type qtString struct {
+	version int
+
+	// header is the raw file offset of the Qt 5 QArrayData header
+	header int64
+
+	// offset is the raw file offset of the text
+	offset int64
+	units  int
+}
+
+// qt5StringHeaderSize returns the size of a Qt 5 QArrayData header.
+func qt5StringHeaderSize(is64 bool) int64 {
+	if is64 {
+		return 24
+	}
+	return 16
+}
+
+// qt5StringHeader returns the raw file offset of the Qt 5 QArrayData header
+// preceding a string, if there is a valid one.
+func qt5StringHeader(img *image, offset int64, units int) (header int64, ok bool) {
+	headerSize := qt5StringHeaderSize(img.is64)
+	header = offset - headerSize
+	if header < 0 {
+		return
+	}
+
+	h := img.data[header:offset]
+	if int32(binary.LittleEndian.Uint32(h[0:])) != -1 || binary.LittleEndian.Uint32(h[4:]) != uint32(units) || binary.LittleEndian.Uint32(h[8:]) != 0 {
+		return
+	}
+	if img.is64 {
+		return header, binary.LittleEndian.Uint32(h[12:]) == 0 && binary.LittleEndian.Uint64(h[16:]) == uint64(headerSize)
+	}
+	return header, binary.LittleEndian.Uint32(h[12:]) == uint32(headerSize)
+}
+
+// findQtStrings finds the QStringLiterals holding str. version limits the
+// search to Qt 5 or Qt 6 layouts; 0 accepts both.
+func findQtStrings(img *image, str string, version int) (found []qtString, skipped int) {
+	for _, occurrence := range findStringOccurrences(img.data, str) {
+		if occurrence.encoding != "utf16le" {
+			continue
+		}
+		end := occurrence.offset + occurrence.length
+		if end+2 > int64(len(img.data)) || img.data[end] != 0 || img.data[end+1] != 0 {
+			skipped++
+			continue
+		}
+
+		s := qtString{offset: occurrence.offset, units: occurrence.units, header: -1}
+		if header, ok := qt5StringHeader(img, s.offset, s.units); ok {
+			s.version, s.header = 5, header
+		} else if isWholeString(img.data, occurrence) {
+			s.version = 6
+		}
+		if s.version == 0 || (version != 0 && s.version != version) {
+			skipped++
+			continue
+		}
+		found = append(found, s)
+	}
+	return
+}
+
+// QtStringPatch rewrites QStringLiterals together with their size: the size
+// field of the Qt 5 header, or the size immediates next to each reference in
+// Qt 6. Literals that do not fit in place are moved to a code cave.
+type QtStringPatch struct {
+	patchFile *patchfile.PatchFile
+	patch     *patchfile.QtStringPatch
+	caves     *CaveAllocator
+	report    []string
+}
+
+func NewQtStringPatch(patchFile *patchfile.PatchFile, patch *patchfile.QtStringPatch, caves *CaveAllocator) *QtStringPatch {
+	return &QtStringPatch{patchFile: patchFile, patch: patch, caves: caves}
+}
+
+func (p *QtStringPatch) Run(file *os.File) (err error) {
+	p.report = nil
+
+	if p.patch.QtVersion != 0 && p.patch.QtVersion != 5 && p.patch.QtVersion != 6 {
+		err = fmt.Errorf("unsupported Qt version: %d", p.patch.QtVersion)
+		return
+	}
+
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	img, err := parseImage(data)
+	if err != nil {
+		return
+	}
+
+	found, skipped := findQtStrings(img, p.patch.OldString, p.patch.QtVersion)
+	if len(found) == 0 {
+		err = fmt.Errorf("no QStringLiteral holding %q found (%d other UTF-16 occurrence(s))", p.patch.OldString, skipped)
+		return
+	}
+
+	newText := encodeUTF16LE(p.patch.NewString)
+	newUnits := len(newText)/2 - 1
+	for _, s := range found {
+		var line string
+		if s.version == 5 {
+			line, err = p.rewriteQt5(img, s, newText, newUnits)
+		} else {
+			line, err = p.rewriteQt6(img, s, newText, newUnits)
+		}
+		if err != nil {
+			err = fmt.Errorf("Qt %d literal at 0x%X: %w", s.version, s.offset, err)
+			return
+		}
+		p.report = append(p.report, fmt.Sprintf("0x%X (Qt %d): %s", s.offset, s.version, line))
+	}
+	if skipped > 0 {
+		p.report = append(p.report, fmt.Sprintf("skipped %d UTF-16 occurrence(s) that are not QStringLiterals", skipped))
+	}
+
+	if err = rewriteWholeFile(file, data); err != nil {
+		return
+	}
+
+	return
+}
+
+// rewriteQt5 rewrites the text and the header's size field in place, or
+// copies both to a code cave and retargets the references to the header.
+func (p *QtStringPatch) rewriteQt5(img *image, s qtString, newText []byte, newUnits int) (line string, err error) {
+	if newUnits <= s.units {
+		writeQtText(img, s, newText)
+		binary.LittleEndian.PutUint32(img.data[s.header+4:], uint32(newUnits))
+		line = "in-place rewrite"
+		return
+	}
+
+	headerAddress, ok := img.offsetToAddress(s.header)
+	if !ok {
+		err = errors.New("literal is not inside a mapped section")
+		return
+	}
+	refs := findReferences(img, headerAddress)
+	if len(refs) == 0 {
+		err = errors.New("new string does not fit in place and no references to the literal were found")
+		return
+	}
+
+	headerSize := qt5StringHeaderSize(img.is64)
+	alignment := int64(4)
+	if img.is64 {
+		alignment = 8
+	}
+	c, err := p.caves.allocate(img, caveRequest{size: headerSize + int64(len(newText)), alignment: alignment})
+	if err != nil {
+		return
+	}
+	copy(img.data[c.offset:], img.data[s.header:s.offset])
+	binary.LittleEndian.PutUint32(img.data[c.offset+4:], uint32(newUnits))
+	copy(img.data[c.offset+headerSize:], newText)
+
+	for _, ref := range refs {
+		if err = ref.retarget(img.data, c.address); err != nil {
+			return
+		}
+	}
+
+	line = fmt.Sprintf("relocated to %s, retargeted %d reference(s)", c, len(refs))
+	return
+}
+
+// rewriteQt6 rewrites the text in place or in a code cave, and the size
+// immediate next to every reference. Each reference must have exactly one.
+func (p *QtStringPatch) rewriteQt6(img *image, s qtString, newText []byte, newUnits int) (line string, err error) {
+	address, ok := img.offsetToAddress(s.offset)
+	if !ok {
+		err = errors.New("literal is not inside a mapped section")
+		return
+	}
+	refs := findReferences(img, address)
+	if len(refs) == 0 {
+		err = errors.New("no references to the literal were found, so its size cannot be updated")
+		return
+	}
+
+	var immediates []lengthImmediate
+	for _, ref := range refs {
+		// Pointers in data, unlike rel32 and 32-bit abs32 operands in code, have no size immediate
+		if section, ok := img.sectionAtOffset(ref.offset); !ok || !section.executable {
+			err = fmt.Errorf("%s reference at 0x%X is not in code and has no size immediate", ref.kind, ref.offset)
+			return
+		}
+		found := findLengthImmediates(img, ref, uint32(s.units))
+		if len(found) != 1 {
+			err = fmt.Errorf("found %d size immediates next to the reference at 0x%X, expected 1", len(found), ref.offset)
+			return
+		}
+		immediates = append(immediates, found[0])
+	}
+
+	if newUnits <= s.units {
+		writeQtText(img, s, newText)
+		line = "in-place rewrite"
+	} else {
+		var c cave
+		if c, err = p.caves.allocate(img, caveRequest{size: int64(len(newText)), alignment: 2}); err != nil {
+			return
+		}
+		copy(img.data[c.offset:], newText)
+		for _, ref := range refs {
+			if err = ref.retarget(img.data, c.address); err != nil {
+				return
+			}
+		}
+		line = fmt.Sprintf("relocated to %s, retargeted %d reference(s)", c, len(refs))
+	}
+
+	for _, imm := range immediates {
+		if err = imm.write(img.data, uint32(newUnits)); err != nil {
+			return
+		}
+	}
+	line += fmt.Sprintf(", updated %d size immediate(s)", len(immediates))
+	return
+}
+
+// writeQtText overwrites a literal's text with a shorter or equal one,
+// clearing the rest along with the old terminator.
+func writeQtText(img *image, s qtString, newText []byte) {
+	end := s.offset + int64(s.units+1)*2
+	copy(img.data[s.offset:], newText)
+	clear(img.data[s.offset+int64(len(newText)) : end])
+}
+
+func (p *QtStringPatch) Name() string {
+	return p.patch.Name
+}
+
+func (p *QtStringPatch) Report() []string {
+	return p.report
+}
@@ -0,0 +1,247 @@
+package patch
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// referenceKind describes how an instruction or pointer encodes an address.
+type referenceKind int
+
+const (
+	// referenceRel32 is a RIP-relative 32-bit displacement (x86-64 LEA)
+	referenceRel32 referenceKind = iota
+
+	// referenceAbs32 is an absolute 32-bit virtual address (x86 PUSH/MOV/LEA, pointer tables)
+	referenceAbs32
+
+	// referenceAbs64 is an absolute 64-bit virtual address (pointer tables)
+	referenceAbs64
+)
+
+func (k referenceKind) String() string {
+	switch k {
+	case referenceRel32:
+		return "rel32"
+	case referenceAbs32:
+		return "abs32"
+	case referenceAbs64:
+		return "abs64"
+	}
+	return "unknown"
+}
+
+// size returns the number of bytes used to encode the reference.
+func (k referenceKind) size() int {
+	if k == referenceAbs64 {
+		return 8
+	}
+	return 4
+}
+
+func parseReferenceKind(kind string) (k referenceKind, err error) {
+	switch kind {
+	case "rel32":
+		k = referenceRel32
+	case "abs32":
+		k = referenceAbs32
+	case "abs64":
+		k = referenceAbs64
+	default:
+		err = fmt.Errorf("unknown reference kind: %s", kind)
+	}
+	return
+}
+
+// reference is a location in the file that refers to a virtual address.
+type reference struct {
+	kind referenceKind
+
+	// offset is the raw file offset of the encoded address
+	offset int64
+
+	// next is the address a rel32 displacement is relative to, i.e. the
+	// address of the byte following the instruction.
+	next uint64
+}
+
+// findReferences scans the image for code and data that refer to the given virtual address.
+func findReferences(img *image, target uint64) (refs []reference) {
+	for _, s := range img.sections {
+		data := img.data[s.offset : s.offset+s.mappedSize()]
+
+		switch {
+		case s.executable && !img.x86:
+			// Only x86 and x86-64 instructions are decoded
+			continue
+		case s.executable && img.is64:
+			// lea r64, [rip+disp32]: [REX] 8D modrm(00 reg 101) disp32
+			for i := 2; i+4 <= len(data); i++ {
+				if data[i-2] != 0x8D || data[i-1]&0xC7 != 0x05 {
+					continue
+				}
+				next := s.address + uint64(i) + 4
+				disp := int32(binary.LittleEndian.Uint32(data[i:]))
+				if next+uint64(int64(disp)) == target {
+					refs = append(refs, reference{kind: referenceRel32, offset: s.offset + int64(i), next: next})
+				}
+			}
+		case s.executable:
+			for i := 1; i+4 <= len(data); i++ {
+				if binary.LittleEndian.Uint32(data[i:]) == uint32(target) && isAbs32Operand(data, i) {
+					refs = append(refs, reference{kind: referenceAbs32, offset: s.offset + int64(i)})
+				}
+			}
+		case img.is64:
+			// In position-independent ELF images this also finds the addends
+			// of R_X86_64_RELATIVE relocations in .rela.dyn, which hold the
+			// pointers the loader writes into pointer tables
+			for i := alignmentPadding(s.address, 8); i+8 <= len(data); i += 8 {
+				if binary.LittleEndian.Uint64(data[i:]) == target {
+					refs = append(refs, reference{kind: referenceAbs64, offset: s.offset + int64(i)})
+				}
+			}
+		default:
+			for i := alignmentPadding(s.address, 4); i+4 <= len(data); i += 4 {
+				if binary.LittleEndian.Uint32(data[i:]) == uint32(target) {
+					refs = append(refs, reference{kind: referenceAbs32, offset: s.offset + int64(i)})
+				}
+			}
+		}
+	}
+
+	return
+}
+
+// isAbs32Operand reports whether the 4 bytes at code[i] look like the address
+// operand of an x86 instruction that loads an address.
+func isAbs32Operand(code []byte, i int) bool {
+	switch {
+	// push imm32
+	case code[i-1] == 0x68:
+		return true
+	// mov r32, imm32
+	case code[i-1] >= 0xB8 && code[i-1] <= 0xBF:
+		return true
+	// lea r32, [disp32]
+	case i >= 2 && code[i-2] == 0x8D && code[i-1]&0xC7 == 0x05:
+		return true
+	// mov dword [ebp+disp8], imm32
+	case i >= 3 && code[i-3] == 0xC7 && code[i-2] == 0x45:
+		return true
+	// mov dword [esp+disp8], imm32
+	case i >= 4 && code[i-4] == 0xC7 && code[i-3] == 0x44 && code[i-2] == 0x24:
+		return true
+	}
+	return false
+}
+
+// retarget rewrites a reference so that it refers to the given address.
+func (r *reference) retarget(data []byte, address uint64) (err error) {
+	switch r.kind {
+	case referenceRel32:
+		disp := int64(address) - int64(r.next)
+		if disp != int64(int32(disp)) {
+			err = fmt.Errorf("address 0x%X is out of rel32 range of reference at 0x%X", address, r.offset)
+			return
+		}
+		binary.LittleEndian.PutUint32(data[r.offset:], uint32(int32(disp)))
+	case referenceAbs32:
+		if address > 0xFFFFFFFF {
+			err = fmt.Errorf("address 0x%X does not fit in abs32 reference at 0x%X", address, r.offset)
+			return
+		}
+		binary.LittleEndian.PutUint32(data[r.offset:], uint32(address))
+	case referenceAbs64:
+		binary.LittleEndian.PutUint64(data[r.offset:], address)
+	}
+	return
+}
+
+// lengthImmediate is an instruction immediate holding a string length.
+type lengthImmediate struct {
+	offset int64
+	width  int
+}
+
+// findLengthImmediates searches the instructions surrounding a reference for
+// immediates equal to the given length, as emitted for Qt and std::string_view
+// style strings whose length is passed alongside the pointer.
+func findLengthImmediates(img *image, ref reference, length uint32) (found []lengthImmediate) {
+	const window = 24
+
+	section, ok := img.sectionAtOffset(ref.offset)
+	if !ok || !section.executable {
+		return
+	}
+
+	start := max(ref.offset-window, section.offset)
+	end := min(ref.offset+4+window, section.offset+section.mappedSize())
+	code := img.data[:end]
+
+	overlapsReference := func(offset int64, width int) bool {
+		return offset < ref.offset+4 && offset+int64(width) > ref.offset
+	}
+
+	for j := start; j+1 < end; j++ {
+		var imm lengthImmediate
+		switch {
+		// mov r32, imm32
+		case code[j] >= 0xB8 && code[j] <= 0xBF && j+5 <= end:
+			imm = lengthImmediate{offset: j + 1, width: 4}
+		// mov r64, imm32 (sign-extended)
+		case code[j]&0xF8 == 0x48 && j+7 <= end && code[j+1] == 0xC7 && code[j+2]&0xF8 == 0xC0:
+			imm = lengthImmediate{offset: j + 3, width: 4}
+		// mov dword/qword [reg+disp8], imm32, as used to fill in string structures
+		case code[j] == 0xC7 && j+2 < end && code[j+1]&0xF8 == 0x40:
+			imm = lengthImmediate{offset: j + 3, width: 4}
+			if code[j+1]&0x07 == 0x04 {
+				// SIB byte, e.g. [rsp+disp8]
+				imm.offset++
+			}
+			if imm.offset+4 > end {
+				continue
+			}
+		// push imm8
+		case code[j] == 0x6A:
+			imm = lengthImmediate{offset: j + 1, width: 1}
+		default:
+			continue
+		}
+
+		if overlapsReference(imm.offset, imm.width) {
+			continue
+		}
+
+		var value uint32
+		if imm.width == 1 {
+			value = uint32(code[imm.offset])
+		} else {
+			value = binary.LittleEndian.Uint32(code[imm.offset:])
+		}
+		if value == length {
+			found = append(found, imm)
+		}
+	}
+
+	return
+}
+
+// write stores a new length into the immediate.
+func (imm *lengthImmediate) write(data []byte, length uint32) (err error) {
+	if imm.width == 1 {
+		if length > 0x7F {
+			err = fmt.Errorf("length %d does not fit in imm8 at 0x%X", length, imm.offset)
+			return
+		}
+		data[imm.offset] = byte(length)
+		return
+	}
+	binary.LittleEndian.PutUint32(data[imm.offset:], length)
+	return
+}
+
+// alignmentPadding returns the number of bytes needed to align address up to alignment.
+func alignmentPadding(address uint64, alignment uint64) int {
+	return int((alignment - address%alignment) % alignment)
+}
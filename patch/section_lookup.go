@@ -0,0 +1,72 @@
+package patch
+
+import (
+	"fmt"
+	"github.com/renorris/openfsd-client-patch-utility/patchfile"
+	"os"
+	"slices"
+)
+
+// SectionLookupPatch fills in the raw offset and virtual start of sections
+// declared in the patchfile by name only, e.g. .rodata, from the section
+// headers of the target binary. ELF segments can be named LOAD0, LOAD1, ...
+// in the order of their program headers. Mach-O sections are named
+// segment,section as in __TEXT,__cstring, and segments as in __DATA.
+type SectionLookupPatch struct {
+	patchFile *patchfile.PatchFile
+	report    []string
+}
+
+func NewSectionLookupPatch(patchFile *patchfile.PatchFile) *SectionLookupPatch {
+	return &SectionLookupPatch{patchFile: patchFile}
+}
+
+func (p *SectionLookupPatch) Run(file *os.File) (err error) {
+	p.report = nil
+
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	img, err := parseImage(data)
+	if err != nil {
+		return
+	}
+
+	for i := range p.patchFile.Sections {
+		section := &p.patchFile.Sections[i]
+		if !section.Unresolved() {
+			continue
+		}
+
+		found, ok := img.findSection(section.Name)
+		if !ok {
+			err = fmt.Errorf("the target file has no section named %s", section.Name)
+			return
+		}
+		section.RawOffset = found.offset
+		section.VirtualStart = int64(found.address)
+		p.report = append(p.report, fmt.Sprintf("%s: raw offset 0x%X, virtual start 0x%X", section.Name, section.RawOffset, section.VirtualStart))
+	}
+
+	return
+}
+
+// findSection returns the section, or ELF or Mach-O segment, with the given name.
+func (img *image) findSection(name string) (section imageSection, ok bool) {
+	for _, s := range slices.Concat(img.sections, img.segments) {
+		if s.name == name {
+			return s, true
+		}
+	}
+	return
+}
+
+func (p *SectionLookupPatch) Name() string {
+	return "Locate sections"
+}
+
+func (p *SectionLookupPatch) Report() []string {
+	return p.report
+}
@@ -0,0 +1,58 @@
+package patch
+
+import (
+	"github.com/renorris/openfsd-client-patch-utility/patchfile"
+	"os"
+)
+
+type SectionReferencePatch struct {
+	patchFile *patchfile.PatchFile
+	patch     *patchfile.SectionReferencePatch
+}
+
+func NewSectionReferencePatch(patchFile *patchfile.PatchFile, patch *patchfile.SectionReferencePatch) *SectionReferencePatch {
+	return &SectionReferencePatch{patchFile, patch}
+}
+
+func (p *SectionReferencePatch) Run(file *os.File) (err error) {
+	section, err := p.patchFile.GetSection(p.patch.Section)
+	if err != nil {
+		return
+	}
+
+	targetSection, err := p.patchFile.GetSection(p.patch.TargetSection)
+	if err != nil {
+		return
+	}
+
+	kind, err := parseReferenceKind(p.patch.Kind)
+	if err != nil {
+		return
+	}
+
+	ref := reference{kind: kind}
+	if kind == referenceRel32 {
+		instructionEnd := p.patch.InstructionEnd
+		if instructionEnd == 0 {
+			instructionEnd = p.patch.SectionAddress + 4
+		}
+		ref.next = uint64(section.AddressOf(instructionEnd))
+	}
+
+	encoded := make([]byte, kind.size())
+	if err = ref.retarget(encoded, uint64(targetSection.AddressOf(p.patch.TargetAddress))); err != nil {
+		return
+	}
+
+	rawOffset := section.RawOffset + (p.patch.SectionAddress - section.VirtualStart)
+
+	if _, err = file.WriteAt(encoded, rawOffset); err != nil {
+		return
+	}
+
+	return
+}
+
+func (p *SectionReferencePatch) Name() string {
+	return p.patch.Name
+}
@@ -0,0 +1,420 @@
+package patch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/renorris/openfsd-client-patch-utility/patchfile"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// textDocument is a line-oriented text file.
+type textDocument struct {
+	textLayout
+	lines        []string
+	finalNewline bool
+
+	// changes records every line changed, added or removed
+	changes []textJournalChange
+}
+
+// textConfigJournal records the lines a TextConfigPatch changed, in order.
+type textConfigJournal struct {
+	Changes []textJournalChange `json:"changes"`
+}
+
+// textJournalChange is a line before and after patching. Before is nil for
+// added lines and After is nil for removed lines. Line is where it was changed.
+type textJournalChange struct {
+	Line   int     `json:"line"`
+	Before *string `json:"before,omitempty"`
+	After  *string `json:"after,omitempty"`
+}
+
+func parseTextDocument(data []byte) (doc *textDocument) {
+	doc = &textDocument{textLayout: detectTextLayout(data)}
+	text := string(data[doc.contentStart():])
+	if strings.HasSuffix(text, "\n") {
+		doc.finalNewline = true
+		text = strings.TrimSuffix(text, "\n")
+	}
+	if text == "" && !doc.finalNewline {
+		return
+	}
+	for _, line := range strings.Split(text, "\n") {
+		doc.lines = append(doc.lines, strings.TrimSuffix(line, "\r"))
+	}
+	return
+}
+
+func (doc *textDocument) bytes() []byte {
+	var b bytes.Buffer
+	if doc.bom {
+		b.Write(utf8BOM)
+	}
+	b.WriteString(strings.Join(doc.lines, doc.newline))
+	if doc.finalNewline && len(doc.lines) > 0 {
+		b.WriteString(doc.newline)
+	}
+	return b.Bytes()
+}
+
+func (doc *textDocument) setLine(i int, line string) bool {
+	if doc.lines[i] == line {
+		return false
+	}
+	before := doc.lines[i]
+	doc.lines[i] = line
+	doc.changes = append(doc.changes, textJournalChange{Line: i, Before: &before, After: &line})
+	return true
+}
+
+func (doc *textDocument) insertLine(i int, line string) {
+	doc.lines = slices.Insert(doc.lines, i, line)
+	doc.changes = append(doc.changes, textJournalChange{Line: i, After: &line})
+}
+
+func (doc *textDocument) removeLine(i int) {
+	before := doc.lines[i]
+	doc.lines = slices.Delete(doc.lines, i, i+1)
+	doc.changes = append(doc.changes, textJournalChange{Line: i, Before: &before})
+}
+
+// nearestLine returns the index of the line equal to line closest to around, or -1.
+func (doc *textDocument) nearestLine(line string, around int) int {
+	for distance := 0; around-distance >= 0 || around+distance < len(doc.lines); distance++ {
+		if i := around - distance; i >= 0 && i < len(doc.lines) && doc.lines[i] == line {
+			return i
+		}
+		if i := around + distance; i >= 0 && i < len(doc.lines) && doc.lines[i] == line {
+			return i
+		}
+	}
+	return -1
+}
+
+var iniSectionPattern = regexp.MustCompile(`^\s*\[([^\]]*)\]\s*$`)
+
+// TextConfigPatch edits an INI or line-oriented settings file. Operations
+// only change lines that differ from the result, so applying it twice does
+// nothing, and the changes are journaled so that reverting undoes them alone.
+type TextConfigPatch struct {
+	patchFile *patchfile.PatchFile
+	patch     *patchfile.TextConfigPatch
+	report    []string
+}
+
+func NewTextConfigPatch(patchFile *patchfile.PatchFile, patch *patchfile.TextConfigPatch) *TextConfigPatch {
+	return &TextConfigPatch{patchFile: patchFile, patch: patch}
+}
+
+func (p *TextConfigPatch) Run(_ *os.File) (err error) {
+	p.report = nil
+
+	if p.patch.Format != "ini" && p.patch.Format != "lines" {
+		err = fmt.Errorf("unknown format %q", p.patch.Format)
+		return
+	}
+
+	file, err := os.OpenFile(p.path(), os.O_RDWR, 0666)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	doc := parseTextDocument(data)
+	for _, op := range p.patch.Operations {
+		var line string
+		if line, err = p.runOperation(doc, op); err != nil {
+			err = fmt.Errorf("%s %s: %w", op.Op, p.describe(op), err)
+			return
+		}
+		p.report = append(p.report, line)
+	}
+
+	if len(doc.changes) == 0 {
+		return
+	}
+	if err = rewriteWholeFile(file, doc.bytes()); err != nil {
+		return
+	}
+
+	// Changes of an earlier run are kept, as they are still to be reverted
+	journal, err := p.readJournal()
+	if err != nil {
+		return
+	}
+	journal.Changes = append(journal.Changes, doc.changes...)
+	journalData, err := json.MarshalIndent(journal, "", "  ")
+	if err != nil {
+		return
+	}
+	if err = os.WriteFile(p.journalPath(), journalData, 0666); err != nil {
+		return
+	}
+
+	return
+}
+
+func (p *TextConfigPatch) path() string {
+	if filepath.IsAbs(p.patch.File) {
+		return p.patch.File
+	}
+	return filepath.Join(p.patchFile.GetTargetFileDirectory(), p.patch.File)
+}
+
+func (p *TextConfigPatch) journalPath() string {
+	return p.path() + JournalSuffix
+}
+
+func (p *TextConfigPatch) readJournal() (journal textConfigJournal, err error) {
+	journalData, err := os.ReadFile(p.journalPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+
+	if err = json.Unmarshal(journalData, &journal); err != nil {
+		err = fmt.Errorf("invalid journal %s: %w", p.journalPath(), err)
+		return
+	}
+	return
+}
+
+// separator returns the text between keys and values.
+func (p *TextConfigPatch) separator() string {
+	if p.patch.Separator != "" {
+		return p.patch.Separator
+	}
+	if p.patch.Format == "ini" {
+		return "="
+	}
+	return " "
+}
+
+// describe names the lines an operation applies to.
+func (p *TextConfigPatch) describe(op patchfile.TextOperation) string {
+	target := op.Key
+	if op.Pattern != "" {
+		target = "/" + op.Pattern + "/"
+	}
+	if op.Section != "" {
+		target = "[" + op.Section + "] " + target
+	}
+	return target
+}
+
+// sectionRange returns the lines of an INI section, after its header. The
+// lines before the first header form the unnamed section, as do all the lines
+// of a line-oriented file.
+func (p *TextConfigPatch) sectionRange(doc *textDocument, section string) (start int, end int, found bool) {
+	if p.patch.Format != "ini" {
+		return 0, len(doc.lines), true
+	}
+
+	start, end = -1, len(doc.lines)
+	if section == "" {
+		start, found = 0, true
+	}
+	for i, line := range doc.lines {
+		match := iniSectionPattern.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		if found {
+			end = i
+			break
+		}
+		if strings.TrimSpace(match[1]) == section {
+			start, found = i+1, true
+		}
+	}
+	if !found {
+		return 0, 0, false
+	}
+	return
+}
+
+// valueStart returns where the value of a line starts if the line holds key.
+func (p *TextConfigPatch) valueStart(line string, key string) (start int, ok bool) {
+	separator := p.separator()
+	if p.patch.Format != "ini" {
+		if line == key {
+			// A bare key, without separator or value
+			return len(key), true
+		}
+		return len(key) + len(separator), strings.HasPrefix(line, key+separator)
+	}
+
+	trimmed := strings.TrimSpace(line)
+	if strings.HasPrefix(trimmed, ";") || strings.HasPrefix(trimmed, "#") {
+		return
+	}
+	i := strings.Index(line, separator)
+	if i < 0 || strings.TrimSpace(line[:i]) != key {
+		return
+	}
+	start = i + len(separator)
+	for start < len(line) && (line[start] == ' ' || line[start] == '\t') {
+		start++
+	}
+	return start, true
+}
+
+func (p *TextConfigPatch) runOperation(doc *textDocument, op patchfile.TextOperation) (line string, err error) {
+	if op.Section != "" && p.patch.Format != "ini" {
+		err = errors.New("sections are only supported in ini files")
+		return
+	}
+
+	var pattern *regexp.Regexp
+	if op.Pattern != "" {
+		if pattern, err = regexp.Compile(op.Pattern); err != nil {
+			return
+		}
+	}
+	matches := func(line string) bool {
+		if pattern != nil {
+			return pattern.MatchString(line)
+		}
+		_, ok := p.valueStart(line, op.Key)
+		return ok
+	}
+
+	description := op.Op + " " + p.describe(op)
+	start, end, found := p.sectionRange(doc, op.Section)
+
+	switch op.Op {
+	case "set":
+		if op.Key == "" {
+			err = errors.New("set needs a key")
+			return
+		}
+		newLine := op.Key + p.separator() + op.Value
+
+		if !found {
+			if len(doc.lines) > 0 && strings.TrimSpace(doc.lines[len(doc.lines)-1]) != "" {
+				doc.insertLine(len(doc.lines), "")
+			}
+			doc.insertLine(len(doc.lines), "["+op.Section+"]")
+			doc.insertLine(len(doc.lines), newLine)
+			return description + ": added with its section", nil
+		}
+
+		for i := start; i < end; i++ {
+			if valueStart, ok := p.valueStart(doc.lines[i], op.Key); ok {
+				prefix := doc.lines[i][:valueStart]
+				if doc.lines[i] == op.Key {
+					prefix += p.separator()
+				}
+				if doc.setLine(i, prefix+op.Value) {
+					return description + ": changed", nil
+				}
+				return description + ": already set", nil
+			}
+		}
+
+		// New keys go after the last line of the section that is not blank
+		at := end
+		for at > start && strings.TrimSpace(doc.lines[at-1]) == "" {
+			at--
+		}
+		doc.insertLine(at, newLine)
+		return description + ": added", nil
+	case "remove":
+		if op.Key == "" && pattern == nil {
+			err = errors.New("remove needs a key or a pattern")
+			return
+		}
+		removed := 0
+		for i := end - 1; found && i >= start; i-- {
+			if matches(doc.lines[i]) {
+				doc.removeLine(i)
+				removed++
+			}
+		}
+		return fmt.Sprintf("%s: removed %d line(s)", description, removed), nil
+	case "replace":
+		if pattern == nil {
+			err = errors.New("replace needs a pattern")
+			return
+		}
+		replaced := 0
+		for i := start; found && i < end; i++ {
+			if pattern.MatchString(doc.lines[i]) && doc.setLine(i, pattern.ReplaceAllString(doc.lines[i], op.Replacement)) {
+				replaced++
+			}
+		}
+		return fmt.Sprintf("%s: replaced %d line(s)", description, replaced), nil
+	default:
+		err = fmt.Errorf("unknown operation %q", op.Op)
+		return
+	}
+}
+
+// Revert undoes the journaled changes, newest first. Lines the user changed
+// since are left alone.
+func (p *TextConfigPatch) Revert() (files []string, err error) {
+	journal, err := p.readJournal()
+	if err != nil || journal.Changes == nil {
+		return
+	}
+
+	file, err := os.OpenFile(p.path(), os.O_RDWR, 0666)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	doc := parseTextDocument(data)
+	for _, change := range slices.Backward(journal.Changes) {
+		switch {
+		case change.After == nil:
+			doc.insertLine(min(change.Line, len(doc.lines)), *change.Before)
+		case change.Before == nil:
+			if i := doc.nearestLine(*change.After, change.Line); i >= 0 {
+				doc.removeLine(i)
+			}
+		default:
+			if i := doc.nearestLine(*change.After, change.Line); i >= 0 {
+				doc.setLine(i, *change.Before)
+			}
+		}
+	}
+
+	if err = rewriteWholeFile(file, doc.bytes()); err != nil {
+		return
+	}
+	if err = os.Remove(p.journalPath()); err != nil {
+		return
+	}
+
+	files = append(files, p.path())
+	return
+}
+
+func (p *TextConfigPatch) Name() string {
+	return p.patch.Name
+}
+
+func (p *TextConfigPatch) Report() []string {
+	return p.report
+}
@@ -0,0 +1,176 @@
+package patch
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/renorris/openfsd-client-patch-utility/patchfile"
+)
+
+var textConfigTests = []struct {
+	name   string
+	input  string
+	patch  patchfile.TextConfigPatch
+	output string
+}{
+	{
+		name:  "ini set keeps BOM, CRLF and spacing",
+		input: "\ufeff; settings\r\n[Network]\r\nServer = old\r\nPort=6809\r\n",
+		patch: patchfile.TextConfigPatch{Format: "ini", Operations: []patchfile.TextOperation{
+			{Op: "set", Section: "Network", Key: "Server", Value: "fsd.example.com"},
+			{Op: "set", Section: "Network", Key: "Port", Value: "6809"},
+		}},
+		output: "\ufeff; settings\r\n[Network]\r\nServer = fsd.example.com\r\nPort=6809\r\n",
+	},
+	{
+		name:  "ini set adds keys and sections",
+		input: "[A]\nx=1\n\n[B]\ny=2\n",
+		patch: patchfile.TextConfigPatch{Format: "ini", Operations: []patchfile.TextOperation{
+			{Op: "set", Section: "A", Key: "z", Value: "3"},
+			{Op: "set", Section: "C", Key: "w", Value: "4"},
+		}},
+		output: "[A]\nx=1\nz=3\n\n[B]\ny=2\n\n[C]\nw=4\n",
+	},
+	{
+		name:  "ini section limits the operation",
+		input: "[A]\nkey=1\n[B]\nkey=2\n;key=3\n",
+		patch: patchfile.TextConfigPatch{Format: "ini", Operations: []patchfile.TextOperation{
+			{Op: "set", Section: "B", Key: "key", Value: "4"},
+			{Op: "remove", Section: "A", Key: "key"},
+		}},
+		output: "[A]\n[B]\nkey=4\n;key=3\n",
+	},
+	{
+		name:  "lines with tab separator and bare key",
+		input: "SERVER\told\nDEBUG\nNAME\tx",
+		patch: patchfile.TextConfigPatch{Format: "lines", Separator: "\t", Operations: []patchfile.TextOperation{
+			{Op: "set", Key: "SERVER", Value: "fsd.example.com"},
+			{Op: "set", Key: "DEBUG", Value: "0"},
+			{Op: "set", Key: "PORT", Value: "6809"},
+		}},
+		output: "SERVER\tfsd.example.com\nDEBUG\t0\nNAME\tx\nPORT\t6809",
+	},
+	{
+		name:  "remove and replace by pattern",
+		input: "a old.example.org\n# old.example.org mirror\nb old.example.org\n",
+		patch: patchfile.TextConfigPatch{Format: "lines", Operations: []patchfile.TextOperation{
+			{Op: "remove", Pattern: `^#`},
+			{Op: "replace", Pattern: `old\.example\.org$`, Replacement: "fsd.example.com"},
+		}},
+		output: "a fsd.example.com\nb fsd.example.com\n",
+	},
+}
+
+// runTextConfigPatch runs a TextConfigPatch on path and returns the file's contents.
+func runTextConfigPatch(t *testing.T, p *TextConfigPatch, path string) string {
+	t.Helper()
+	if err := p.Run(nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestTextConfigPatch(t *testing.T) {
+	for _, test := range textConfigTests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "config.ini")
+			if err := os.WriteFile(path, []byte(test.input), 0666); err != nil {
+				t.Fatal(err)
+			}
+			definition := test.patch
+			definition.File = path
+			p := NewTextConfigPatch(&patchfile.PatchFile{ExpectedLocation: filepath.Join(dir, "client.exe")}, &definition)
+
+			if output := runTextConfigPatch(t, p, path); output != test.output {
+				t.Fatalf("got:\n%q\nwant:\n%q", output, test.output)
+			}
+			journal, err := os.ReadFile(path + JournalSuffix)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Applying again changes neither the file nor the journal
+			if output := runTextConfigPatch(t, p, path); output != test.output {
+				t.Errorf("second run got:\n%q\nwant:\n%q", output, test.output)
+			}
+			if again, err := os.ReadFile(path + JournalSuffix); err != nil || string(again) != string(journal) {
+				t.Errorf("second run changed the journal:\n%s\nwas:\n%s", again, journal)
+			}
+
+			files, err := p.Revert()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(files, []string{path}) {
+				t.Errorf("Revert() = %v, want [%s]", files, path)
+			}
+			if data, err := os.ReadFile(path); err != nil || string(data) != test.input {
+				t.Errorf("reverted file:\n%q\nwant:\n%q", data, test.input)
+			}
+			if _, err := os.Stat(path + JournalSuffix); !os.IsNotExist(err) {
+				t.Errorf("journal not removed on revert: %v", err)
+			}
+		})
+	}
+}
+
+func TestTextConfigPatchRevertKeepsUserChanges(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.ini")
+	if err := os.WriteFile(path, []byte("[A]\nx=1\ny=2\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	p := NewTextConfigPatch(&patchfile.PatchFile{ExpectedLocation: filepath.Join(dir, "client.exe")}, &patchfile.TextConfigPatch{
+		File: path, Format: "ini", Operations: []patchfile.TextOperation{
+			{Op: "set", Section: "A", Key: "x", Value: "10"},
+			{Op: "set", Section: "A", Key: "y", Value: "20"},
+			{Op: "set", Section: "A", Key: "z", Value: "30"},
+		},
+	})
+	runTextConfigPatch(t, p, path)
+
+	// The user changes a patched line and adds one above the patched lines
+	if err := os.WriteFile(path, []byte("; mine\n[A]\nx=10\ny=25\nz=30\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Revert(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "; mine\n[A]\nx=1\ny=25\n" {
+		t.Errorf("reverted file:\n%q", data)
+	}
+}
+
+func TestTextConfigPatchErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		patch patchfile.TextConfigPatch
+	}{
+		{"unknown format", patchfile.TextConfigPatch{Format: "toml"}},
+		{"section in lines file", patchfile.TextConfigPatch{Format: "lines", Operations: []patchfile.TextOperation{{Op: "set", Section: "A", Key: "x"}}}},
+		{"set without key", patchfile.TextConfigPatch{Format: "ini", Operations: []patchfile.TextOperation{{Op: "set", Value: "x"}}}},
+		{"replace without pattern", patchfile.TextConfigPatch{Format: "ini", Operations: []patchfile.TextOperation{{Op: "replace", Key: "x"}}}},
+		{"invalid pattern", patchfile.TextConfigPatch{Format: "ini", Operations: []patchfile.TextOperation{{Op: "remove", Pattern: "("}}}},
+		{"unknown operation", patchfile.TextConfigPatch{Format: "ini", Operations: []patchfile.TextOperation{{Op: "rename", Key: "x"}}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := runConfigPatch(t, "config.ini", "[A]\nx=1\n", func(patchFile *patchfile.PatchFile, file string) Patch {
+				definition := test.patch
+				definition.File = file
+				return NewTextConfigPatch(patchFile, &definition)
+			})
+			if err == nil {
+				t.Errorf("Run() succeeded, want an error")
+			}
+		})
+	}
+}
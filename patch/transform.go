@@ -0,0 +1,293 @@
+package patch
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/renorris/openfsd-client-patch-utility/patchfile"
+	"hash"
+)
+
+// valueTransform encodes config values the way a client obfuscates them
+// before storing them, and decodes stored values back.
+type valueTransform interface {
+	encode(value string) (encoded string, err error)
+	decode(encoded string) (value string, err error)
+}
+
+// transformFuncs adapts a pair of functions to a valueTransform.
+type transformFuncs struct {
+	encodeFunc func(value string) (string, error)
+	decodeFunc func(encoded string) (string, error)
+}
+
+func (t transformFuncs) encode(value string) (string, error) { return t.encodeFunc(value) }
+
+func (t transformFuncs) decode(encoded string) (string, error) { return t.decodeFunc(encoded) }
+
+// transformRegistry maps transform names to transforms.
+type transformRegistry map[string]valueTransform
+
+// builtinTransforms are available to every patchfile.
+var builtinTransforms = transformRegistry{
+	"plain": transformFuncs{
+		encodeFunc: func(value string) (string, error) { return value, nil },
+		decodeFunc: func(encoded string) (string, error) { return encoded, nil },
+	},
+	"base64": transformFuncs{
+		encodeFunc: func(value string) (string, error) { return base64.StdEncoding.EncodeToString([]byte(value)), nil },
+		decodeFunc: func(encoded string) (string, error) {
+			value, err := base64.StdEncoding.DecodeString(encoded)
+			return string(value), err
+		},
+	},
+	"hex": transformFuncs{
+		encodeFunc: func(value string) (string, error) { return hex.EncodeToString([]byte(value)), nil },
+		decodeFunc: func(encoded string) (string, error) {
+			value, err := hex.DecodeString(encoded)
+			return string(value), err
+		},
+	},
+	"vpilot-3des": transformFuncs{encodeFunc: encodeVPilotField, decodeFunc: decodeVPilotField},
+}
+
+// newTransformRegistry returns the built-in transforms along with those
+// defined in a patchfile, which may not reuse a built-in name.
+func newTransformRegistry(definitions []patchfile.Transform) (registry transformRegistry, err error) {
+	registry = transformRegistry{}
+	for name, t := range builtinTransforms {
+		registry[name] = t
+	}
+
+	for _, definition := range definitions {
+		if definition.Name == "" {
+			err = errors.New("transform has no name")
+			return
+		}
+		if _, exists := registry[definition.Name]; exists {
+			err = fmt.Errorf("transform %s is already defined", definition.Name)
+			return
+		}
+
+		var t valueTransform
+		if t, err = newDefinedTransform(definition); err != nil {
+			err = fmt.Errorf("transform %s: %w", definition.Name, err)
+			return
+		}
+		registry[definition.Name] = t
+	}
+	return
+}
+
+// encode encodes a value with the named transform. No name leaves the value as is.
+func (r transformRegistry) encode(name string, value string) (encoded string, err error) {
+	if name == "" {
+		return value, nil
+	}
+	t, ok := r[name]
+	if !ok {
+		err = fmt.Errorf("unknown transform %q", name)
+		return
+	}
+	return t.encode(value)
+}
+
+// decode decodes a stored value with the named transform.
+func (r transformRegistry) decode(name string, encoded string) (value string, err error) {
+	if name == "" {
+		return encoded, nil
+	}
+	t, ok := r[name]
+	if !ok {
+		err = fmt.Errorf("unknown transform %q", name)
+		return
+	}
+	return t.decode(encoded)
+}
+
+func newDefinedTransform(definition patchfile.Transform) (t valueTransform, err error) {
+	switch definition.Type {
+	case "base64", "hex":
+		return builtinTransforms[definition.Type], nil
+	case "3des-ecb":
+		var key []byte
+		if key, err = hex.DecodeString(definition.Key); err != nil || len(key) != 24 {
+			err = errors.New("3des-ecb needs a 24-byte hex key")
+			return
+		}
+		return newCipherTransform(definition.Output, func(plaintext []byte) ([]byte, error) {
+			return tripleDESEncrypt(plaintext, key)
+		}, func(ciphertext []byte) ([]byte, error) {
+			return tripleDESDecrypt(ciphertext, key)
+		})
+	case "aes-cbc":
+		return newAESCBCTransform(definition)
+	default:
+		err = fmt.Errorf("unknown transform type %q", definition.Type)
+		return
+	}
+}
+
+// newCipherTransform wraps a cipher in a transform that writes ciphertext as
+// base64 or hex text.
+func newCipherTransform(output string, encrypt func([]byte) ([]byte, error), decrypt func([]byte) ([]byte, error)) (t valueTransform, err error) {
+	var text valueTransform
+	switch output {
+	case "", "base64":
+		text = builtinTransforms["base64"]
+	case "hex":
+		text = builtinTransforms["hex"]
+	default:
+		err = fmt.Errorf("unknown output encoding %q", output)
+		return
+	}
+
+	return transformFuncs{
+		encodeFunc: func(value string) (encoded string, err error) {
+			var ciphertext []byte
+			if ciphertext, err = encrypt([]byte(value)); err != nil {
+				return
+			}
+			return text.encode(string(ciphertext))
+		},
+		decodeFunc: func(encoded string) (value string, err error) {
+			var ciphertext string
+			if ciphertext, err = text.decode(encoded); err != nil {
+				return
+			}
+			var plaintext []byte
+			if plaintext, err = decrypt([]byte(ciphertext)); err != nil {
+				return
+			}
+			value = string(plaintext)
+			return
+		},
+	}, nil
+}
+
+// newAESCBCTransform returns an AES-CBC transform with PKCS#7 padding. The key
+// is given or derived with PBKDF2, as done by .NET's Rfc2898DeriveBytes.
+func newAESCBCTransform(definition patchfile.Transform) (t valueTransform, err error) {
+	keySize := definition.KeySize
+	if keySize == 0 {
+		keySize = 32
+	}
+	if keySize != 16 && keySize != 24 && keySize != 32 {
+		err = fmt.Errorf("invalid key size %d", keySize)
+		return
+	}
+
+	var key, iv []byte
+	if definition.IV != "" {
+		if iv, err = hex.DecodeString(definition.IV); err != nil || len(iv) != aes.BlockSize {
+			err = errors.New("iv must be 16 hex-encoded bytes")
+			return
+		}
+	}
+
+	switch {
+	case definition.Key != "":
+		if key, err = hex.DecodeString(definition.Key); err != nil || len(key) != keySize {
+			err = fmt.Errorf("key must be %d hex-encoded bytes", keySize)
+			return
+		}
+	case definition.Password != "":
+		var derived []byte
+		if derived, err = deriveTransformKey(definition, keySize); err != nil {
+			return
+		}
+		key = derived[:keySize]
+		if definition.DeriveIV {
+			iv = derived[keySize:]
+		}
+	default:
+		err = errors.New("aes-cbc needs a key or a password")
+		return
+	}
+	if definition.DeriveIV && definition.Password == "" {
+		err = errors.New("derive_iv needs a password")
+		return
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+
+	return newCipherTransform(definition.Output, func(plaintext []byte) (ciphertext []byte, err error) {
+		var padded []byte
+		if padded, err = pkcs7pad(plaintext, aes.BlockSize); err != nil {
+			return
+		}
+
+		// Without a fixed IV, a random one is stored in front of the ciphertext
+		blockIV := iv
+		if blockIV == nil {
+			blockIV = make([]byte, aes.BlockSize)
+			if _, err = rand.Read(blockIV); err != nil {
+				return
+			}
+			ciphertext = append(ciphertext, blockIV...)
+		}
+
+		encrypted := make([]byte, len(padded))
+		cipher.NewCBCEncrypter(block, blockIV).CryptBlocks(encrypted, padded)
+		ciphertext = append(ciphertext, encrypted...)
+		return
+	}, func(ciphertext []byte) (plaintext []byte, err error) {
+		blockIV := iv
+		if blockIV == nil {
+			if len(ciphertext) < aes.BlockSize {
+				err = errors.New("ciphertext is too short")
+				return
+			}
+			blockIV, ciphertext = ciphertext[:aes.BlockSize], ciphertext[aes.BlockSize:]
+		}
+		if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+			err = errors.New("ciphertext is not a whole number of blocks")
+			return
+		}
+
+		plaintext = make([]byte, len(ciphertext))
+		cipher.NewCBCDecrypter(block, blockIV).CryptBlocks(plaintext, ciphertext)
+		return pkcs7strip(plaintext, aes.BlockSize)
+	})
+}
+
+// deriveTransformKey derives the key, followed by the IV if requested, with PBKDF2.
+func deriveTransformKey(definition patchfile.Transform, keySize int) (derived []byte, err error) {
+	var h func() hash.Hash
+	switch definition.Hash {
+	case "", "sha1":
+		h = sha1.New
+	case "sha256":
+		h = sha256.New
+	default:
+		err = fmt.Errorf("unknown hash %q", definition.Hash)
+		return
+	}
+
+	salt, err := hex.DecodeString(definition.Salt)
+	if err != nil {
+		err = errors.New("salt must be hex-encoded")
+		return
+	}
+
+	iterations := definition.Iterations
+	if iterations == 0 {
+		iterations = 1000
+	}
+
+	length := keySize
+	if definition.DeriveIV {
+		length += aes.BlockSize
+	}
+	return pbkdf2.Key(h, definition.Password, salt, iterations, length)
+}
@@ -0,0 +1,144 @@
+package patch
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/renorris/openfsd-client-patch-utility/patchfile"
+)
+
+func TestTransformRoundTrip(t *testing.T) {
+	registry, err := newTransformRegistry([]patchfile.Transform{
+		{Name: "b64", Type: "base64"},
+		{Name: "3des", Type: "3des-ecb", Key: "000102030405060708090a0b0c0d0e0f1011121314151617"},
+		{Name: "3des-hex", Type: "3des-ecb", Key: "000102030405060708090a0b0c0d0e0f1011121314151617", Output: "hex"},
+		{Name: "aes-key", Type: "aes-cbc", Key: "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"},
+		{Name: "aes-iv", Type: "aes-cbc", Key: "000102030405060708090a0b0c0d0e0f", KeySize: 16, IV: "0f0e0d0c0b0a09080706050403020100"},
+		{Name: "aes-sha1", Type: "aes-cbc", Password: "openfsd", Salt: "73616c74"},
+		{Name: "aes-sha256", Type: "aes-cbc", Password: "openfsd", Salt: "73616c74", Hash: "sha256", Iterations: 10, KeySize: 24},
+		{Name: "aes-derive-iv", Type: "aes-cbc", Password: "openfsd", Salt: "73616c74", DeriveIV: true, Output: "hex"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{"", "plain", "base64", "hex", "vpilot-3des", "b64", "3des", "3des-hex",
+		"aes-key", "aes-iv", "aes-sha1", "aes-sha256", "aes-derive-iv"}
+	values := []string{"", "openfsd", "MAIN|main.example.org", "exactly8", strings.Repeat("ü", 40)}
+	for _, name := range names {
+		for _, value := range values {
+			encoded, err := registry.encode(name, value)
+			if err != nil {
+				t.Errorf("encode(%q, %q): %v", name, value, err)
+				continue
+			}
+			decoded, err := registry.decode(name, encoded)
+			if err != nil {
+				t.Errorf("decode(%q, %q): %v", name, encoded, err)
+				continue
+			}
+			if decoded != value {
+				t.Errorf("%s: round trip of %q gave %q", name, value, decoded)
+			}
+		}
+	}
+}
+
+// The expected values were computed with openssl rather than by this package.
+func TestTransformVectors(t *testing.T) {
+	registry, err := newTransformRegistry([]patchfile.Transform{
+		{Name: "3des", Type: "3des-ecb", Key: "000102030405060708090a0b0c0d0e0f1011121314151617"},
+		{Name: "aes-iv", Type: "aes-cbc", Key: "000102030405060708090a0b0c0d0e0f", KeySize: 16, IV: "0f0e0d0c0b0a09080706050403020100", Output: "hex"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		value   string
+		encoded string
+	}{
+		// Catches a change to the vPilot obfuscation key
+		{"vpilot-3des", "MAIN|main.example.org", "AJ9PnL9TyE0bc+rIDDNsMnbm9VGog/F3"},
+		{"3des", "openfsd", "36A46kNQWtg="},
+		{"aes-iv", "openfsd", "ea1f1b7fc4a3a4a69c7675e2c6ce9317"},
+	}
+	for _, test := range tests {
+		encoded, err := registry.encode(test.name, test.value)
+		if err != nil {
+			t.Errorf("encode(%q, %q): %v", test.name, test.value, err)
+		} else if encoded != test.encoded {
+			t.Errorf("encode(%q, %q) = %q, want %q", test.name, test.value, encoded, test.encoded)
+		}
+
+		value, err := registry.decode(test.name, test.encoded)
+		if err != nil {
+			t.Errorf("decode(%q, %q): %v", test.name, test.encoded, err)
+		} else if value != test.value {
+			t.Errorf("decode(%q, %q) = %q, want %q", test.name, test.encoded, value, test.value)
+		}
+	}
+}
+
+// PBKDF2-HMAC-SHA1 test vector from RFC 6070. The key and derived IV are the
+// first and second part of a single PBKDF2 output.
+func TestDeriveTransformKey(t *testing.T) {
+	derived, err := deriveTransformKey(patchfile.Transform{Password: "password", Salt: "73616c74", Iterations: 1, DeriveIV: true}, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(derived) != 32 {
+		t.Fatalf("derived %d bytes, want 32", len(derived))
+	}
+	if got, want := hex.EncodeToString(derived[:20]), "0c60c80f961f0e71f3a9b524af6012062fe037a6"; got != want {
+		t.Errorf("derived %s, want %s", got, want)
+	}
+}
+
+func TestTransformDecodeErrors(t *testing.T) {
+	registry, err := newTransformRegistry([]patchfile.Transform{
+		{Name: "3des", Type: "3des-ecb", Key: "000102030405060708090a0b0c0d0e0f1011121314151617"},
+		{Name: "aes", Type: "aes-cbc", Key: "000102030405060708090a0b0c0d0e0f", KeySize: 16, IV: "0f0e0d0c0b0a09080706050403020100"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{"vpilot-3des", "QUJD"},
+		{"vpilot-3des", ""},
+		{"vpilot-3des", "not base64"},
+		{"3des", "QUJDREVG"},
+		{"aes", "QUJD"},
+		{"aes", ""},
+		{"hex", "xyz"},
+		{"unknown", "QUJD"},
+	}
+	for _, test := range tests {
+		if value, err := registry.decode(test.name, test.encoded); err == nil {
+			t.Errorf("decode(%q, %q) = %q, want an error", test.name, test.encoded, value)
+		}
+	}
+}
+
+func TestTransformDefinitionErrors(t *testing.T) {
+	tests := []patchfile.Transform{
+		{Type: "base64"},
+		{Name: "base64", Type: "base64"},
+		{Name: "t", Type: "rot13"},
+		{Name: "t", Type: "3des-ecb", Key: "0001"},
+		{Name: "t", Type: "aes-cbc", Key: "000102030405060708090a0b0c0d0e0f", KeySize: 20},
+		{Name: "t", Type: "aes-cbc", Password: "openfsd", Salt: "salt"},
+		{Name: "t", Type: "aes-cbc", Password: "openfsd", Salt: "73616c74", Hash: "md5"},
+	}
+	for _, definition := range tests {
+		if _, err := newTransformRegistry([]patchfile.Transform{definition}); err == nil {
+			t.Errorf("newTransformRegistry(%+v) succeeded, want an error", definition)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package patch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/renorris/openfsd-client-patch-utility/patchfile"
+	"os"
+	"strings"
+)
+
+// URLRedirectPatch replaces every occurrence of a URL in the target file,
+// choosing a strategy for each occurrence based on the space available and
+// the kind of binary it was found in.
+type URLRedirectPatch struct {
+	patchFile *patchfile.PatchFile
+	patch     *patchfile.URLRedirect
+	caves     *CaveAllocator
+	report    []string
+}
+
+func NewURLRedirectPatch(patchFile *patchfile.PatchFile, patch *patchfile.URLRedirect, caves *CaveAllocator) *URLRedirectPatch {
+	return &URLRedirectPatch{patchFile: patchFile, patch: patch, caves: caves}
+}
+
+// stringOccurrence is an occurrence of a string in the raw file.
+type stringOccurrence struct {
+	offset   int64
+	encoding string
+
+	// length is the number of bytes of string data, excluding any terminator
+	length int64
+
+	// units is the number of characters (UTF-16 code units for utf16le)
+	units int
+}
+
+func (p *URLRedirectPatch) Run(file *os.File) (err error) {
+	p.report = nil
+
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	img, err := parseImage(data)
+	if err != nil {
+		return
+	}
+
+	var userstrings *cliStream
+	if header, headerErr := img.cliHeader(); headerErr == nil {
+		userstrings, _ = header.stream("#US")
+	}
+
+	redirected := 0
+	for _, occurrence := range findStringOccurrences(data, p.patch.OldURL) {
+		var line string
+		switch {
+		case userstrings != nil && userstrings.contains(occurrence.offset):
+			line, err = p.rewriteUserstring(img, occurrence)
+		case !isWholeString(data, occurrence):
+			line = "skipped: part of a longer string"
+		default:
+			line, err = p.rewriteNative(img, occurrence)
+		}
+		if err != nil {
+			err = fmt.Errorf("occurrence at 0x%X (%s): %w", occurrence.offset, occurrence.encoding, err)
+			return
+		}
+
+		p.report = append(p.report, fmt.Sprintf("0x%X (%s): %s", occurrence.offset, occurrence.encoding, line))
+		if !strings.HasPrefix(line, "skipped") {
+			redirected++
+		}
+	}
+
+	if redirected == 0 {
+		err = fmt.Errorf("no redirectable occurrences of %s found", p.patch.OldURL)
+		return
+	}
+
+	if _, err = file.WriteAt(data, 0); err != nil {
+		return
+	}
+
+	return
+}
+
+// rewriteUserstring rewrites a #US heap entry in place.
+func (p *URLRedirectPatch) rewriteUserstring(img *image, occurrence stringOccurrence) (line string, err error) {
+	if occurrence.encoding != "utf16le" {
+		line = "skipped: not a UTF-16 user string"
+		return
+	}
+
+	// Find the length header preceding the string data
+	entryOffset := int64(-1)
+	for _, headerSize := range []int64{1, 2, 4} {
+		start := occurrence.offset - headerSize
+		if start < 0 {
+			continue
+		}
+		var header [4]byte
+		copy(header[:], img.data[start:])
+		length, decodedSize, decodeErr := decodeLength(header)
+		if decodeErr == nil && int64(decodedSize) == headerSize && int64(length) == occurrence.length+1 {
+			entryOffset = start
+			break
+		}
+	}
+	if entryOffset < 0 {
+		line = "skipped: part of a longer user string"
+		return
+	}
+
+	encoded, err := encodeUserString(p.patch.NewURL)
+	if err != nil {
+		return
+	}
+
+	capacity := occurrence.offset + occurrence.length + 1 - entryOffset
+	if int64(len(encoded)) > capacity {
+		err = fmt.Errorf("new URL does not fit in the existing #US entry (%d > %d bytes)", len(encoded), capacity)
+		return
+	}
+
+	// Zero bytes decode as empty entries, which keeps the heap walkable.
+	copy(img.data[entryOffset:], encoded)
+	clear(img.data[entryOffset+int64(len(encoded)) : entryOffset+capacity])
+
+	line = "#US rewrite"
+	return
+}
+
+// rewriteNative rewrites a NULL-terminated string in place when the new string
+// fits, and otherwise relocates it and retargets its references.
+func (p *URLRedirectPatch) rewriteNative(img *image, occurrence stringOccurrence) (line string, err error) {
+	newBytes := encodeString(p.patch.NewURL, occurrence.encoding)
+	terminatorSize := int64(1)
+	if occurrence.encoding == "utf16le" {
+		terminatorSize = 2
+	}
+	newUnits := len(newBytes) / int(terminatorSize)
+
+	oldAddress, ok := img.offsetToAddress(occurrence.offset)
+	if !ok {
+		err = errors.New("occurrence is not inside a mapped section")
+		return
+	}
+	refs := findReferences(img, oldAddress)
+
+	capacity := occurrence.length + terminatorSize
+	if int64(len(newBytes))+terminatorSize <= capacity {
+		copy(img.data[occurrence.offset:], newBytes)
+		clear(img.data[occurrence.offset+int64(len(newBytes)) : occurrence.offset+capacity])
+		line = "in-place padded rewrite"
+	} else {
+		if len(refs) == 0 {
+			err = errors.New("new URL does not fit in place and no references to the string were found")
+			return
+		}
+
+		var c cave
+		if c, err = p.caves.allocate(img, caveRequest{
+			size:      int64(len(newBytes)) + terminatorSize,
+			alignment: terminatorSize,
+		}); err != nil {
+			return
+		}
+		copy(img.data[c.offset:], newBytes)
+
+		for _, ref := range refs {
+			if err = ref.retarget(img.data, c.address); err != nil {
+				return
+			}
+		}
+
+		line = fmt.Sprintf("relocated to %s, retargeted %d reference(s)", c, len(refs))
+	}
+
+	if p.patch.AdjustLengths && newUnits != occurrence.units {
+		line += p.adjustLengths(img, refs, uint32(occurrence.units), uint32(newUnits))
+	}
+
+	return
+}
+
+// adjustLengths rewrites length immediates next to each rel32 reference.
+func (p *URLRedirectPatch) adjustLengths(img *image, refs []reference, oldLength uint32, newLength uint32) (summary string) {
+	adjusted, ambiguous := 0, 0
+	for _, ref := range refs {
+		if ref.kind != referenceRel32 {
+			continue
+		}
+		immediates := findLengthImmediates(img, ref, oldLength)
+		if len(immediates) != 1 {
+			ambiguous++
+			continue
+		}
+		if err := immediates[0].write(img.data, newLength); err != nil {
+			ambiguous++
+			continue
+		}
+		adjusted++
+	}
+
+	summary = fmt.Sprintf(", adjusted %d length immediate(s)", adjusted)
+	if ambiguous > 0 {
+		summary += fmt.Sprintf(" (%d reference(s) left unadjusted: no unique length immediate found)", ambiguous)
+	}
+	return
+}
+
+func (p *URLRedirectPatch) Name() string {
+	if p.patch.Name != "" {
+		return p.patch.Name
+	}
+	return fmt.Sprintf("Redirect %s", p.patch.OldURL)
+}
+
+func (p *URLRedirectPatch) Report() []string {
+	return p.report
+}
+
+// findStringOccurrences finds every UTF-8 and UTF-16LE occurrence of str in data.
+func findStringOccurrences(data []byte, str string) (occurrences []stringOccurrence) {
+	for _, encoding := range []string{"utf8", "utf16le"} {
+		needle := encodeString(str, encoding)
+		units := len(needle)
+		if encoding == "utf16le" {
+			units /= 2
+		}
+
+		for start := 0; ; {
+			i := bytes.Index(data[start:], needle)
+			if i < 0 {
+				break
+			}
+			occurrences = append(occurrences, stringOccurrence{
+				offset:   int64(start + i),
+				encoding: encoding,
+				length:   int64(len(needle)),
+				units:    units,
+			})
+			start += i + 1
+		}
+	}
+	return
+}
+
+// isWholeString reports whether an occurrence is a complete NULL-terminated
+// string rather than a fragment of a longer one.
+func isWholeString(data []byte, occurrence stringOccurrence) bool {
+	unitSize := int64(1)
+	if occurrence.encoding == "utf16le" {
+		unitSize = 2
+	}
+
+	end := occurrence.offset + occurrence.length
+	if end+unitSize > int64(len(data)) {
+		return false
+	}
+	for _, b := range data[end : end+unitSize] {
+		if b != 0x00 {
+			return false
+		}
+	}
+
+	// The preceding character must not be printable, otherwise the occurrence
+	// is the tail of a longer string.
+	if occurrence.offset >= unitSize {
+		prev := data[occurrence.offset-unitSize : occurrence.offset]
+		if unitSize == 2 && prev[1] != 0x00 {
+			return true
+		}
+		if prev[0] >= 0x20 && prev[0] < 0x7F {
+			return false
+		}
+	}
+
+	return true
+}
+
+// encodeString encodes a string without a terminator.
+func encodeString(str string, encoding string) []byte {
+	if encoding == "utf16le" {
+		buf := encodeUTF16LE(str)
+		return buf[:len(buf)-2]
+	}
+	return []byte(str)
+}
@@ -6,8 +6,99 @@ import (
 	"crypto/des"
 	"errors"
 	"fmt"
+	"io"
+	"os"
+	"slices"
 )
 
+// readWholeFile reads the entire contents of a file from its start.
+func readWholeFile(file *os.File) (data []byte, err error) {
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	return io.ReadAll(file)
+}
+
+// rewriteWholeFile replaces the entire contents of a file.
+func rewriteWholeFile(file *os.File, data []byte) (err error) {
+	if err = file.Truncate(0); err != nil {
+		return
+	}
+	if _, err = file.WriteAt(data, 0); err != nil {
+		return
+	}
+	return
+}
+
+// textEdit replaces the bytes between start and end of a text file.
+type textEdit struct {
+	start       int
+	end         int
+	replacement string
+}
+
+// spliceEdits returns data with edits applied, or false if edits overlap.
+func spliceEdits(data []byte, edits []textEdit) (edited []byte, ok bool) {
+	slices.SortFunc(edits, func(a, b textEdit) int { return b.start - a.start })
+	for i := 1; i < len(edits); i++ {
+		if edits[i].end > edits[i-1].start {
+			return
+		}
+	}
+
+	edited = slices.Clone(data)
+	for _, e := range edits {
+		edited = slices.Concat(edited[:e.start], []byte(e.replacement), edited[e.end:])
+	}
+	return edited, true
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// textLayout is the line separator and byte order mark of a text file, which
+// edits to the file keep.
+type textLayout struct {
+	// newline is the line separator used by the file
+	newline string
+
+	// bom is set when the file starts with a UTF-8 byte order mark
+	bom bool
+}
+
+// detectTextLayout returns the layout of a text file. Files that use no CRLF
+// line separators are taken to use LF.
+func detectTextLayout(data []byte) (layout textLayout) {
+	layout.newline = "\n"
+	if bytes.Contains(data, []byte("\r\n")) {
+		layout.newline = "\r\n"
+	}
+	layout.bom = bytes.HasPrefix(data, utf8BOM)
+	return
+}
+
+// contentStart returns where the text of a file starts, after any byte order mark.
+func (layout textLayout) contentStart() int {
+	if layout.bom {
+		return len(utf8BOM)
+	}
+	return 0
+}
+
+// reparseEdits splices edits into data and parses the result into doc. ok is
+// false if edits overlap, in which case doc is left as is.
+func reparseEdits[T any](doc *T, data []byte, edits []textEdit, parse func([]byte) (*T, error)) (ok bool, err error) {
+	if data, ok = spliceEdits(data, edits); !ok {
+		return
+	}
+
+	var parsed *T
+	if parsed, err = parse(data); err != nil {
+		return
+	}
+	*doc = *parsed
+	return
+}
+
 // Decrypts ciphertext using Triple DES in ECB mode
 func tripleDESDecrypt(ciphertext []byte, key []byte) (plaintext []byte, err error) {
 	// Create a new DES cipher
@@ -16,6 +107,11 @@ func tripleDESDecrypt(ciphertext []byte, key []byte) (plaintext []byte, err erro
 		return nil, err
 	}
 
+	// Ciphertext read from a config file may be truncated or not encrypted at all
+	if len(ciphertext) == 0 || len(ciphertext)%block.BlockSize() != 0 {
+		return nil, fmt.Errorf("3des: ciphertext of %d bytes is not a whole number of blocks", len(ciphertext))
+	}
+
 	// Initialize byte array for the plaintext
 	plaintext = make([]byte, len(ciphertext))
 
@@ -81,3 +177,33 @@ func pkcs7pad(data []byte, blockSize int) ([]byte, error) {
 	padding := bytes.Repeat([]byte{byte(padLen)}, padLen)
 	return append(data, padding...), nil
 }
+
+// read7BitEncodedInt reads an integer written by .NET's BinaryWriter.Write7BitEncodedInt.
+func read7BitEncodedInt(data []byte) (value int, size int, err error) {
+	for shift := 0; shift < 35; shift += 7 {
+		if size >= len(data) {
+			err = errors.New("7-bit encoded integer is truncated")
+			return
+		}
+		b := data[size]
+		size++
+		value |= int(b&0x7F) << shift
+		if b&0x80 == 0 {
+			return
+		}
+	}
+	err = errors.New("7-bit encoded integer is too long")
+	return
+}
+
+// appendDotNetString appends a string as written by .NET's BinaryWriter: its
+// UTF-8 length as a 7-bit encoded integer followed by the UTF-8 bytes.
+func appendDotNetString(data []byte, str string) []byte {
+	length := uint32(len(str))
+	for length >= 0x80 {
+		data = append(data, byte(length)|0x80)
+		length >>= 7
+	}
+	data = append(data, byte(length))
+	return append(data, str...)
+}
@@ -1,74 +1,154 @@
 package patch
 
 import (
-	"bytes"
 	"crypto/md5"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"github.com/renorris/openfsd-client-patch-utility/patchfile"
-	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
-	"regexp"
+	"strings"
 )
 
+// VPilotConfigPatch points vPilotConfig.xml at the new network status URL and
+// servers, and clears, preserves or sets the stored CID and password.
 type VPilotConfigPatch struct {
 	patchFile *patchfile.PatchFile
 	patch     *patchfile.VPilotConfigPatch
+	report    []string
 }
 
 func NewVPilotConfigPatch(patchFile *patchfile.PatchFile, patch *patchfile.VPilotConfigPatch) *VPilotConfigPatch {
-	return &VPilotConfigPatch{patchFile, patch}
+	return &VPilotConfigPatch{patchFile: patchFile, patch: patch}
 }
 
-func (p *VPilotConfigPatch) Run(_ *os.File) (err error) {
-	configFilePath := filepath.Join(p.patchFile.GetTargetFileDirectory(), "vPilotConfig.xml")
-	file, err := os.OpenFile(configFilePath, os.O_RDWR, 0666)
+func (p *VPilotConfigPatch) Run(file *os.File) (err error) {
+	p.report = nil
+
+	xmlConfigPatch, err := p.xmlConfigPatch()
 	if err != nil {
 		return
 	}
-	defer file.Close()
 
-	obfuscatedNetworkStatusURL, err := p.obfuscateFieldToBase64([]byte(p.patch.NetworkStatusURL), vPilotConfigObfuscatorKey)
-	if err != nil {
+	if err = p.createMissingConfig(); err != nil {
 		return
 	}
+	configPatch := NewXMLConfigPatch(p.patchFile, xmlConfigPatch)
 
-	var obfuscatedCachedServerList []string
-	for _, cachedServer := range p.patch.CachedServerList {
-		var obfuscatedCachedServer []byte
-		if obfuscatedCachedServer, err = p.obfuscateFieldToBase64(
-			[]byte(cachedServer),
-			vPilotConfigObfuscatorKey,
-		); err != nil {
-			return
-		}
-		obfuscatedCachedServerList = append(obfuscatedCachedServerList, string(obfuscatedCachedServer))
+	if p.patch.CachedServerMode != "merge" {
+		err = configPatch.Run(file)
+		p.report = append(p.report, configPatch.Report()...)
+		return
 	}
 
-	var fileContents bytes.Buffer
-	if _, err = io.Copy(&fileContents, file); err != nil {
+	// The fields are journaled along with the merged servers, so that reverting
+	// restores them too
+	before, err := p.readJournaledFields()
+	if err != nil {
+		return
+	}
+	if err = configPatch.Run(file); err != nil {
 		return
 	}
+	p.report = append(p.report, configPatch.Report()...)
 
-	newFileContents, err := p.replaceXmlFields(fileContents.Bytes(), string(obfuscatedNetworkStatusURL), obfuscatedCachedServerList)
-	if err != nil {
+	return p.mergeCachedServers(before)
+}
+
+// configPath returns the path of vPilotConfig.xml, next to the target file.
+func (p *VPilotConfigPatch) configPath() string {
+	return filepath.Join(p.patchFile.GetTargetFileDirectory(), "vPilotConfig.xml")
+}
+
+// minimalVPilotConfig is the smallest vPilotConfig.xml vPilot loads. Settings
+// that are left out take their default value.
+const minimalVPilotConfig = "\ufeff<?xml version=\"1.0\" encoding=\"utf-8\"?>\r\n" +
+	"<Config xmlns:xsi=\"http://www.w3.org/2001/XMLSchema-instance\" xmlns:xsd=\"http://www.w3.org/2001/XMLSchema\">\r\n" +
+	"  <NetworkStatusURL />\r\n" +
+	"  <CachedServers />\r\n" +
+	"  <NetworkLogin />\r\n" +
+	"  <NetworkPassword />\r\n" +
+	"</Config>\r\n"
+
+// createMissingConfig writes a minimal vPilotConfig.xml when vPilot has not
+// been started yet, so that the settings can be patched into it.
+func (p *VPilotConfigPatch) createMissingConfig() (err error) {
+	if _, err = os.Stat(p.configPath()); !errors.Is(err, fs.ErrNotExist) {
 		return
 	}
 
-	// Erase file
-	if _, err = file.Seek(0, io.SeekStart); err != nil {
+	if err = os.WriteFile(p.configPath(), []byte(minimalVPilotConfig), 0666); err != nil {
 		return
 	}
-	if err = file.Truncate(0); err != nil {
+	p.report = append(p.report, "vPilotConfig.xml does not exist yet, created it")
+	return
+}
+
+// xmlConfigPatch describes the changes to vPilotConfig.xml as XML config operations.
+// Elements missing from the file are left alone, except for credentials being set.
+func (p *VPilotConfigPatch) xmlConfigPatch() (xmlConfigPatch *patchfile.XMLConfigPatch, err error) {
+	names := map[string]bool{}
+	for _, server := range p.patch.CachedServerList {
+		var name string
+		if name, err = parseCachedServer(server); err != nil {
+			return
+		}
+		if names[name] {
+			err = fmt.Errorf("cached server %s is listed more than once", name)
+			return
+		}
+		names[name] = true
+	}
+
+	operations := []patchfile.XMLOperation{
+		{Op: "set", Path: "//NetworkStatusURL", Value: p.patch.NetworkStatusURL, Transform: "vpilot-3des", Optional: true},
+	}
+
+	switch p.patch.CachedServerMode {
+	case "", "replace":
+		operations = append(operations,
+			patchfile.XMLOperation{Op: "clear", Path: "//CachedServers", Optional: true},
+			patchfile.XMLOperation{Op: "append_list", Path: "//CachedServers", Values: p.patch.CachedServerList, Transform: "vpilot-3des", Optional: true},
+		)
+	case "merge":
+	default:
+		err = fmt.Errorf("unknown cached server mode %q", p.patch.CachedServerMode)
 		return
 	}
 
-	// Re-write
-	if _, err = io.Copy(file, bytes.NewReader(newFileContents)); err != nil {
+	switch p.patch.Credentials {
+	case "", "clear":
+		operations = append(operations,
+			patchfile.XMLOperation{Op: "clear", Path: "//NetworkLogin", Optional: true},
+			patchfile.XMLOperation{Op: "clear", Path: "//NetworkPassword", Optional: true},
+		)
+	case "preserve":
+	case "prompt":
+		if p.patch.CID == "" || p.patch.Password == "" {
+			err = errors.New("no openfsd CID and password were given")
+			return
+		}
+		for _, field := range []struct{ name, value string }{
+			{"NetworkLogin", p.patch.CID},
+			{"NetworkPassword", p.patch.Password},
+		} {
+			operations = append(operations,
+				patchfile.XMLOperation{Op: "set", Path: "//" + field.name, Value: field.value, Transform: "vpilot-3des", Optional: true},
+				patchfile.XMLOperation{Op: "create_if_missing", Path: "/Config/" + field.name, Value: field.value, Transform: "vpilot-3des"},
+			)
+		}
+	default:
+		err = fmt.Errorf("unknown credentials mode %q", p.patch.Credentials)
 		return
 	}
 
+	xmlConfigPatch = &patchfile.XMLConfigPatch{
+		Name:       p.Name(),
+		File:       "vPilotConfig.xml",
+		Operations: operations,
+	}
 	return
 }
 
@@ -84,69 +164,106 @@ func generatevPilotConfigObfuscatorKey() []byte {
 	return key
 }
 
-func (p *VPilotConfigPatch) encrypt(plaintext []byte, key []byte) (ciphertext []byte, err error) {
-	return tripleDESEncrypt(plaintext, key)
-}
-
-func (p *VPilotConfigPatch) decrypt(ciphertext []byte, key []byte) (plaintext []byte, err error) {
-	return tripleDESDecrypt(ciphertext, key)
-}
-
-func (p *VPilotConfigPatch) obfuscateFieldToBase64(plaintext []byte, key []byte) (ciphertextBase64 []byte, err error) {
+// encodeVPilotField obfuscates a vPilotConfig.xml field: 3DES-ECB with the
+// vPilot key, then base64.
+func encodeVPilotField(value string) (encoded string, err error) {
 	var ciphertext []byte
-	if ciphertext, err = p.encrypt(plaintext, key); err != nil {
+	if ciphertext, err = tripleDESEncrypt([]byte(value), vPilotConfigObfuscatorKey); err != nil {
 		return
 	}
 
-	ciphertextBase64 = []byte(base64.StdEncoding.EncodeToString(ciphertext))
+	encoded = base64.StdEncoding.EncodeToString(ciphertext)
 	return
 }
 
-func (p *VPilotConfigPatch) deobfuscateFieldFromBase64(ciphertextBase64 []byte, key []byte) (plaintext []byte, err error) {
+// decodeVPilotField reverses encodeVPilotField.
+func decodeVPilotField(encoded string) (value string, err error) {
 	var ciphertext []byte
-	if ciphertext, err = base64.StdEncoding.DecodeString(string(ciphertextBase64)); err != nil {
+	if ciphertext, err = base64.StdEncoding.DecodeString(encoded); err != nil {
 		return
 	}
 
-	if plaintext, err = p.decrypt(ciphertext, key); err != nil {
+	var plaintext []byte
+	if plaintext, err = tripleDESDecrypt(ciphertext, vPilotConfigObfuscatorKey); err != nil {
 		return
 	}
 
+	value = string(plaintext)
 	return
 }
 
-// replaceXmlFields replaces the network status and cached server fields.
-// It clears the NetworkLogin and NetworkPassword fields.
-// The passed fields must be properly obfuscated.
-func (p *VPilotConfigPatch) replaceXmlFields(xmlFileData []byte, networkStatusURL string, cachedServers []string) ([]byte, error) {
-	// Prepare regex patterns to match the relevant XML elements
-	networkStatusURLPattern := regexp.MustCompile(`<NetworkStatusURL>[\s\S]*?</NetworkStatusURL>`)
-	cachedServersPattern := regexp.MustCompile(`<CachedServers>[\s\S]*?</CachedServers>`)
+// VPilotConfigValue is a decoded field of vPilotConfig.xml.
+type VPilotConfigValue struct {
+	Value string
 
-	// Replace NetworkStatusURL with the new value
-	newNetworkStatusURL := fmt.Sprintf("<NetworkStatusURL>%s</NetworkStatusURL>", networkStatusURL)
-	xmlFileData = networkStatusURLPattern.ReplaceAll(xmlFileData, []byte(newNetworkStatusURL))
+	// Missing is set when the file has no such element
+	Missing bool
+
+	// Err is set when the stored value cannot be decoded, in which case Value
+	// holds it as stored
+	Err error
+}
+
+// VPilotConfigInfo holds the decoded network settings of vPilotConfig.xml.
+type VPilotConfigInfo struct {
+	NetworkStatusURL VPilotConfigValue
+	CachedServers    []VPilotConfigValue
+	NetworkLogin     VPilotConfigValue
+	NetworkPassword  VPilotConfigValue
+}
 
-	// Construct the new CachedServers XML
-	cachedServersXML := "<CachedServers>\n"
-	for _, server := range cachedServers {
-		cachedServersXML += fmt.Sprintf("    <string>%s</string>\n", server)
+// InspectVPilotConfig decodes the network settings stored in vPilotConfig.xml.
+func InspectVPilotConfig(file *os.File) (info VPilotConfigInfo, err error) {
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
 	}
-	cachedServersXML += "  </CachedServers>"
 
-	// Replace CachedServers with the new value
-	xmlFileData = cachedServersPattern.ReplaceAll(xmlFileData, []byte(cachedServersXML))
+	doc, err := parseXMLDocument(data)
+	if err != nil {
+		return
+	}
 
-	// Clear CID and password fields
-	networkLoginPattern := regexp.MustCompile(`<NetworkLogin>[\s\S]*?</NetworkLogin>`)
-	networkPasswordPattern := regexp.MustCompile(`<NetworkPassword>[\s\S]*?</NetworkPassword>`)
+	field := func(path string) (value VPilotConfigValue) {
+		p, _ := parseXMLPath(path)
+		selected := doc.selectSteps(p.steps)
+		if len(selected) == 0 {
+			value.Missing = true
+			return
+		}
+		return decodeVPilotConfigValue(selected[0].text)
+	}
+
+	info.NetworkStatusURL = field("//NetworkStatusURL")
+	info.NetworkLogin = field("//NetworkLogin")
+	info.NetworkPassword = field("//NetworkPassword")
 
-	xmlFileData = networkLoginPattern.ReplaceAll(xmlFileData, []byte("<NetworkLogin></NetworkLogin>"))
-	xmlFileData = networkPasswordPattern.ReplaceAll(xmlFileData, []byte("<NetworkPassword></NetworkPassword>"))
+	p, _ := parseXMLPath("//CachedServers/string")
+	for _, e := range doc.selectSteps(p.steps) {
+		info.CachedServers = append(info.CachedServers, decodeVPilotConfigValue(e.text))
+	}
+	return
+}
+
+func decodeVPilotConfigValue(text string) (value VPilotConfigValue) {
+	value.Value = strings.TrimSpace(text)
+	if value.Value == "" {
+		return
+	}
 
-	return xmlFileData, nil
+	decoded, err := decodeVPilotField(value.Value)
+	if err != nil {
+		value.Err = fmt.Errorf("cannot decode: %w", err)
+		return
+	}
+	value.Value = decoded
+	return
 }
 
 func (p *VPilotConfigPatch) Name() string {
 	return "vPilot Config Patch"
 }
+
+func (p *VPilotConfigPatch) Report() []string {
+	return p.report
+}
@@ -0,0 +1,243 @@
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// cachedServerPattern matches a vPilot cached server entry, NAME|host
+var cachedServerPattern = regexp.MustCompile(`^([^|\s][^|]*)\|([A-Za-z0-9.-]+)$`)
+
+// parseCachedServer validates a cached server entry and returns its name.
+func parseCachedServer(server string) (name string, err error) {
+	match := cachedServerPattern.FindStringSubmatch(server)
+	if match == nil {
+		err = fmt.Errorf("invalid cached server %q: expected NAME|host", server)
+		return
+	}
+	name = strings.TrimSpace(match[1])
+	return
+}
+
+// vPilotJournalFields are the fields of vPilotConfig.xml whose changes are
+// journaled in merge mode.
+var vPilotJournalFields = []string{"NetworkStatusURL", "NetworkLogin", "NetworkPassword"}
+
+// vPilotConfigJournal records the changes made to vPilotConfig.xml in merge
+// mode. Values are stored obfuscated, as in the config.
+type vPilotConfigJournal struct {
+	Fields  []vPilotJournalEntry `json:"fields"`
+	Servers []vPilotJournalEntry `json:"servers"`
+}
+
+// vPilotJournalEntry is a value before and after patching. Before is empty
+// for cached servers that were added.
+type vPilotJournalEntry struct {
+	Name   string `json:"name"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// journalPath returns the path of the journal kept next to vPilotConfig.xml.
+func (p *VPilotConfigPatch) journalPath() string {
+	return p.configPath() + JournalSuffix
+}
+
+// readJournaledFields returns the stored values of the journaled fields.
+func (p *VPilotConfigPatch) readJournaledFields() (values map[string]string, err error) {
+	data, err := os.ReadFile(p.configPath())
+	if err != nil {
+		return
+	}
+
+	doc, err := parseXMLDocument(data)
+	if err != nil {
+		return
+	}
+
+	values = map[string]string{}
+	for _, name := range vPilotJournalFields {
+		if e := findVPilotField(doc, name); e != nil {
+			values[name] = strings.TrimSpace(e.text)
+		}
+	}
+	return
+}
+
+func findVPilotField(doc *xmlDocument, name string) *xmlElement {
+	selected := doc.selectSteps([]xmlStep{{name: name, descendant: true}})
+	if len(selected) == 0 {
+		return nil
+	}
+	return selected[0]
+}
+
+// mergeCachedServers adds the patchfile's cached servers to vPilotConfig.xml,
+// or updates the entries with the same name, and writes the journal.
+func (p *VPilotConfigPatch) mergeCachedServers(before map[string]string) (err error) {
+	file, err := os.OpenFile(p.configPath(), os.O_RDWR, 0666)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	doc, err := parseXMLDocument(data)
+	if err != nil {
+		return
+	}
+
+	var journal vPilotConfigJournal
+	for _, name := range vPilotJournalFields {
+		if e := findVPilotField(doc, name); e != nil && strings.TrimSpace(e.text) != before[name] {
+			journal.Fields = append(journal.Fields, vPilotJournalEntry{Name: name, Before: before[name], After: strings.TrimSpace(e.text)})
+		}
+	}
+
+	list := findVPilotField(doc, "CachedServers")
+	if list == nil {
+		p.report = append(p.report, "merge cached servers: no CachedServers element, skipped")
+	} else {
+		var edits []textEdit
+		var added []string
+		for _, server := range p.patch.CachedServerList {
+			name, _ := parseCachedServer(server)
+
+			var encoded string
+			if encoded, err = encodeVPilotField(server); err != nil {
+				return
+			}
+
+			existing := findCachedServer(list, name)
+			switch {
+			case existing == nil:
+				added = append(added, "<string>"+escapeXMLText(encoded)+"</string>")
+				journal.Servers = append(journal.Servers, vPilotJournalEntry{Name: name, After: encoded})
+			case strings.TrimSpace(existing.text) != encoded:
+				edits = append(edits, doc.setText(existing, encoded))
+				journal.Servers = append(journal.Servers, vPilotJournalEntry{Name: name, Before: strings.TrimSpace(existing.text), After: encoded})
+			}
+		}
+		if len(added) > 0 {
+			var edit textEdit
+			if edit, err = doc.appendChildren(list, func(indent string) string {
+				return strings.Join(added, doc.newline+indent)
+			}); err != nil {
+				return
+			}
+			edits = append(edits, edit)
+		}
+		if err = doc.apply(edits); err != nil {
+			return
+		}
+		p.report = append(p.report, fmt.Sprintf("merge cached servers: added %d, updated %d", len(added), len(journal.Servers)-len(added)))
+	}
+
+	if err = rewriteWholeFile(file, doc.data); err != nil {
+		return
+	}
+
+	journalData, err := json.MarshalIndent(journal, "", "  ")
+	if err != nil {
+		return
+	}
+	if err = os.WriteFile(p.journalPath(), journalData, 0666); err != nil {
+		return
+	}
+
+	return
+}
+
+// findCachedServer returns the entry of a CachedServers element with a name.
+func findCachedServer(list *xmlElement, name string) *xmlElement {
+	for _, e := range list.children {
+		server, err := decodeVPilotField(strings.TrimSpace(e.text))
+		if err != nil {
+			continue
+		}
+		if serverName, err := parseCachedServer(server); err == nil && serverName == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// Revert undoes the changes recorded in the journal that are still in place:
+// added servers are removed, and updated servers and fields get their
+// previous value back. Without a journal, which is only written in merge
+// mode, vPilotConfig.xml is left to be restored from its backup.
+func (p *VPilotConfigPatch) Revert() (files []string, err error) {
+	journalData, err := os.ReadFile(p.journalPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+
+	var journal vPilotConfigJournal
+	if err = json.Unmarshal(journalData, &journal); err != nil {
+		err = fmt.Errorf("invalid journal %s: %w", p.journalPath(), err)
+		return
+	}
+
+	file, err := os.OpenFile(p.configPath(), os.O_RDWR, 0666)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	doc, err := parseXMLDocument(data)
+	if err != nil {
+		return
+	}
+
+	var edits []textEdit
+	for _, entry := range journal.Fields {
+		if e := findVPilotField(doc, entry.Name); e != nil && strings.TrimSpace(e.text) == entry.After {
+			edits = append(edits, doc.setText(e, entry.Before))
+		}
+	}
+	if list := findVPilotField(doc, "CachedServers"); list != nil {
+		for _, entry := range journal.Servers {
+			for _, e := range list.children {
+				if strings.TrimSpace(e.text) != entry.After {
+					continue
+				}
+				if entry.Before == "" {
+					edits = append(edits, doc.remove(e))
+				} else {
+					edits = append(edits, doc.setText(e, entry.Before))
+				}
+				break
+			}
+		}
+	}
+	if err = doc.apply(edits); err != nil {
+		return
+	}
+
+	if err = rewriteWholeFile(file, doc.data); err != nil {
+		return
+	}
+	if err = os.Remove(p.journalPath()); err != nil {
+		return
+	}
+
+	files = append(files, p.configPath())
+	return
+}
@@ -0,0 +1,70 @@
+package patch
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/renorris/openfsd-client-patch-utility/patchfile"
+)
+
+func TestMergeCachedServersSkipsMalformedEntries(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "vPilotConfig.xml")
+
+	existing, err := encodeVPilotField("MAIN|main.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// QUJD is valid base64 but not a whole number of 3DES blocks
+	original := "<Config>\r\n" +
+		"  <NetworkStatusURL>http://status.example.org</NetworkStatusURL>\r\n" +
+		"  <CachedServers>\r\n" +
+		"    <string>QUJD</string>\r\n" +
+		"    <string>" + existing + "</string>\r\n" +
+		"  </CachedServers>\r\n" +
+		"</Config>\r\n"
+	if err = os.WriteFile(configPath, []byte(original), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	patchFile := &patchfile.PatchFile{ExpectedLocation: filepath.Join(dir, "vPilot.exe")}
+	p := NewVPilotConfigPatch(patchFile, &patchfile.VPilotConfigPatch{
+		NetworkStatusURL: "http://status.example.com",
+		CachedServerList: []string{"OPENFSD|fsd.example.com"},
+		CachedServerMode: "merge",
+		Credentials:      "preserve",
+	})
+	if err = p.Run(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, err := encodeVPilotField("OPENFSD|fsd.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"<string>QUJD</string>", "<string>" + existing + "</string>", "<string>" + added + "</string>"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("patched config does not contain %s:\n%s", want, data)
+		}
+	}
+
+	files, err := p.Revert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0] != configPath {
+		t.Errorf("Revert() = %v, want [%s]", files, configPath)
+	}
+	if data, err = os.ReadFile(configPath); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != original {
+		t.Errorf("reverted config:\n%s\nwant:\n%s", data, original)
+	}
+}
@@ -0,0 +1,216 @@
+package patch
+
+import (
+	"errors"
+	"fmt"
+	"github.com/renorris/openfsd-client-patch-utility/patchfile"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// XMLConfigPatch edits an XML settings file of the client, e.g. vPilotConfig.xml
+// or a vatSys profile, through XML paths.
+type XMLConfigPatch struct {
+	patchFile *patchfile.PatchFile
+	patch     *patchfile.XMLConfigPatch
+	report    []string
+}
+
+func NewXMLConfigPatch(patchFile *patchfile.PatchFile, patch *patchfile.XMLConfigPatch) *XMLConfigPatch {
+	return &XMLConfigPatch{patchFile: patchFile, patch: patch}
+}
+
+func (p *XMLConfigPatch) Run(_ *os.File) (err error) {
+	p.report = nil
+
+	transforms, err := newTransformRegistry(p.patchFile.Transforms)
+	if err != nil {
+		return
+	}
+
+	path := p.patch.File
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(p.patchFile.GetTargetFileDirectory(), path)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	data, err := readWholeFile(file)
+	if err != nil {
+		return
+	}
+
+	doc, err := parseXMLDocument(data)
+	if err != nil {
+		err = fmt.Errorf("%s: %w", filepath.Base(path), err)
+		return
+	}
+
+	for _, op := range p.patch.Operations {
+		var line string
+		if line, err = p.runOperation(doc, op, transforms); err != nil {
+			err = fmt.Errorf("%s %s: %w", op.Op, op.Path, err)
+			return
+		}
+		p.report = append(p.report, line)
+	}
+
+	if err = rewriteWholeFile(file, doc.data); err != nil {
+		return
+	}
+
+	return
+}
+
+func (p *XMLConfigPatch) runOperation(doc *xmlDocument, op patchfile.XMLOperation, transforms transformRegistry) (line string, err error) {
+	path, err := parseXMLPath(op.Path)
+	if err != nil {
+		return
+	}
+
+	value, err := transforms.encode(op.Transform, op.Value)
+	if err != nil {
+		return
+	}
+
+	selected := doc.selectSteps(path.steps)
+	if len(selected) == 0 && op.Op != "create_if_missing" {
+		if op.Optional {
+			line = fmt.Sprintf("%s %s: no match, skipped", op.Op, path)
+			return
+		}
+		err = errors.New("path matches nothing")
+		return
+	}
+
+	var edits []textEdit
+	switch op.Op {
+	case "set", "clear":
+		if op.Op == "clear" {
+			value = ""
+		}
+		for _, e := range selected {
+			if path.attribute != "" {
+				edits = append(edits, doc.setAttr(e, path.attribute, value))
+			} else {
+				edits = append(edits, doc.setText(e, value))
+			}
+		}
+	case "append_list":
+		if path.attribute != "" {
+			err = errors.New("cannot append to an attribute")
+			return
+		}
+		item := op.Item
+		if item == "" {
+			item = "string"
+		}
+		var items []string
+		for _, v := range op.Values {
+			if v, err = transforms.encode(op.Transform, v); err != nil {
+				return
+			}
+			items = append(items, "<"+item+">"+escapeXMLText(v)+"</"+item+">")
+		}
+		for _, e := range selected {
+			var edit textEdit
+			if edit, err = doc.appendChildren(e, func(indent string) string {
+				return strings.Join(items, doc.newline+indent)
+			}); err != nil {
+				return
+			}
+			edits = append(edits, edit)
+		}
+		line = fmt.Sprintf("append_list %s: added %d item(s) to %d element(s)", path, len(items), len(selected))
+		return line, doc.apply(edits)
+	case "create_if_missing":
+		return p.create(doc, path, value, selected)
+	default:
+		err = fmt.Errorf("unknown operation %q", op.Op)
+		return
+	}
+
+	line = fmt.Sprintf("%s %s: %d match(es)", op.Op, path, len(selected))
+	err = doc.apply(edits)
+	return
+}
+
+// create adds the elements, or attribute, of a path that does not match
+// anything yet, under the deepest existing element on the path. The missing
+// steps must name a single element each.
+func (p *XMLConfigPatch) create(doc *xmlDocument, path xmlPath, value string, selected []*xmlElement) (line string, err error) {
+	if len(selected) > 0 && path.attribute == "" {
+		line = fmt.Sprintf("create_if_missing %s: exists", path)
+		return
+	}
+
+	// An element with the attribute already set is left alone
+	var missing []*xmlElement
+	for _, e := range selected {
+		if _, ok := e.attr(path.attribute); !ok {
+			missing = append(missing, e)
+		}
+	}
+	if len(selected) > 0 {
+		var edits []textEdit
+		for _, e := range missing {
+			edits = append(edits, doc.setAttr(e, path.attribute, value))
+		}
+		line = fmt.Sprintf("create_if_missing %s: added to %d element(s)", path, len(missing))
+		err = doc.apply(edits)
+		return
+	}
+
+	existing := len(path.steps) - 1
+	var parents []*xmlElement
+	for ; existing > 0; existing-- {
+		if parents = doc.selectSteps(path.steps[:existing]); len(parents) > 0 {
+			break
+		}
+	}
+	if existing == 0 {
+		err = errors.New("the root element does not match")
+		return
+	}
+	if len(parents) > 1 {
+		err = fmt.Errorf("%d elements could hold the new element", len(parents))
+		return
+	}
+	for _, step := range path.steps[existing:] {
+		if step.name == "*" || step.descendant || step.index > 1 {
+			err = fmt.Errorf("cannot create an element for step %s", step.name)
+			return
+		}
+	}
+
+	// With an attribute path, the innermost element gets the attribute and no text
+	leaf := xmlLeaf{text: value}
+	if path.attribute != "" {
+		leaf = xmlLeaf{attribute: path.attribute, attributeValue: value}
+	}
+
+	parent := parents[0]
+	unit := doc.indentUnit(parent)
+	edit, err := doc.appendChildren(parent, func(indent string) string {
+		return doc.renderXMLElements(path.steps[existing:], leaf, indent, unit)
+	})
+	if err != nil {
+		return
+	}
+	line = fmt.Sprintf("create_if_missing %s: created", path)
+	err = doc.apply([]textEdit{edit})
+	return
+}
+
+func (p *XMLConfigPatch) Name() string {
+	return p.patch.Name
+}
+
+func (p *XMLConfigPatch) Report() []string {
+	return p.report
+}
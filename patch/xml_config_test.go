@@ -0,0 +1,142 @@
+package patch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/renorris/openfsd-client-patch-utility/patchfile"
+)
+
+// runConfigPatch writes input to a config file next to a target, runs the
+// patch made by newPatch and returns the file's contents afterwards.
+func runConfigPatch(t *testing.T, name string, input string, newPatch func(patchFile *patchfile.PatchFile, file string) Patch) (output string, err error) {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, name)
+	if err = os.WriteFile(path, []byte(input), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	patchFile := &patchfile.PatchFile{ExpectedLocation: filepath.Join(dir, "client.exe")}
+	if err = newPatch(patchFile, path).Run(nil); err != nil {
+		return
+	}
+
+	data, readErr := os.ReadFile(path)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	return string(data), nil
+}
+
+func TestXMLConfigPatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		operations []patchfile.XMLOperation
+		output     string
+	}{
+		{
+			name:       "set text keeps BOM, declaration and CRLF",
+			input:      "\ufeff<?xml version=\"1.0\"?>\r\n<Config>\r\n  <URL>http://old</URL>\r\n</Config>\r\n",
+			operations: []patchfile.XMLOperation{{Op: "set", Path: "/Config/URL", Value: "http://new?a=1&b=2"}},
+			output:     "\ufeff<?xml version=\"1.0\"?>\r\n<Config>\r\n  <URL>http://new?a=1&amp;b=2</URL>\r\n</Config>\r\n",
+		},
+		{
+			name:       "set self-closing element",
+			input:      "<Config>\n  <URL/>\n</Config>\n",
+			operations: []patchfile.XMLOperation{{Op: "set", Path: "/Config/URL", Value: "x"}},
+			output:     "<Config>\n  <URL>x</URL>\n</Config>\n",
+		},
+		{
+			name:  "set attribute selected by predicate",
+			input: "<Servers>\n  <Server name=\"Main\" host=\"a\"/>\n  <Server name=\"Other\" host=\"b\"/>\n</Servers>\n",
+			operations: []patchfile.XMLOperation{
+				{Op: "set", Path: "/Servers/Server[@name='Main']/@host", Value: "fsd.example.com"},
+			},
+			output: "<Servers>\n  <Server name=\"Main\" host=\"fsd.example.com\"/>\n  <Server name=\"Other\" host=\"b\"/>\n</Servers>\n",
+		},
+		{
+			name:       "clear every descendant",
+			input:      "<Config><A><Name>x</Name></A><Name>y</Name></Config>",
+			operations: []patchfile.XMLOperation{{Op: "clear", Path: "//Name"}},
+			output:     "<Config><A><Name></Name></A><Name></Name></Config>",
+		},
+		{
+			name:       "set with transform",
+			input:      "<Config>\n  <Password>x</Password>\n</Config>\n",
+			operations: []patchfile.XMLOperation{{Op: "set", Path: "/Config/Password", Value: "secret", Transform: "base64"}},
+			output:     "<Config>\n  <Password>c2VjcmV0</Password>\n</Config>\n",
+		},
+		{
+			name:  "append_list follows the indentation",
+			input: "<Config>\n    <List>\n        <string>a</string>\n    </List>\n</Config>\n",
+			operations: []patchfile.XMLOperation{
+				{Op: "append_list", Path: "/Config/List", Values: []string{"b", "c<d"}},
+			},
+			output: "<Config>\n    <List>\n        <string>a</string>\n        <string>b</string>\n        <string>c&lt;d</string>\n    </List>\n</Config>\n",
+		},
+		{
+			name:  "create_if_missing adds the missing elements",
+			input: "<Config>\n  <A>1</A>\n</Config>\n",
+			operations: []patchfile.XMLOperation{
+				{Op: "create_if_missing", Path: "/Config/B/C", Value: "2"},
+				{Op: "create_if_missing", Path: "/Config/A", Value: "3"},
+			},
+			output: "<Config>\n  <A>1</A>\n  <B>\n    <C>2</C>\n  </B>\n</Config>\n",
+		},
+		{
+			name:       "create_if_missing attribute keeps an existing value",
+			input:      "<Config>\n  <A x=\"1\"/>\n  <A/>\n</Config>\n",
+			operations: []patchfile.XMLOperation{{Op: "create_if_missing", Path: "/Config/A/@x", Value: "2"}},
+			output:     "<Config>\n  <A x=\"1\"/>\n  <A x=\"2\"/>\n</Config>\n",
+		},
+		{
+			name:       "optional operation on a missing path",
+			input:      "<Config/>\n",
+			operations: []patchfile.XMLOperation{{Op: "set", Path: "/Config/Missing", Value: "x", Optional: true}},
+			output:     "<Config/>\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output, err := runConfigPatch(t, "config.xml", test.input, func(patchFile *patchfile.PatchFile, file string) Patch {
+				return NewXMLConfigPatch(patchFile, &patchfile.XMLConfigPatch{File: file, Operations: test.operations})
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if output != test.output {
+				t.Errorf("got:\n%q\nwant:\n%q", output, test.output)
+			}
+		})
+	}
+}
+
+func TestXMLConfigPatchErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		operation patchfile.XMLOperation
+	}{
+		{"missing path", "<Config/>", patchfile.XMLOperation{Op: "set", Path: "/Config/Missing"}},
+		{"nested selection", "<A><A>x</A></A>", patchfile.XMLOperation{Op: "set", Path: "//A", Value: "y"}},
+		{"append to attribute", "<Config a=\"1\"/>", patchfile.XMLOperation{Op: "append_list", Path: "/Config/@a"}},
+		{"create under wildcard", "<Config/>", patchfile.XMLOperation{Op: "create_if_missing", Path: "/Config/*"}},
+		{"unknown operation", "<Config/>", patchfile.XMLOperation{Op: "rename", Path: "/Config"}},
+		{"invalid XML", "<Config>", patchfile.XMLOperation{Op: "set", Path: "/Config"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := runConfigPatch(t, "config.xml", test.input, func(patchFile *patchfile.PatchFile, file string) Patch {
+				return NewXMLConfigPatch(patchFile, &patchfile.XMLConfigPatch{File: file, Operations: []patchfile.XMLOperation{test.operation}})
+			})
+			if err == nil {
+				t.Errorf("Run() succeeded, want an error")
+			}
+		})
+	}
+}
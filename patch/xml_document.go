@@ -0,0 +1,444 @@
+package patch
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// xmlDocument is a parsed XML file that keeps the byte ranges of its elements,
+// so that edits are spliced into the original text and leave the formatting,
+// comments and declaration of everything else untouched.
+type xmlDocument struct {
+	textLayout
+	data []byte
+	root *xmlElement
+}
+
+// xmlElement is an element of an xmlDocument.
+type xmlElement struct {
+	// name is the qualified name as written, e.g. Config or x:Setting
+	name   string
+	attrs  []xml.Attr
+	parent *xmlElement
+
+	children []*xmlElement
+
+	// text is the unescaped character data directly inside the element
+	text string
+
+	// start and end delimit the whole element, contentStart and contentEnd
+	// what is between its start and end tags
+	start        int
+	end          int
+	contentStart int
+	contentEnd   int
+	selfClosing  bool
+}
+
+func parseXMLDocument(data []byte) (doc *xmlDocument, err error) {
+	doc = &xmlDocument{textLayout: detectTextLayout(data), data: data}
+	base := doc.contentStart()
+	decoder := xml.NewDecoder(bytes.NewReader(data[base:]))
+
+	var current *xmlElement
+	for {
+		before := base + int(decoder.InputOffset())
+		var token xml.Token
+		if token, err = decoder.RawToken(); err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			err = fmt.Errorf("invalid XML: %w", err)
+			return
+		}
+		after := base + int(decoder.InputOffset())
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			e := &xmlElement{
+				name:         qualifiedXMLName(t.Name),
+				attrs:        slices.Clone(t.Attr),
+				parent:       current,
+				start:        before,
+				contentStart: after,
+				selfClosing:  bytes.HasSuffix(data[before:after], []byte("/>")),
+			}
+			if current != nil {
+				current.children = append(current.children, e)
+			} else if doc.root == nil {
+				doc.root = e
+			}
+			current = e
+		case xml.EndElement:
+			if current == nil {
+				err = errors.New("invalid XML: unexpected end element")
+				return
+			}
+			current.contentEnd = before
+			current.end = after
+			if current.selfClosing {
+				current.contentEnd = current.contentStart
+			}
+			current = current.parent
+		case xml.CharData:
+			if current != nil {
+				current.text += string(t)
+			}
+		}
+	}
+
+	if doc.root == nil {
+		err = errors.New("XML file has no root element")
+		return
+	}
+	// RawToken does not check that every element is closed, e.g. in a truncated file
+	if current != nil {
+		err = fmt.Errorf("invalid XML: element <%s> is not closed", current.name)
+		return
+	}
+	return
+}
+
+func qualifiedXMLName(name xml.Name) string {
+	if name.Space != "" {
+		return name.Space + ":" + name.Local
+	}
+	return name.Local
+}
+
+// attr returns the value of an attribute.
+func (e *xmlElement) attr(name string) (value string, ok bool) {
+	for _, a := range e.attrs {
+		if qualifiedXMLName(a.Name) == name {
+			return a.Value, true
+		}
+	}
+	return
+}
+
+// xmlPath selects elements, or attributes of elements, of a document with a
+// subset of XPath: /Config/CachedServers, //NetworkLogin, /Settings/*,
+// /Servers/Server[2], /Servers/Server[@name='Main']/@host.
+type xmlPath struct {
+	steps []xmlStep
+
+	// attribute is set when the path ends in an attribute
+	attribute string
+}
+
+type xmlStep struct {
+	// name is an element name or *
+	name string
+
+	// descendant matches the step at any depth rather than as a child
+	descendant bool
+
+	// index is the 1-based position among the matches, or 0 for all of them
+	index int
+
+	// attrName and attrValue require an attribute to have a value
+	attrName  string
+	attrValue string
+}
+
+var xmlStepPattern = regexp.MustCompile(`^([\w.:*-]+)((?:\[[^\]]*\])*)$`)
+var xmlPredicatePattern = regexp.MustCompile(`\[([^\]]*)\]`)
+var xmlAttributePredicatePattern = regexp.MustCompile(`^@([\w.:-]+)\s*=\s*(?:'([^']*)'|"([^"]*)")$`)
+
+func parseXMLPath(path string) (p xmlPath, err error) {
+	if !strings.HasPrefix(path, "/") {
+		err = fmt.Errorf("XML path %s must start with /", path)
+		return
+	}
+
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range path {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case '/':
+			if depth == 0 {
+				parts = append(parts, path[start:i])
+				start = i + 1
+			}
+		}
+	}
+	parts = append(parts[1:], path[start:])
+
+	descendant := false
+	for i, part := range parts {
+		if part == "" {
+			if descendant || i == len(parts)-1 {
+				err = fmt.Errorf("invalid XML path %s", path)
+				return
+			}
+			descendant = true
+			continue
+		}
+		if strings.HasPrefix(part, "@") && i == len(parts)-1 && !descendant {
+			p.attribute = part[1:]
+			break
+		}
+
+		match := xmlStepPattern.FindStringSubmatch(part)
+		if match == nil {
+			err = fmt.Errorf("invalid step %s in XML path %s", part, path)
+			return
+		}
+		step := xmlStep{name: match[1], descendant: descendant}
+		descendant = false
+
+		for _, predicate := range xmlPredicatePattern.FindAllStringSubmatch(match[2], -1) {
+			if attribute := xmlAttributePredicatePattern.FindStringSubmatch(predicate[1]); attribute != nil {
+				step.attrName, step.attrValue = attribute[1], attribute[2]+attribute[3]
+			} else if step.index, err = strconv.Atoi(predicate[1]); err != nil || step.index < 1 {
+				err = fmt.Errorf("invalid predicate [%s] in XML path %s", predicate[1], path)
+				return
+			}
+		}
+		p.steps = append(p.steps, step)
+	}
+
+	if len(p.steps) == 0 {
+		err = fmt.Errorf("XML path %s selects no element", path)
+		return
+	}
+	return
+}
+
+func (p xmlPath) String() string {
+	var b strings.Builder
+	for _, step := range p.steps {
+		b.WriteString("/")
+		if step.descendant {
+			b.WriteString("/")
+		}
+		b.WriteString(step.name)
+		if step.attrName != "" {
+			fmt.Fprintf(&b, "[@%s='%s']", step.attrName, step.attrValue)
+		}
+		if step.index != 0 {
+			fmt.Fprintf(&b, "[%d]", step.index)
+		}
+	}
+	if p.attribute != "" {
+		b.WriteString("/@" + p.attribute)
+	}
+	return b.String()
+}
+
+// matches reports whether an element satisfies a step's name and attribute test.
+func (s xmlStep) matches(e *xmlElement) bool {
+	if s.name != "*" && s.name != e.name {
+		return false
+	}
+	if s.attrName != "" {
+		if value, ok := e.attr(s.attrName); !ok || value != s.attrValue {
+			return false
+		}
+	}
+	return true
+}
+
+// selectSteps returns the elements selected by steps, in document order.
+func (doc *xmlDocument) selectSteps(steps []xmlStep) (selected []*xmlElement) {
+	// The document node has the root element as its only child
+	context := []*xmlElement{{children: []*xmlElement{doc.root}}}
+
+	for _, step := range steps {
+		var next []*xmlElement
+		for _, c := range context {
+			var candidates []*xmlElement
+			if step.descendant {
+				walkXMLElements(c, func(e *xmlElement) {
+					if e != c && step.matches(e) {
+						candidates = append(candidates, e)
+					}
+				})
+			} else {
+				for _, child := range c.children {
+					if step.matches(child) {
+						candidates = append(candidates, child)
+					}
+				}
+			}
+			if step.index != 0 {
+				if step.index > len(candidates) {
+					continue
+				}
+				candidates = candidates[step.index-1 : step.index]
+			}
+			for _, e := range candidates {
+				if !slices.Contains(next, e) {
+					next = append(next, e)
+				}
+			}
+		}
+		slices.SortFunc(next, func(a, b *xmlElement) int { return a.start - b.start })
+		context = next
+	}
+	return context
+}
+
+func walkXMLElements(e *xmlElement, fn func(e *xmlElement)) {
+	fn(e)
+	for _, child := range e.children {
+		walkXMLElements(child, fn)
+	}
+}
+
+// apply splices edits into the document and parses it again. Edits must not overlap.
+func (doc *xmlDocument) apply(edits []textEdit) (err error) {
+	ok, err := reparseEdits(doc, doc.data, edits, parseXMLDocument)
+	if err == nil && !ok {
+		err = errors.New("XML path selects nested elements")
+	}
+	return
+}
+
+// setText replaces the content of an element with text.
+func (doc *xmlDocument) setText(e *xmlElement, text string) textEdit {
+	escaped := escapeXMLText(text)
+	if e.selfClosing {
+		if text == "" {
+			return textEdit{start: e.start, end: e.start}
+		}
+		return textEdit{start: e.start, end: e.end, replacement: doc.openTag(e) + escaped + "</" + e.name + ">"}
+	}
+	return textEdit{start: e.contentStart, end: e.contentEnd, replacement: escaped}
+}
+
+// setAttr sets the value of an attribute, adding it to the start tag if missing.
+func (doc *xmlDocument) setAttr(e *xmlElement, name string, value string) textEdit {
+	escaped := escapeXMLText(value)
+	tag := string(doc.data[e.start:e.contentStart])
+
+	pattern := regexp.MustCompile(`(\s` + regexp.QuoteMeta(name) + `\s*=\s*)("[^"]*"|'[^']*')`)
+	if location := pattern.FindStringSubmatchIndex(tag); location != nil {
+		return textEdit{start: e.start + location[4], end: e.start + location[5], replacement: `"` + escaped + `"`}
+	}
+
+	end := len(tag) - 1
+	if e.selfClosing {
+		end--
+	}
+	end = len(strings.TrimRight(tag[:end], " \t\r\n"))
+	return textEdit{start: e.start + end, end: e.start + end, replacement: fmt.Sprintf(` %s="%s"`, name, escaped)}
+}
+
+// remove deletes an element, along with the line break and indentation before
+// it if it starts a line.
+func (doc *xmlDocument) remove(e *xmlElement) textEdit {
+	start := e.start
+	lineStart := bytes.LastIndexByte(doc.data[:start], '\n') + 1
+	if lineStart > 0 && len(bytes.TrimLeft(doc.data[lineStart:start], " \t")) == 0 {
+		start = lineStart - 1
+		if start > 0 && doc.data[start-1] == '\r' {
+			start--
+		}
+	}
+	return textEdit{start: start, end: e.end}
+}
+
+// appendChildren adds markup as the last children of an element, indented
+// like the existing children or one level deeper than the element.
+func (doc *xmlDocument) appendChildren(e *xmlElement, render func(indent string) string) (edit textEdit, err error) {
+	if len(e.children) > 0 {
+		last := e.children[len(e.children)-1]
+		indent := doc.lineIndent(last.start)
+		return textEdit{start: last.end, end: last.end, replacement: doc.newline + indent + render(indent)}, nil
+	}
+	if strings.TrimSpace(e.text) != "" {
+		err = fmt.Errorf("element %s has text content", e.name)
+		return
+	}
+
+	indent := doc.lineIndent(e.start)
+	childIndent := indent + doc.indentUnit(e)
+	content := doc.newline + childIndent + render(childIndent) + doc.newline + indent
+	if e.selfClosing {
+		return textEdit{start: e.start, end: e.end, replacement: doc.openTag(e) + content + "</" + e.name + ">"}, nil
+	}
+	return textEdit{start: e.contentStart, end: e.contentEnd, replacement: content}, nil
+}
+
+// openTag returns the start tag of an element, which is made an open tag if it was self-closing.
+func (doc *xmlDocument) openTag(e *xmlElement) string {
+	tag := string(doc.data[e.start:e.contentStart])
+	if e.selfClosing {
+		tag = strings.TrimRight(strings.TrimSuffix(tag, "/>"), " \t\r\n") + ">"
+	}
+	return tag
+}
+
+// lineIndent returns the whitespace preceding pos on its line, or nothing if
+// pos is not the first non-whitespace character of the line.
+func (doc *xmlDocument) lineIndent(pos int) string {
+	lineStart := bytes.LastIndexByte(doc.data[:pos], '\n') + 1
+	indent := doc.data[lineStart:pos]
+	if len(bytes.TrimLeft(indent, " \t")) != 0 {
+		return ""
+	}
+	return string(indent)
+}
+
+// indentUnit returns the indentation added per nesting level around an element.
+func (doc *xmlDocument) indentUnit(e *xmlElement) string {
+	for ; e != nil; e = e.parent {
+		indent := doc.lineIndent(e.start)
+		if e.parent != nil {
+			if parentIndent := doc.lineIndent(e.parent.start); len(indent) > len(parentIndent) && strings.HasPrefix(indent, parentIndent) {
+				return indent[len(parentIndent):]
+			}
+		}
+		for _, child := range e.children {
+			if childIndent := doc.lineIndent(child.start); len(childIndent) > len(indent) && strings.HasPrefix(childIndent, indent) {
+				return childIndent[len(indent):]
+			}
+		}
+	}
+	return "  "
+}
+
+// xmlLeaf is the content of the innermost element created for a path.
+type xmlLeaf struct {
+	text           string
+	attribute      string
+	attributeValue string
+}
+
+// renderXMLElements renders the nested elements named by steps as they are
+// added to a document. Attribute tests of the steps become attributes.
+func (doc *xmlDocument) renderXMLElements(steps []xmlStep, leaf xmlLeaf, indent string, unit string) string {
+	step := steps[0]
+	open := step.name
+	if step.attrName != "" {
+		open += fmt.Sprintf(` %s="%s"`, step.attrName, escapeXMLText(step.attrValue))
+	}
+	if len(steps) == 1 {
+		if leaf.attribute != "" {
+			open += fmt.Sprintf(` %s="%s"`, leaf.attribute, escapeXMLText(leaf.attributeValue))
+			return "<" + open + "/>"
+		}
+		return "<" + open + ">" + escapeXMLText(leaf.text) + "</" + step.name + ">"
+	}
+
+	inner := indent + unit
+	return "<" + open + ">" + doc.newline + inner + doc.renderXMLElements(steps[1:], leaf, inner, unit) + doc.newline + indent + "</" + step.name + ">"
+}
+
+func escapeXMLText(text string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(text))
+	return b.String()
+}
@@ -1,11 +1,16 @@
 package patchfile
 
 import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"github.com/goccy/go-yaml"
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 )
 
@@ -15,11 +20,85 @@ type PatchFile struct {
 	ExpectedLocation string   `yaml:"expected_location"`
 	MakeBackupsFor   []string `yaml:"make_backups_for"`
 
+	// ExpectedSums are further accepted checksums of the target file. Checksums
+	// are hex-encoded SHA1 or SHA256 sums.
+	ExpectedSums []string `yaml:"expected_sums"`
+
+	// Variants adapt the patchfile to other versions of the target file. The first
+	// variant with a checksum of the target file is applied when no expected sum matches.
+	Variants []Variant `yaml:"variants"`
+
+	// Targets are further files binary patched along with the target file, e.g. DLLs
+	// next to the executable. Each has its own expected_location (relative to the target
+	// file's directory unless absolute), expected_sum, sections and patches. All targets
+	// are verified before any of them is patched, and they are reverted together.
+	Targets []PatchFile `yaml:"targets"`
+
+	// BundleEntry is the path of a file inside a .NET single-file bundle, e.g. vPilot.dll.
+	// When set, the binary patches apply to that file rather than to the bundle itself.
+	BundleEntry string `yaml:"bundle_entry"`
+
+	// ManifestResource is the name of a manifest resource holding an embedded assembly,
+	// e.g. costura.vpilot.network.dll.compressed. When set, the binary patches apply to
+	// the embedded assembly (inside the bundle entry, if one is set).
+	ManifestResource string `yaml:"manifest_resource"`
+
+	// MachOSlice is the architecture of a Mach-O file the binary patches apply to,
+	// e.g. x86_64 or arm64, or "all" to apply them to every slice of a universal binary.
+	// Raw offsets are relative to the start of the slice.
+	MachOSlice string `yaml:"macho_slice"`
+
+	// UpdateChecksum recomputes the PE optional header checksum after all patches succeed
+	UpdateChecksum bool `yaml:"update_checksum"`
+
+	// Authenticode controls what happens to an existing Authenticode signature
+	Authenticode *Authenticode `yaml:"authenticode"`
+
 	Sections                   []Section                  `yaml:"sections"`
+	NewSections                []NewSection               `yaml:"new_sections"`
+	CodeCaves                  []CodeCave                 `yaml:"code_caves"`
+	StringTablePatches         []StringTablePatch         `yaml:"string_table_patches"`
+	VersionInfoPatches         []VersionInfoPatch         `yaml:"version_info_patches"`
 	SectionOverwritePatches    []SectionOverwritePatch    `yaml:"section_overwrite_patches"`
 	SectionPaddedStringPatches []SectionPaddedStringPatch `yaml:"section_padded_string_patches"`
 	CilUserstringPatches       []CilUserstringPatch       `yaml:"cil_userstring_patches"`
+	CilBlobPatches             []CilBlobPatch             `yaml:"cil_blob_patches"`
+	CilStringsPatches          []CilStringsPatch          `yaml:"cil_strings_patches"`
+	ResourcesStringPatches     []ResourcesStringPatch     `yaml:"resources_string_patches"`
+	QtResourcePatches          []QtResourcePatch          `yaml:"qt_resource_patches"`
+	QtStringPatches            []QtStringPatch            `yaml:"qt_string_patches"`
+	DotNetImage                *DotNetImage               `yaml:"dotnet_image"`
 	VPilotConfigPatch          *VPilotConfigPatch         `yaml:"vpilot_config_patch"`
+	XMLConfigPatches           []XMLConfigPatch           `yaml:"xml_config_patches"`
+	JSONConfigPatches          []JSONConfigPatch          `yaml:"json_config_patches"`
+	TextConfigPatches          []TextConfigPatch          `yaml:"text_config_patches"`
+	Transforms                 []Transform                `yaml:"transforms"`
+	URLRedirects               []URLRedirect              `yaml:"url_redirects"`
+	SectionReferencePatches    []SectionReferencePatch    `yaml:"section_reference_patches"`
+}
+
+// Variant holds what differs between versions of a target file, which share
+// the rest of the patchfile, e.g. URLs and config patches.
+type Variant struct {
+	Name string `yaml:"name"`
+	// ExpectedSums are the checksums of the version, SHA1 or SHA256.
+	ExpectedSums []string `yaml:"expected_sums"`
+	// Sections replace the patchfile's sections of the same name, or are added to them.
+	Sections []Section `yaml:"sections"`
+	// Addresses override the section_address of the patchfile's patches, by patch name.
+	Addresses map[string]int64 `yaml:"addresses"`
+}
+
+// Checksums are the hex-encoded SHA1 and SHA256 sums of a target file.
+type Checksums struct {
+	SHA1   string
+	SHA256 string
+}
+
+// Matches reports whether sum is the SHA1 or SHA256 sum of the file.
+func (c Checksums) Matches(sum string) bool {
+	sum = strings.ToLower(sum)
+	return sum != "" && (sum == c.SHA1 || sum == c.SHA256)
 }
 
 // Section defines a binary section like .text or .data.
@@ -32,6 +111,28 @@ type Section struct {
 
 	// VirtualStart specifies the starting virtual address of the section
 	VirtualStart int64 `yaml:"virtual_start"`
+
+	// RawOffset and VirtualStart may be left out to look the section up by
+	// name in the target file, e.g. .rodata in an ELF binary.
+
+	// ImageAddress is the virtual address of the byte at RawOffset once the image is loaded.
+	// It is only set for sections located at patch time (e.g. code caves), whose VirtualStart is 0.
+	ImageAddress int64 `yaml:"-"`
+}
+
+// CodeCave requests a zero-filled region of the target file of a given size and alignment.
+// The region is located and reserved at patch time, then registered as a section named
+// after the cave so that other patches can address it (section_address 0 is its first byte).
+type CodeCave struct {
+	Name      string `yaml:"name"`
+	Size      int64  `yaml:"size"`
+	Alignment int64  `yaml:"alignment"`
+
+	// Sections optionally restricts the search to the named binary sections, e.g. .rdata
+	Sections []string `yaml:"sections"`
+
+	// Executable requests space in an executable section for code stubs
+	Executable bool `yaml:"executable"`
 }
 
 // SectionOverwritePatch overwrites some bytes at a given section address.
@@ -42,6 +143,48 @@ type SectionOverwritePatch struct {
 	NewBytes       []byte `yaml:"new_bytes"`
 }
 
+// Authenticode describes how to handle the Authenticode signature of the target file,
+// which patching invalidates.
+type Authenticode struct {
+	// Action is one of keep (only warn), strip or sign
+	Action string `yaml:"action"`
+
+	// CertificateFile is a PEM file holding the code signing certificate followed by any
+	// intermediate certificates. KeyFile is a PEM file holding the matching private key.
+	// Both are only used by the sign action.
+	CertificateFile string `yaml:"certificate_file"`
+	KeyFile         string `yaml:"key_file"`
+}
+
+// NewSection appends a new zero-filled section to a PE file for patch payloads such as
+// relocated strings and small code stubs. Like a code cave, it is registered as a section
+// with section_address 0 being its first byte, and code caves are allocated from it once
+// slack space in the existing sections is exhausted.
+type NewSection struct {
+	// Name of the section, at most 8 bytes e.g., .ofsd
+	Name       string `yaml:"name"`
+	Size       int64  `yaml:"size"`
+	Executable bool   `yaml:"executable"`
+	Writable   bool   `yaml:"writable"`
+}
+
+// SectionReferencePatch writes a reference to a location in another section, typically a code cave.
+type SectionReferencePatch struct {
+	Name           string `yaml:"name"`
+	Section        string `yaml:"section"`
+	SectionAddress int64  `yaml:"section_address"`
+
+	// Kind is one of rel32 (RIP-relative displacement), abs32 or abs64
+	Kind string `yaml:"kind"`
+
+	// InstructionEnd is the section address a rel32 displacement is relative to.
+	// Defaults to the address following the displacement.
+	InstructionEnd int64 `yaml:"instruction_end"`
+
+	TargetSection string `yaml:"target_section"`
+	TargetAddress int64  `yaml:"target_address"`
+}
+
 // SectionPaddedStringPatch overwrites some bytes at a given section address, padding any unused bytes with NULL characters.
 type SectionPaddedStringPatch struct {
 	Name           string `yaml:"name"`
@@ -62,32 +205,449 @@ type CilUserstringPatch struct {
 	NewString      string `yaml:"new_string"`
 }
 
+// CilBlobPatch replaces string arguments of .NET custom attributes stored in the #Blob heap,
+// e.g. settings default values ([DefaultSettingValue("...")]).
+// https://ecma-international.org/wp-content/uploads/ECMA-335_6th_edition_june_2012.pdf
+// II.23.3 Custom attributes.
+type CilBlobPatch struct {
+	Name string `yaml:"name"`
+
+	// Section and SectionAddress optionally locate the length prefix of the #Blob entry.
+	// Without them, every custom attribute with an argument equal to OldString is patched.
+	Section        string `yaml:"section"`
+	SectionAddress int64  `yaml:"section_address"`
+
+	OldString string `yaml:"old_string"`
+	NewString string `yaml:"new_string"`
+}
+
+// CilStringsPatch replaces an identifier in the .NET #Strings heap, e.g. a manifest resource name.
+// Section and SectionAddress optionally locate the entry; otherwise it is found by OldString.
+type CilStringsPatch struct {
+	Name           string `yaml:"name"`
+	Section        string `yaml:"section"`
+	SectionAddress int64  `yaml:"section_address"`
+	OldString      string `yaml:"old_string"`
+	NewString      string `yaml:"new_string"`
+}
+
+// ResourcesStringPatch replaces a string value in a .resources file embedded in a .NET assembly.
+type ResourcesStringPatch struct {
+	Name string `yaml:"name"`
+	// Resource is the manifest resource name, e.g. VPilot.Properties.Resources.resources
+	Resource  string `yaml:"resource"`
+	Key       string `yaml:"key"`
+	NewString string `yaml:"new_string"`
+}
+
+// QtResourcePatch replaces a file compiled into a Qt resource (.qrc) blob.
+type QtResourcePatch struct {
+	Name string `yaml:"name"`
+	// Path of the resource, e.g. :/qml/Settings.qml
+	Path string `yaml:"path"`
+	// Content replaces the whole file unless Replacements are given.
+	Content string `yaml:"content"`
+	// Replacements are applied to the current content of the file instead.
+	Replacements []TextReplacement `yaml:"replacements"`
+}
+
+// QtStringPatch rewrites every QStringLiteral holding OldString, including its size.
+type QtStringPatch struct {
+	Name      string `yaml:"name"`
+	OldString string `yaml:"old_string"`
+	NewString string `yaml:"new_string"`
+	// QtVersion limits the patch to Qt 5 or Qt 6 literals. By default, both are patched.
+	QtVersion int `yaml:"qt_version"`
+}
+
+// TextReplacement replaces every occurrence of Old with New.
+type TextReplacement struct {
+	Old string `yaml:"old"`
+	New string `yaml:"new"`
+}
+
+// StringTablePatch sets a string of the native RT_STRING resources by its ID.
+type StringTablePatch struct {
+	Name string `yaml:"name"`
+	ID   uint16 `yaml:"id"`
+	// Language limits the patch to one language ID. By default, the string is set in every language.
+	Language uint16 `yaml:"language"`
+	// OldString optionally checks the current value of the string.
+	OldString string `yaml:"old_string"`
+	NewString string `yaml:"new_string"`
+}
+
+// VersionInfoPatch sets a string of the native RT_VERSION resource, e.g. FileDescription or PrivateBuild.
+type VersionInfoPatch struct {
+	Name  string `yaml:"name"`
+	Key   string `yaml:"key"`
+	Value string `yaml:"value"`
+	// Append appends Value to the current value instead of replacing it.
+	Append bool `yaml:"append"`
+}
+
+// DotNetImage controls flags of a .NET assembly that can keep IL and metadata
+// patches from taking effect.
+type DotNetImage struct {
+	// ClearStrongNameFlag clears COMIMAGE_FLAGS_STRONGNAMESIGNED, whose signature
+	// no longer matches once the assembly is patched
+	ClearStrongNameFlag bool `yaml:"clear_strong_name_flag"`
+
+	// RemoveReadyToRun drops the ReadyToRun header so that the runtime compiles
+	// the patched IL instead of running the precompiled native code
+	RemoveReadyToRun bool `yaml:"remove_ready_to_run"`
+}
+
 // VPilotConfigPatch patches an obfuscated vPilotConfig.xml file
 type VPilotConfigPatch struct {
 	NetworkStatusURL string   `yaml:"network_status_url"`
 	CachedServerList []string `yaml:"cached_server_list"`
+
+	// CachedServerMode is replace (default) to replace the cached servers with
+	// CachedServerList, or merge to add or update its NAME|host entries. Merged
+	// changes are recorded in a journal next to the config, so that reverting
+	// undoes them alone rather than restoring the whole file.
+	CachedServerMode string `yaml:"cached_server_mode"`
+
+	// Credentials is what happens to the stored CID and password: clear (default),
+	// preserve, or prompt to ask the user for their openfsd credentials and store them.
+	Credentials string `yaml:"credentials"`
+
+	// CID and Password are the credentials stored in prompt mode. They are given
+	// at patch time rather than in the patchfile.
+	CID      string `yaml:"-"`
+	Password string `yaml:"-"`
+}
+
+// XMLConfigPatch edits an XML settings file of the client.
+type XMLConfigPatch struct {
+	Name string `yaml:"name"`
+	// File is the path of the XML file, relative to the target file's directory unless absolute.
+	File       string         `yaml:"file"`
+	Operations []XMLOperation `yaml:"operations"`
+}
+
+// XMLOperation changes the elements or attributes selected by Path.
+type XMLOperation struct {
+	// Op is set, clear, append_list or create_if_missing.
+	Op string `yaml:"op"`
+	// Path selects elements with a subset of XPath, e.g. /Config/NetworkStatusURL,
+	// //CachedServers, /Servers/Server[2] or /Servers/Server[@name='Main']/@host.
+	Path string `yaml:"path"`
+	// Value is written by set and create_if_missing.
+	Value string `yaml:"value"`
+	// Values are added as child elements by append_list.
+	Values []string `yaml:"values"`
+	// Item is the element name of the children added by append_list, string by default.
+	Item string `yaml:"item"`
+	// Transform encodes values before they are written: plain, base64, hex,
+	// vpilot-3des or the name of a transform defined in the patchfile.
+	Transform string `yaml:"transform"`
+	// Optional operations do nothing when Path matches nothing.
+	Optional bool `yaml:"optional"`
+}
+
+// JSONConfigPatch edits a JSON settings file of the client.
+type JSONConfigPatch struct {
+	Name string `yaml:"name"`
+	// File is the path of the JSON file, relative to the target file's directory unless absolute.
+	File       string          `yaml:"file"`
+	Operations []JSONOperation `yaml:"operations"`
+}
+
+// JSONOperation changes the value at Path.
+type JSONOperation struct {
+	// Op is set, delete, append or merge.
+	Op string `yaml:"op"`
+	// Path is a JSON pointer, e.g. /network/servers/0/host. The empty path is the whole document.
+	Path string `yaml:"path"`
+	// Value is written by set, or merged into the object at Path by merge.
+	// Mappings keep their key order.
+	Value any `yaml:"value"`
+	// Values are added to the array at Path by append.
+	Values []any `yaml:"values"`
+	// Transform encodes string values before they are written, as for XMLOperation.
+	Transform string `yaml:"transform"`
+	// Optional operations do nothing when Path does not exist, or for set, cannot be created.
+	Optional bool `yaml:"optional"`
+}
+
+// TextConfigPatch edits a line-oriented settings file of the client, such as an
+// INI file or a Euroscope profile. Its changes are recorded in a journal next
+// to the file, so that reverting undoes them alone.
+type TextConfigPatch struct {
+	Name string `yaml:"name"`
+	// File is the path of the file, relative to the target file's directory unless absolute.
+	File string `yaml:"file"`
+	// Format is ini for files with [Section] headers, or lines for files of
+	// key-value lines without sections.
+	Format string `yaml:"format"`
+	// Separator is what separates keys from values: = by default in ini files,
+	// a space in line files, e.g. "\t" for Euroscope profiles.
+	Separator  string          `yaml:"separator"`
+	Operations []TextOperation `yaml:"operations"`
+}
+
+// TextOperation changes the lines of a TextConfigPatch file.
+type TextOperation struct {
+	// Op is set, remove or replace.
+	Op string `yaml:"op"`
+	// Section limits the operation to an INI section.
+	Section string `yaml:"section"`
+	// Key selects the line to set or remove.
+	Key string `yaml:"key"`
+	// Value is written by set.
+	Value string `yaml:"value"`
+	// Pattern is a regular expression selecting the lines to remove, or to
+	// replace with Replacement, which may refer to groups as $1.
+	Pattern     string `yaml:"pattern"`
+	Replacement string `yaml:"replacement"`
+}
+
+// Transform defines a named value transform that config patches can reference,
+// describing how a client obfuscates a stored value.
+type Transform struct {
+	Name string `yaml:"name"`
+	// Type is base64, hex, 3des-ecb or aes-cbc.
+	Type string `yaml:"type"`
+	// Key is the hex-encoded cipher key. For aes-cbc, it may be derived with PBKDF2 instead.
+	Key string `yaml:"key"`
+	// Password, Salt, Iterations and Hash (sha1 or sha256, sha1 by default) derive the
+	// aes-cbc key with PBKDF2. Salt is hex-encoded; Iterations default to 1000.
+	Password   string `yaml:"password"`
+	Salt       string `yaml:"salt"`
+	Iterations int    `yaml:"iterations"`
+	Hash       string `yaml:"hash"`
+	// KeySize is the aes-cbc key size in bytes: 16, 24 or 32 (default).
+	KeySize int `yaml:"key_size"`
+	// IV is the hex-encoded aes-cbc IV. DeriveIV takes it from the PBKDF2 output
+	// following the key instead. Without either, a random IV is prepended to the ciphertext.
+	IV       string `yaml:"iv"`
+	DeriveIV bool   `yaml:"derive_iv"`
+	// Output is the text encoding of ciphertext: base64 (default) or hex.
+	Output string `yaml:"output"`
+}
+
+// URLRedirect replaces every occurrence of a URL in the target file with a new URL.
+// The tool decides per occurrence whether to rewrite the string in place, rewrite
+// the .NET #US entry, or relocate the string and retarget its references.
+type URLRedirect struct {
+	Name   string `yaml:"name"`
+	OldURL string `yaml:"old_url"`
+	NewURL string `yaml:"new_url"`
+
+	// AdjustLengths updates string length immediates found next to retargeted
+	// references, e.g. for Qt strings whose length is passed alongside the pointer.
+	AdjustLengths bool `yaml:"adjust_lengths"`
 }
 
 func UnmarshalPatchFile(file io.Reader) (patchFile *PatchFile, err error) {
-	decoder := yaml.NewDecoder(file)
+	// Values of config patches keep the key order of their mappings
+	decoder := yaml.NewDecoder(file, yaml.UseOrderedMap())
 	patchFile = &PatchFile{}
 	if err = decoder.Decode(patchFile); err != nil {
 		return
 	}
 
-	if patchFile.ExpectedLocation, err = formatPath(patchFile.ExpectedLocation); err != nil {
+	if err = patchFile.formatPaths(); err != nil {
+		return
+	}
+	if err = patchFile.validateVariants(); err != nil {
 		return
 	}
 
-	for i := range patchFile.MakeBackupsFor {
-		if patchFile.MakeBackupsFor[i], err = formatPath(patchFile.MakeBackupsFor[i]); err != nil {
+	for i := range patchFile.Targets {
+		target := &patchFile.Targets[i]
+		if err = target.validateTarget(); err != nil {
+			err = fmt.Errorf("target %s: %w", target.ExpectedLocation, err)
+			return
+		}
+		if err = target.formatPaths(); err != nil {
+			return
+		}
+		if err = target.validateVariants(); err != nil {
+			err = fmt.Errorf("target %s: %w", target.ExpectedLocation, err)
 			return
 		}
+		if !filepath.IsAbs(target.ExpectedLocation) {
+			target.ExpectedLocation = filepath.Join(patchFile.GetTargetFileDirectory(), target.ExpectedLocation)
+		}
+		if target.Name == "" {
+			target.Name = filepath.Base(target.ExpectedLocation)
+		}
+	}
+
+	return
+}
+
+// formatPaths replaces the placeholders in the paths of a patchfile or target.
+func (f *PatchFile) formatPaths() (err error) {
+	if f.ExpectedLocation, err = formatPath(f.ExpectedLocation); err != nil {
+		return
+	}
+
+	for i := range f.XMLConfigPatches {
+		if f.XMLConfigPatches[i].File, err = formatPath(f.XMLConfigPatches[i].File); err != nil {
+			return
+		}
+	}
+	for i := range f.JSONConfigPatches {
+		if f.JSONConfigPatches[i].File, err = formatPath(f.JSONConfigPatches[i].File); err != nil {
+			return
+		}
+	}
+	for i := range f.TextConfigPatches {
+		if f.TextConfigPatches[i].File, err = formatPath(f.TextConfigPatches[i].File); err != nil {
+			return
+		}
+	}
+
+	if f.Authenticode != nil {
+		if f.Authenticode.CertificateFile, err = formatPath(f.Authenticode.CertificateFile); err != nil {
+			return
+		}
+		if f.Authenticode.KeyFile, err = formatPath(f.Authenticode.KeyFile); err != nil {
+			return
+		}
+	}
+
+	for i := range f.MakeBackupsFor {
+		if f.MakeBackupsFor[i], err = formatPath(f.MakeBackupsFor[i]); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// validateTarget checks that a target only holds what applies to a single
+// binary: backups, config patches and further targets belong to the patchfile.
+func (f *PatchFile) validateTarget() (err error) {
+	switch {
+	case f.ExpectedLocation == "":
+		err = errors.New("missing expected_location")
+	case len(f.Targets) > 0:
+		err = errors.New("targets cannot have targets")
+	case len(f.MakeBackupsFor) > 0:
+		err = errors.New("make_backups_for belongs to the patchfile")
+	case f.VPilotConfigPatch != nil || len(f.XMLConfigPatches) > 0 || len(f.JSONConfigPatches) > 0 || len(f.TextConfigPatches) > 0:
+		err = errors.New("config patches belong to the patchfile")
+	}
+	return
+}
+
+// validateVariants checks the checksums of a patchfile or target and that its
+// variants only override the addresses of existing patches.
+func (f *PatchFile) validateVariants() (err error) {
+	for _, sum := range f.acceptedSums() {
+		if !isChecksum(sum) {
+			return fmt.Errorf("invalid checksum %q: expected a SHA1 or SHA256 sum", sum)
+		}
+	}
+
+	addresses := f.sectionAddresses()
+	for i := range f.Variants {
+		variant := &f.Variants[i]
+		if len(variant.ExpectedSums) == 0 {
+			return fmt.Errorf("variant %s: missing expected_sums", variant.Name)
+		}
+		if variant.Name == "" {
+			variant.Name = variant.ExpectedSums[0]
+		}
+		for _, sum := range variant.ExpectedSums {
+			if !isChecksum(sum) {
+				return fmt.Errorf("variant %s: invalid checksum %q: expected a SHA1 or SHA256 sum", variant.Name, sum)
+			}
+		}
+		for name := range variant.Addresses {
+			if addresses[name] == nil {
+				return fmt.Errorf("variant %s: no patch named %q has a section address", variant.Name, name)
+			}
+		}
+	}
+	return
+}
+
+// isChecksum reports whether sum is a hex-encoded SHA1 or SHA256 sum.
+func isChecksum(sum string) bool {
+	if len(sum) != 2*sha1.Size && len(sum) != 2*sha256.Size {
+		return false
 	}
+	_, err := hex.DecodeString(sum)
+	return err == nil
+}
 
+// acceptedSums returns the expected checksums of the patchfile's own target file.
+func (f *PatchFile) acceptedSums() (sums []string) {
+	if f.ExpectedSum != "" {
+		sums = append(sums, f.ExpectedSum)
+	}
+	return append(sums, f.ExpectedSums...)
+}
+
+// sectionAddresses returns the section addresses of the patches, by patch name.
+func (f *PatchFile) sectionAddresses() (addresses map[string][]*int64) {
+	addresses = map[string][]*int64{}
+	add := func(name string, address *int64) {
+		addresses[name] = append(addresses[name], address)
+	}
+	for i := range f.SectionOverwritePatches {
+		add(f.SectionOverwritePatches[i].Name, &f.SectionOverwritePatches[i].SectionAddress)
+	}
+	for i := range f.SectionPaddedStringPatches {
+		add(f.SectionPaddedStringPatches[i].Name, &f.SectionPaddedStringPatches[i].SectionAddress)
+	}
+	for i := range f.CilUserstringPatches {
+		add(f.CilUserstringPatches[i].Name, &f.CilUserstringPatches[i].SectionAddress)
+	}
+	for i := range f.CilBlobPatches {
+		add(f.CilBlobPatches[i].Name, &f.CilBlobPatches[i].SectionAddress)
+	}
+	for i := range f.CilStringsPatches {
+		add(f.CilStringsPatches[i].Name, &f.CilStringsPatches[i].SectionAddress)
+	}
+	for i := range f.SectionReferencePatches {
+		add(f.SectionReferencePatches[i].Name, &f.SectionReferencePatches[i].SectionAddress)
+	}
 	return
 }
 
+// SelectVariant reports whether the checksums of the target file match the
+// patchfile, i.e. the file is a known version that is not patched yet. When
+// they match a variant rather than the expected sums, the variant is applied
+// to the patchfile and returned.
+func (f *PatchFile) SelectVariant(sums Checksums) (ok bool, variant *Variant) {
+	if slices.ContainsFunc(f.acceptedSums(), sums.Matches) {
+		return true, nil
+	}
+
+	for i := range f.Variants {
+		if slices.ContainsFunc(f.Variants[i].ExpectedSums, sums.Matches) {
+			variant = &f.Variants[i]
+			f.applyVariant(variant)
+			return true, variant
+		}
+	}
+	return
+}
+
+func (f *PatchFile) applyVariant(variant *Variant) {
+	for _, section := range variant.Sections {
+		if i := slices.IndexFunc(f.Sections, func(s Section) bool { return s.Name == section.Name }); i >= 0 {
+			f.Sections[i] = section
+		} else {
+			f.Sections = append(f.Sections, section)
+		}
+	}
+
+	addresses := f.sectionAddresses()
+	for name, address := range variant.Addresses {
+		for _, sectionAddress := range addresses[name] {
+			*sectionAddress = address
+		}
+	}
+}
+
 func formatPath(path string) (formattedPath string, err error) {
 	// Replace $HOME_DIR placeholder with user's home directory
 	homeDir, err := os.UserHomeDir()
@@ -112,6 +672,25 @@ func (f *PatchFile) GetSection(name string) (section *Section, err error) {
 	return
 }
 
+// Unresolved reports whether the section was declared by name only, to be
+// located in the target file at patch time.
+func (s *Section) Unresolved() bool {
+	return s.RawOffset == 0 && s.VirtualStart == 0 && s.ImageAddress == 0
+}
+
+// AddSection registers a section located at patch time.
+func (f *PatchFile) AddSection(section Section) {
+	f.Sections = append(f.Sections, section)
+}
+
+// AddressOf returns the virtual address of a section address once the image is loaded.
+func (s *Section) AddressOf(sectionAddress int64) int64 {
+	if s.ImageAddress != 0 {
+		return s.ImageAddress + (sectionAddress - s.VirtualStart)
+	}
+	return sectionAddress
+}
+
 func (f *PatchFile) OpenTargetFile() (file *os.File, err error) {
 	if file, err = os.OpenFile(f.ExpectedLocation, os.O_RDWR, 0666); err != nil {
 		return
@@ -119,6 +698,15 @@ func (f *PatchFile) OpenTargetFile() (file *os.File, err error) {
 	return
 }
 
+// AllTargets returns the patchfile itself, for its own target file, followed by its further targets.
+func (f *PatchFile) AllTargets() (targets []*PatchFile) {
+	targets = append(targets, f)
+	for i := range f.Targets {
+		targets = append(targets, &f.Targets[i])
+	}
+	return
+}
+
 func (f *PatchFile) GetTargetFileDirectory() (dir string) {
 	dir = filepath.Dir(f.ExpectedLocation)
 	return